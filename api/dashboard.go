@@ -0,0 +1,20 @@
+package api
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed web
+var webFiles embed.FS
+
+// dashboardHandler serves the embedded web dashboard. The dashboard itself holds
+// no data; it calls the API with the token entered by the user.
+func dashboardHandler() http.Handler {
+	files, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		panic("embedded dashboard files are missing: " + err.Error())
+	}
+	return http.FileServer(http.FS(files))
+}
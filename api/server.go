@@ -0,0 +1,438 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"backupdb/backup"
+	"backupdb/config"
+	"backupdb/history"
+	"backupdb/logger"
+	"backupdb/scheduler"
+	"backupdb/storage"
+)
+
+// Server exposes the HTTP management API
+type Server struct {
+	config    config.APIConfig
+	backups   *backup.BackupService
+	scheduler *scheduler.SchedulerService
+	server    *http.Server
+	log       *logger.Logger
+}
+
+type scheduleStatus struct {
+	Enabled  bool       `json:"enabled"`
+	CronExpr string     `json:"cron_expr"`
+	PrevRun  *time.Time `json:"prev_run,omitempty"`
+	NextRun  *time.Time `json:"next_run,omitempty"`
+}
+
+type backupStatus struct {
+	Name     string         `json:"name"`
+	Type     string         `json:"type"`
+	Storage  []string       `json:"storage"`
+	Schedule scheduleStatus `json:"schedule"`
+	Running  bool           `json:"running"`
+	LastRun  *history.Run   `json:"last_run,omitempty"`
+}
+
+type archiveStatus struct {
+	storage.RemoteArchive
+	Pinned bool `json:"pinned"`
+}
+
+type restoreRequest struct {
+	Storage        string   `json:"storage"`
+	Archive        string   `json:"archive"`
+	Target         string   `json:"target"`
+	Database       string   `json:"database"`
+	TargetDatabase string   `json:"target_database"`
+	Jobs           int      `json:"jobs"`
+	Tables         []string `json:"tables"`
+	Schemas        []string `json:"schemas"`
+	BinlogBackup   string   `json:"binlog_backup"`
+	WALBackup      string   `json:"wal_backup"`
+	Until          string   `json:"until"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// NewServer creates a management API server
+func NewServer(cfg config.APIConfig, backupService *backup.BackupService, schedulerService *scheduler.SchedulerService) *Server {
+	return &Server{
+		config:    cfg,
+		backups:   backupService,
+		scheduler: schedulerService,
+		log:       logger.Get(),
+	}
+}
+
+// Start starts listening in the background
+func (s *Server) Start() error {
+	if s.config.Token == "" {
+		return fmt.Errorf("api token is required")
+	}
+	listen := s.config.Listen
+	if listen == "" {
+		listen = ":8080"
+	}
+
+	s.server = &http.Server{
+		Addr:              listen,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		s.log.Info("API", "Listening on %s", listen)
+		if err := s.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.log.Error("API", "Server stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Shutdown gracefully stops the server
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.server == nil {
+		return nil
+	}
+	return s.server.Shutdown(ctx)
+}
+
+// Handler returns the HTTP handler serving the API
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/api/", s.authenticate(http.HandlerFunc(s.handleAPI)))
+	mux.Handle("/", dashboardHandler())
+	return mux
+}
+
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if s.config.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.config.Token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleAPI routes the API requests:
+//
+//	GET  /api/backups
+//	GET  /api/backups/{name}
+//	POST /api/backups/{name}/run
+//	GET  /api/backups/{name}/history
+//	POST /api/backups/{name}/restore
+//	GET  /api/backups/{name}/storage/{storage}/archives
+//	GET  /api/backups/{name}/storage/{storage}/archives/{archive}
+//	POST /api/backups/{name}/storage/{storage}/archives/{archive}/pin
+//	DELETE /api/backups/{name}/storage/{storage}/archives/{archive}/pin
+func (s *Server) handleAPI(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api"), "/")
+	parts := strings.Split(path, "/")
+	if parts[0] != "backups" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	if len(parts) == 1 {
+		s.requireMethod(w, r, http.MethodGet, s.listBackups)
+		return
+	}
+
+	backupCfg, ok := s.backups.FindBackup(parts[1])
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("backup %s not found", parts[1]))
+		return
+	}
+
+	switch {
+	case len(parts) == 2:
+		s.requireMethod(w, r, http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusOK, s.backupStatus(backupCfg))
+		})
+	case len(parts) == 3 && parts[2] == "run":
+		s.requireMethod(w, r, http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+			s.runBackup(w, backupCfg)
+		})
+	case len(parts) == 3 && parts[2] == "history":
+		s.requireMethod(w, r, http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+			s.listHistory(w, r, backupCfg)
+		})
+	case len(parts) == 3 && parts[2] == "restore":
+		s.requireMethod(w, r, http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+			s.restoreBackup(w, r, backupCfg)
+		})
+	case len(parts) == 5 && parts[2] == "storage" && parts[4] == "archives":
+		s.requireMethod(w, r, http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+			s.listArchives(w, backupCfg, parts[3])
+		})
+	case len(parts) == 6 && parts[2] == "storage" && parts[4] == "archives":
+		s.requireMethod(w, r, http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+			s.downloadArchive(w, backupCfg, parts[3], parts[5])
+		})
+	case len(parts) == 7 && parts[2] == "storage" && parts[4] == "archives" && parts[6] == "pin":
+		switch r.Method {
+		case http.MethodPost:
+			s.pinArchive(w, backupCfg, parts[5], true)
+		case http.MethodDelete:
+			s.pinArchive(w, backupCfg, parts[5], false)
+		default:
+			w.Header().Set("Allow", "POST, DELETE")
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (s *Server) requireMethod(w http.ResponseWriter, r *http.Request, method string, handler http.HandlerFunc) {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	handler(w, r)
+}
+
+func (s *Server) listBackups(w http.ResponseWriter, r *http.Request) {
+	statuses := make([]backupStatus, 0, len(s.backups.Config().Backups))
+	for _, backupCfg := range s.backups.Config().Backups {
+		statuses = append(statuses, s.backupStatus(backupCfg))
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func (s *Server) backupStatus(backupCfg config.BackupConfig) backupStatus {
+	backupType := backupCfg.Type
+	if backupType == "" {
+		backupType = "folder"
+	}
+	status := backupStatus{
+		Name:    backupCfg.Name,
+		Type:    backupType,
+		Storage: backupCfg.Storage,
+		Schedule: scheduleStatus{
+			Enabled:  backupCfg.Scheduler.Enabled,
+			CronExpr: backupCfg.Scheduler.CronExpr,
+		},
+		Running: s.backups.IsRunning(backupCfg.Name),
+	}
+	if status.Storage == nil {
+		status.Storage = []string{}
+	}
+
+	if s.scheduler != nil {
+		if schedule, ok := s.scheduler.Schedule(backupCfg.Name); ok {
+			if !schedule.Prev.IsZero() {
+				status.Schedule.PrevRun = &schedule.Prev
+			}
+			if !schedule.Next.IsZero() {
+				status.Schedule.NextRun = &schedule.Next
+			}
+		}
+	}
+
+	if store := s.backups.History(); store != nil {
+		runs, err := store.List(backupCfg.Name, 1)
+		if err != nil {
+			s.log.Error("API", "[%s] Failed to read run history: %v", backupCfg.Name, err)
+		} else if len(runs) > 0 {
+			status.LastRun = &runs[0]
+		}
+	}
+	return status
+}
+
+func (s *Server) runBackup(w http.ResponseWriter, backupCfg config.BackupConfig) {
+	// The run is reserved before answering, so a run started meanwhile by the
+	// scheduler or another request is reported as a conflict
+	err := s.backups.StartBackup(backupCfg, func(_ *history.Run, err error) {
+		if err != nil {
+			s.log.Error("API", "[%s] Triggered backup failed: %v", backupCfg.Name, err)
+		}
+	})
+	if err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	s.log.Info("API", "[%s] Running backup triggered through the API", backupCfg.Name)
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "started", "backup": backupCfg.Name})
+}
+
+func (s *Server) listHistory(w http.ResponseWriter, r *http.Request, backupCfg config.BackupConfig) {
+	store := s.backups.History()
+	if store == nil {
+		writeJSON(w, http.StatusOK, []history.Run{})
+		return
+	}
+
+	limit := 20
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		limit = parsed
+	}
+
+	runs, err := store.List(backupCfg.Name, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if runs == nil {
+		runs = []history.Run{}
+	}
+	writeJSON(w, http.StatusOK, runs)
+}
+
+func (s *Server) listArchives(w http.ResponseWriter, backupCfg config.BackupConfig, storageName string) {
+	if !hasStorage(backupCfg, storageName) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("backup %s does not use storage %s", backupCfg.Name, storageName))
+		return
+	}
+
+	archives, err := s.backups.Storage().ListArchives(storageName, backupCfg)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	pinned := map[string]bool{}
+	if store := s.backups.History(); store != nil {
+		if pinned, err = store.Pinned(backupCfg.Name); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	statuses := make([]archiveStatus, 0, len(archives))
+	for _, archive := range archives {
+		statuses = append(statuses, archiveStatus{RemoteArchive: archive, Pinned: pinned[archive.Name]})
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func (s *Server) pinArchive(w http.ResponseWriter, backupCfg config.BackupConfig, archiveName string, pin bool) {
+	store := s.backups.History()
+	if store == nil {
+		writeError(w, http.StatusServiceUnavailable, "run history is not enabled")
+		return
+	}
+
+	var err error
+	if pin {
+		err = store.Pin(backupCfg.Name, archiveName)
+	} else {
+		err = store.Unpin(backupCfg.Name, archiveName)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, archiveStatus{RemoteArchive: storage.RemoteArchive{Name: archiveName}, Pinned: pin})
+}
+
+func (s *Server) restoreBackup(w http.ResponseWriter, r *http.Request, backupCfg config.BackupConfig) {
+	var req restoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	if req.Storage != "" && !hasStorage(backupCfg, req.Storage) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("backup %s does not use storage %s", backupCfg.Name, req.Storage))
+		return
+	}
+
+	until, err := backup.ParseRestoreTime(req.Until)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.log.Info("API", "[%s] Restore of %s from %s into %s requested through the API", backupCfg.Name, req.Archive, req.Storage, req.Target)
+	err = s.backups.Restore(backupCfg, backup.RestoreOptions{
+		Storage:        req.Storage,
+		Archive:        req.Archive,
+		TargetDir:      req.Target,
+		Database:       req.Database,
+		TargetDatabase: req.TargetDatabase,
+		Jobs:           req.Jobs,
+		Tables:         req.Tables,
+		Schemas:        req.Schemas,
+		BinlogBackup:   req.BinlogBackup,
+		WALBackup:      req.WALBackup,
+		Until:          until,
+	})
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "restored", "target": req.Target})
+}
+
+func (s *Server) downloadArchive(w http.ResponseWriter, backupCfg config.BackupConfig, storageName, archiveName string) {
+	if !hasStorage(backupCfg, storageName) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("backup %s does not use storage %s", backupCfg.Name, storageName))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", archiveName))
+	writer := &trackingWriter{ResponseWriter: w}
+	if err := s.backups.Storage().DownloadArchive(storageName, backupCfg, archiveName, writer); err != nil {
+		s.log.Error("API", "[%s] Failed to download archive %s from %s: %v", backupCfg.Name, archiveName, storageName, err)
+		if !writer.written {
+			w.Header().Del("Content-Disposition")
+			writeError(w, http.StatusNotFound, err.Error())
+		}
+	}
+}
+
+// hasStorage reports whether a backup is uploaded to the named storage; local archives are always available
+func hasStorage(backupCfg config.BackupConfig, storageName string) bool {
+	if storageName == storage.LocalStorageName {
+		return true
+	}
+	for _, name := range backupCfg.Storage {
+		if name == storageName {
+			return true
+		}
+	}
+	return false
+}
+
+// trackingWriter records whether any part of the response body was written
+type trackingWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (w *trackingWriter) Write(p []byte) (int, error) {
+	w.written = true
+	return w.ResponseWriter.Write(p)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, errorResponse{Error: logger.Redact(message)})
+}
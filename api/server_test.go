@@ -0,0 +1,181 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"backupdb/backup"
+	"backupdb/config"
+	"backupdb/history"
+	"backupdb/scheduler"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestServer(t *testing.T) (*Server, *backup.BackupService) {
+	testDir := "test_api_data"
+	os.MkdirAll(testDir, 0755)
+	os.WriteFile(filepath.Join(testDir, "test.txt"), []byte("test content"), 0644)
+	t.Cleanup(func() {
+		os.RemoveAll(testDir)
+		os.RemoveAll("backups")
+	})
+
+	cfg := &config.Config{
+		Backups: []config.BackupConfig{
+			{Name: "api-test", SourcePath: testDir, Storage: []string{"s3"}},
+		},
+		API: config.APIConfig{Enabled: true, Token: "secret"},
+	}
+	backupService := backup.NewBackupService(cfg)
+	backupService.SetHistory(history.NewStore(filepath.Join(t.TempDir(), "history.db")))
+	return NewServer(cfg.API, backupService, scheduler.NewSchedulerService(cfg)), backupService
+}
+
+func doRequest(server *Server, method, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	server.Handler().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestServerRequiresToken(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	assert.Equal(t, http.StatusUnauthorized, doRequest(server, http.MethodGet, "/api/backups", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, doRequest(server, http.MethodGet, "/api/backups", "wrong").Code)
+	assert.Equal(t, http.StatusOK, doRequest(server, http.MethodGet, "/api/backups", "secret").Code)
+}
+
+func TestServerListBackups(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	rec := doRequest(server, http.MethodGet, "/api/backups", "secret")
+	var statuses []backupStatus
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &statuses))
+	assert.Len(t, statuses, 1)
+	assert.Equal(t, "api-test", statuses[0].Name)
+	assert.Equal(t, "folder", statuses[0].Type)
+
+	assert.Equal(t, http.StatusNotFound, doRequest(server, http.MethodGet, "/api/backups/missing", "secret").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, doRequest(server, http.MethodGet, "/api/backups/api-test/run", "secret").Code)
+}
+
+func TestServerRunAndDownloadLocalArchive(t *testing.T) {
+	server, backupService := newTestServer(t)
+
+	// Run the backup without storage so it only produces a local archive
+	backupCfg, _ := backupService.FindBackup("api-test")
+	backupCfg.Storage = nil
+	assert.NoError(t, backupService.CreateBackup(backupCfg))
+
+	rec := doRequest(server, http.MethodGet, "/api/backups/api-test/storage/local/archives", "secret")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var archives []struct {
+		Name string `json:"name"`
+		Size int64  `json:"size"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &archives))
+	assert.Len(t, archives, 1)
+
+	rec = doRequest(server, http.MethodGet, "/api/backups/api-test/storage/local/archives/"+archives[0].Name, "secret")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/gzip", rec.Header().Get("Content-Type"))
+	assert.Equal(t, archives[0].Size, int64(rec.Body.Len()))
+
+	rec = doRequest(server, http.MethodGet, "/api/backups/api-test/storage/local/archives/other.tar.gz", "secret")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(server, http.MethodGet, "/api/backups/api-test/storage/gdrive/archives", "secret").Code)
+
+	rec = doRequest(server, http.MethodGet, "/api/backups/api-test/history", "secret")
+	var runs []history.Run
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &runs))
+	assert.Len(t, runs, 1)
+	assert.Equal(t, history.StatusSuccess, runs[0].Status)
+}
+
+func TestServerTriggerRun(t *testing.T) {
+	server, backupService := newTestServer(t)
+
+	rec := doRequest(server, http.MethodPost, "/api/backups/api-test/run", "secret")
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+
+	assert.Eventually(t, func() bool {
+		runs, _ := backupService.History().List("api-test", 1)
+		return len(runs) == 1 && !backupService.IsRunning("api-test")
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestServerTriggerRunConflict(t *testing.T) {
+	server, backupService := newTestServer(t)
+
+	// A run of the backup, started elsewhere, waiting for a release file
+	dir := t.TempDir()
+	fakeDump := filepath.Join(dir, "mysqldump")
+	assert.NoError(t, os.WriteFile(fakeDump, []byte("#!/bin/sh\nwhile [ ! -f "+dir+"/release ]; do sleep 0.05; done\necho dump\n"), 0755))
+	done := make(chan error, 1)
+	err := backupService.StartBackup(config.BackupConfig{Name: "api-test", Type: "mysql", DB: &config.DBConfig{Name: "app", MysqldumpPath: fakeDump}}, func(_ *history.Run, err error) {
+		done <- err
+	})
+	assert.NoError(t, err)
+
+	rec := doRequest(server, http.MethodPost, "/api/backups/api-test/run", "secret")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Contains(t, rec.Body.String(), backup.ErrBackupRunning.Error())
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "release"), nil, 0644))
+	assert.NoError(t, <-done)
+	assert.False(t, backupService.IsRunning("api-test"))
+}
+
+func TestServerDashboard(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	rec := doRequest(server, http.MethodGet, "/", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "<title>Backups</title>")
+
+	rec = doRequest(server, http.MethodGet, "/app.js", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestServerPinAndRestore(t *testing.T) {
+	server, backupService := newTestServer(t)
+
+	backupCfg, _ := backupService.FindBackup("api-test")
+	backupCfg.Storage = nil
+	run, err := backupService.RunBackup(backupCfg)
+	assert.NoError(t, err)
+
+	pinPath := "/api/backups/api-test/storage/local/archives/" + run.Archive + "/pin"
+	assert.Equal(t, http.StatusOK, doRequest(server, http.MethodPost, pinPath, "secret").Code)
+
+	rec := doRequest(server, http.MethodGet, "/api/backups/api-test/storage/local/archives", "secret")
+	var archives []archiveStatus
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &archives))
+	assert.Len(t, archives, 1)
+	assert.True(t, archives[0].Pinned)
+
+	assert.Equal(t, http.StatusOK, doRequest(server, http.MethodDelete, pinPath, "secret").Code)
+	pinned, err := backupService.History().Pinned("api-test")
+	assert.NoError(t, err)
+	assert.Empty(t, pinned)
+
+	target := filepath.Join(t.TempDir(), "restored")
+	body := strings.NewReader(`{"storage":"local","archive":"` + run.Archive + `","target":"` + target + `"}`)
+	req := httptest.NewRequest(http.MethodPost, "/api/backups/api-test/restore", body)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	server.Handler().ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.FileExists(t, filepath.Join(target, "test.txt"))
+}
@@ -0,0 +1,215 @@
+(function () {
+  "use strict";
+
+  const tokenKey = "backupdb-token";
+  const backupsEl = document.getElementById("backups");
+  const errorEl = document.getElementById("error");
+  const loginEl = document.getElementById("login");
+  const template = document.getElementById("backup-template");
+
+  function token() {
+    return localStorage.getItem(tokenKey) || "";
+  }
+
+  async function api(method, path, body) {
+    const options = { method: method, headers: { Authorization: "Bearer " + token() } };
+    if (body !== undefined) {
+      options.headers["Content-Type"] = "application/json";
+      options.body = JSON.stringify(body);
+    }
+    const resp = await fetch("api" + path, options);
+    if (resp.status === 401) {
+      showLogin();
+      throw new Error("Invalid API token");
+    }
+    const data = await resp.json();
+    if (!resp.ok) {
+      throw new Error(data.error || resp.statusText);
+    }
+    return data;
+  }
+
+  function enc(value) {
+    return encodeURIComponent(value);
+  }
+
+  function formatTime(value) {
+    return value ? new Date(value).toLocaleString() : "-";
+  }
+
+  function formatSize(bytes) {
+    const units = ["B", "KB", "MB", "GB", "TB"];
+    let size = bytes || 0;
+    let unit = 0;
+    while (size >= 1024 && unit < units.length - 1) {
+      size /= 1024;
+      unit++;
+    }
+    return size.toFixed(unit === 0 ? 0 : 1) + " " + units[unit];
+  }
+
+  function formatDuration(run) {
+    if (!run.finished_at) {
+      return "-";
+    }
+    const seconds = Math.round((new Date(run.finished_at) - new Date(run.started_at)) / 1000);
+    return seconds < 60 ? seconds + "s" : Math.floor(seconds / 60) + "m " + (seconds % 60) + "s";
+  }
+
+  function cell(row, text) {
+    const td = document.createElement("td");
+    td.textContent = text;
+    row.appendChild(td);
+    return td;
+  }
+
+  function showError(err) {
+    errorEl.textContent = err.message || String(err);
+    errorEl.hidden = false;
+  }
+
+  function showLogin() {
+    loginEl.hidden = false;
+    backupsEl.replaceChildren();
+  }
+
+  function renderHistory(section, backup) {
+    const tbody = section.querySelector(".history tbody");
+    api("GET", "/backups/" + enc(backup.name) + "/history?limit=5").then(function (runs) {
+      tbody.replaceChildren();
+      if (runs.length === 0) {
+        const row = tbody.insertRow();
+        cell(row, "No runs recorded").colSpan = 6;
+      }
+      runs.forEach(function (run) {
+        const row = tbody.insertRow();
+        cell(row, formatTime(run.started_at));
+        cell(row, formatDuration(run));
+        const status = cell(row, run.status + (run.stage ? " (" + run.stage + ")" : ""));
+        status.title = run.error || "";
+        cell(row, run.archive || "-");
+        cell(row, formatSize(run.size));
+        cell(row, (run.uploads || []).map(function (u) {
+          return u.storage + ":" + (u.success ? "ok" : "failed");
+        }).join(", ") || "-");
+      });
+    }).catch(showError);
+  }
+
+  function renderStorage(container, backup, storageName) {
+    const details = document.createElement("details");
+    const summary = document.createElement("summary");
+    summary.textContent = storageName + ": loading...";
+    details.appendChild(summary);
+    container.appendChild(details);
+
+    const base = "/backups/" + enc(backup.name) + "/storage/" + enc(storageName) + "/archives";
+    api("GET", base).then(function (archives) {
+      const total = archives.reduce(function (sum, a) { return sum + a.size; }, 0);
+      summary.textContent = storageName + ": " + archives.length + " archives, " + formatSize(total);
+
+      const table = document.createElement("table");
+      const tbody = table.createTBody();
+      archives.forEach(function (archive) {
+        const row = tbody.insertRow();
+        cell(row, archive.name + (archive.pinned ? " (pinned)" : ""));
+        cell(row, formatTime(archive.timestamp));
+        cell(row, formatSize(archive.size));
+        const actions = cell(row, "");
+        actions.className = "actions";
+
+        const pin = document.createElement("button");
+        pin.textContent = archive.pinned ? "Unpin" : "Pin";
+        pin.onclick = function () {
+          api(archive.pinned ? "DELETE" : "POST", base + "/" + enc(archive.name) + "/pin")
+            .then(refresh).catch(showError);
+        };
+        actions.appendChild(pin);
+
+        const restore = document.createElement("button");
+        restore.textContent = "Restore";
+        restore.onclick = function () {
+          const target = prompt("Restore " + archive.name + " into directory (must be empty):");
+          if (!target) {
+            return;
+          }
+          restore.disabled = true;
+          api("POST", "/backups/" + enc(backup.name) + "/restore", { storage: storageName, archive: archive.name, target: target })
+            .then(function () { alert("Restored " + archive.name + " into " + target); })
+            .catch(showError)
+            .finally(function () { restore.disabled = false; });
+        };
+        actions.appendChild(restore);
+      });
+      details.appendChild(table);
+    }).catch(function (err) {
+      summary.textContent = storageName + ": " + err.message;
+    });
+  }
+
+  function renderBackup(backup) {
+    const section = template.content.firstElementChild.cloneNode(true);
+    section.querySelector(".name").textContent = backup.name;
+    section.querySelector(".type").textContent = backup.type;
+    section.querySelector(".schedule").textContent = backup.schedule.enabled ? backup.schedule.cron_expr : "disabled";
+    section.querySelector(".next-run").textContent = formatTime(backup.schedule.next_run);
+
+    const status = section.querySelector(".status");
+    const lastRun = backup.last_run;
+    if (backup.running) {
+      status.textContent = "running";
+      status.classList.add("running");
+    } else if (lastRun) {
+      status.textContent = lastRun.status;
+      status.classList.add(lastRun.status);
+    } else {
+      status.textContent = "never run";
+    }
+    section.querySelector(".last-run").textContent = lastRun
+      ? formatTime(lastRun.started_at) + " - " + lastRun.status + (lastRun.error ? ": " + lastRun.error : "")
+      : "-";
+
+    const run = section.querySelector(".run");
+    run.disabled = backup.running;
+    run.onclick = function () {
+      run.disabled = true;
+      api("POST", "/backups/" + enc(backup.name) + "/run")
+        .then(function () { setTimeout(refresh, 1000); })
+        .catch(showError);
+    };
+
+    renderHistory(section, backup);
+    const storages = section.querySelector(".storages");
+    ["local"].concat(backup.storage).forEach(function (name) {
+      renderStorage(storages, backup, name);
+    });
+    return section;
+  }
+
+  function refresh() {
+    if (!token()) {
+      showLogin();
+      return;
+    }
+    errorEl.hidden = true;
+    api("GET", "/backups").then(function (backups) {
+      loginEl.hidden = true;
+      backupsEl.replaceChildren.apply(backupsEl, backups.map(renderBackup));
+      document.getElementById("updated").textContent = "Updated " + new Date().toLocaleTimeString();
+    }).catch(showError);
+  }
+
+  loginEl.addEventListener("submit", function (event) {
+    event.preventDefault();
+    localStorage.setItem(tokenKey, document.getElementById("token").value);
+    refresh();
+  });
+  document.getElementById("refresh").onclick = refresh;
+  document.getElementById("logout").onclick = function () {
+    localStorage.removeItem(tokenKey);
+    showLogin();
+  };
+
+  refresh();
+  setInterval(refresh, 60000);
+})();
@@ -7,6 +7,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"backupdb/config"
 	"backupdb/logger"
@@ -102,3 +103,134 @@ func (s *ArchiveService) CreateBackupArchive(backup config.BackupConfig, backupF
 	s.log.Info("Archive", "[%s] Backup archive created successfully: %s", backup.Name, backupFile)
 	return nil
 }
+
+// ExtractArchive extracts a tar.gz backup archive into targetDir
+func (s *ArchiveService) ExtractArchive(archiveFile, targetDir string) error {
+	s.log.Info("Archive", "Extracting archive %s into %s", archiveFile, targetDir)
+
+	file, err := os.Open(archiveFile)
+	if err != nil {
+		return fmt.Errorf("failed to open archive file: %v", err)
+	}
+	defer file.Close()
+
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("failed to read gzip stream: %v", err)
+	}
+	defer gzipReader.Close()
+
+	if err := s.ExtractTar(gzipReader, targetDir); err != nil {
+		return err
+	}
+
+	s.log.Info("Archive", "Archive extracted successfully: %s", archiveFile)
+	return nil
+}
+
+// ReadFile returns the content of a file of a tar.gz backup archive, without
+// extracting the others
+func (s *ArchiveService) ReadFile(archiveFile, name string) ([]byte, error) {
+	file, err := os.Open(archiveFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive file: %v", err)
+	}
+	defer file.Close()
+
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read gzip stream: %v", err)
+	}
+	defer gzipReader.Close()
+
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no file %s in archive %s", name, archiveFile)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tar entry: %v", err)
+		}
+		if header.Typeflag == tar.TypeReg && filepath.Clean(header.Name) == name {
+			return io.ReadAll(tarReader)
+		}
+	}
+}
+
+// ExtractTar extracts an uncompressed tar stream into targetDir
+func (s *ArchiveService) ExtractTar(r io.Reader, targetDir string) error {
+	if err := os.MkdirAll(targetDir, 0755); err != nil {
+		return fmt.Errorf("failed to create target directory: %v", err)
+	}
+
+	tarReader := tar.NewReader(r)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar entry: %v", err)
+		}
+
+		target, err := extractPath(targetDir, header.Name)
+		if err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, os.FileMode(header.Mode)|0700); err != nil {
+				return fmt.Errorf("failed to create directory %s: %v", target, err)
+			}
+		case tar.TypeReg:
+			if err := extractFile(tarReader, target, os.FileMode(header.Mode)); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if filepath.IsAbs(header.Linkname) {
+				return fmt.Errorf("refusing to extract absolute symlink %s -> %s", header.Name, header.Linkname)
+			}
+			if _, err := extractPath(targetDir, filepath.Join(filepath.Dir(header.Name), header.Linkname)); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return fmt.Errorf("failed to create directory for %s: %v", target, err)
+			}
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return fmt.Errorf("failed to create symlink %s: %v", target, err)
+			}
+		default:
+			s.log.Info("Archive", "Skipping unsupported tar entry %s (type %c)", header.Name, header.Typeflag)
+		}
+	}
+	return nil
+}
+
+// extractPath resolves an archive entry name inside targetDir, rejecting entries that escape it
+func extractPath(targetDir, name string) (string, error) {
+	target := filepath.Join(targetDir, name)
+	rel, err := filepath.Rel(targetDir, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("archive entry %s escapes the target directory", name)
+	}
+	return target, nil
+}
+
+func extractFile(r io.Reader, target string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %v", target, err)
+	}
+
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return fmt.Errorf("failed to create file %s: %v", target, err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, r); err != nil {
+		return fmt.Errorf("failed to write file %s: %v", target, err)
+	}
+	return file.Close()
+}
@@ -83,3 +83,44 @@ func TestCreateBackupArchive_CannotWriteArchive(t *testing.T) {
 	err := service.CreateBackupArchive(backup, archiveFile)
 	assert.Error(t, err)
 }
+
+func TestExtractArchive_RoundTrip(t *testing.T) {
+	dir := "test_archive_extract"
+	os.MkdirAll(filepath.Join(dir, "nested"), 0755)
+	defer os.RemoveAll(dir)
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0644)
+	os.WriteFile(filepath.Join(dir, "nested", "b.txt"), []byte("world"), 0600)
+
+	archiveFile := "test-extract.tar.gz"
+	defer os.Remove(archiveFile)
+
+	service := NewArchiveService()
+	assert.NoError(t, service.CreateBackupArchive(config.BackupConfig{Name: "extract", SourcePath: dir}, archiveFile))
+
+	target := filepath.Join(t.TempDir(), "restore")
+	assert.NoError(t, service.ExtractArchive(archiveFile, target))
+
+	content, err := os.ReadFile(filepath.Join(target, "a.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(content))
+	content, err = os.ReadFile(filepath.Join(target, "nested", "b.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "world", string(content))
+
+	content, err = service.ReadFile(archiveFile, filepath.Join("nested", "b.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "world", string(content))
+	_, err = service.ReadFile(archiveFile, "missing.txt")
+	assert.ErrorContains(t, err, "no file missing.txt in archive")
+}
+
+func TestExtractPath_RejectsEscapes(t *testing.T) {
+	_, err := extractPath("/restore", "../etc/passwd")
+	assert.Error(t, err)
+	_, err = extractPath("/restore", "a/../../b")
+	assert.Error(t, err)
+
+	target, err := extractPath("/restore", "a/b.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "/restore/a/b.txt", target)
+}
@@ -3,21 +3,28 @@ package backup
 import (
 	"archive/tar"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"backupdb/archive"
 	"backupdb/config"
+	"backupdb/history"
 	"backupdb/logger"
+	"backupdb/secrets"
 	"backupdb/storage"
 )
 
-// BackupTask is the interface for all backup types (folder, mysql, postgres)
+// BackupTask is the interface for all backup types (folder, mysql, mysql_binlog, mysql_physical, postgres, sqlite, mongodb, redis, ...)
 type BackupTask interface {
 	// Run executes the backup process
 	Run(backup config.BackupConfig, backupDir, backupFile string, log *logger.Logger) error
@@ -25,11 +32,33 @@ type BackupTask interface {
 	Kind() string
 }
 
+// databaseTask is implemented by tasks dumping databases, to record the
+// outcome of each dump in the run history
+type databaseTask interface {
+	DatabaseResults() []history.DatabaseResult
+}
+
+// statefulTask is implemented by tasks keeping state across runs, saved once
+// the archive of a run is stored
+type statefulTask interface {
+	SaveState() error
+}
+
+// errNoNewData is returned by tasks finding nothing new to back up, the run
+// succeeds without an archive
+var errNoNewData = errors.New("nothing new to back up")
+
+// ErrBackupRunning is returned when a backup is started while a run of it is still in progress
+var ErrBackupRunning = errors.New("backup is already running")
+
 type BackupService struct {
 	config         *config.Config
 	log            *logger.Logger
 	archiveService *archive.ArchiveService
 	storageService *storage.StorageService
+	history        *history.Store
+	running        map[string]bool
+	mu             sync.Mutex
 }
 
 func NewBackupService(cfg *config.Config) *BackupService {
@@ -38,7 +67,76 @@ func NewBackupService(cfg *config.Config) *BackupService {
 		log:            logger.Get(),
 		archiveService: archive.NewArchiveService(),
 		storageService: storage.NewStorageService(cfg),
+		running:        make(map[string]bool),
+	}
+}
+
+// Config returns the current configuration
+func (s *BackupService) Config() *config.Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.config
+}
+
+// Storage returns the storage service used to upload archives
+func (s *BackupService) Storage() *storage.StorageService {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.storageService
+}
+
+// Reload switches the service to a new configuration and rebuilds the storage providers.
+// Backups already running keep using the providers they started with.
+func (s *BackupService) Reload(cfg *config.Config) {
+	storageService := storage.NewStorageService(cfg)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = cfg
+	s.storageService = storageService
+}
+
+// FindBackup returns the configured backup with the given name
+func (s *BackupService) FindBackup(name string) (config.BackupConfig, bool) {
+	for _, backup := range s.Config().Backups {
+		if backup.Name == name {
+			return backup, true
+		}
 	}
+	return config.BackupConfig{}, false
+}
+
+// IsRunning reports whether a run of the named backup is in progress
+func (s *BackupService) IsRunning(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running[name]
+}
+
+func (s *BackupService) markRunning(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running[name] {
+		return false
+	}
+	s.running[name] = true
+	return true
+}
+
+func (s *BackupService) markDone(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.running, name)
+}
+
+// SetHistory sets the store used to record every backup run
+func (s *BackupService) SetHistory(store *history.Store) {
+	s.history = store
+}
+
+// History returns the run history store, or nil if runs are not recorded
+func (s *BackupService) History() *history.Store {
+	return s.history
 }
 
 // shouldIgnoreFile checks if a file should be ignored based on the ignore patterns
@@ -80,6 +178,18 @@ func (s *BackupService) shouldIgnoreFile(path string, backup config.BackupConfig
 	return false
 }
 
+// pinnedArchives returns the pinned archive names of a backup, which retention must keep
+func (s *BackupService) pinnedArchives(backup config.BackupConfig) (map[string]bool, error) {
+	if s.history == nil {
+		return nil, nil
+	}
+	pinned, err := s.history.Pinned(backup.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pinned archives: %v", err)
+	}
+	return pinned, nil
+}
+
 // cleanupOldBackups removes old backups if they exceed the maximum number allowed
 func (s *BackupService) cleanupOldBackups(backup config.BackupConfig) error {
 	if backup.Scheduler.MaxBackups <= 0 {
@@ -91,6 +201,10 @@ func (s *BackupService) cleanupOldBackups(backup config.BackupConfig) error {
 	if err != nil {
 		return fmt.Errorf("failed to read backup directory: %v", err)
 	}
+	pinned, err := s.pinnedArchives(backup)
+	if err != nil {
+		return err
+	}
 
 	// Sort backups by timestamp in filename (newest first)
 	type backupInfo struct {
@@ -104,7 +218,7 @@ func (s *BackupService) cleanupOldBackups(backup config.BackupConfig) error {
 			continue
 		}
 		name := entry.Name()
-		if !strings.HasSuffix(name, ".tar.gz") {
+		if !strings.HasSuffix(name, ".tar.gz") || pinned[name] {
 			continue
 		}
 		// Extract timestamp from filename (format: YYYYMMDDHHMMSS.NNNNNN.tar.gz)
@@ -120,9 +234,19 @@ func (s *BackupService) cleanupOldBackups(backup config.BackupConfig) error {
 		return backups[i].timestamp > backups[j].timestamp
 	})
 
+	keep := backup.Scheduler.MaxBackups
+	if backup.Type == "mysql_physical" && len(backups) > keep {
+		// An incremental backup is restored on top of the ones before it
+		var older []string
+		for _, old := range backups[keep:] {
+			older = append(older, old.path)
+		}
+		keep += s.physicalChainLength(backup, backups[keep-1].path, older)
+	}
+
 	// Remove old backups
-	if len(backups) > backup.Scheduler.MaxBackups {
-		for i := backup.Scheduler.MaxBackups; i < len(backups); i++ {
+	if len(backups) > keep {
+		for i := keep; i < len(backups); i++ {
 			s.log.Info("Backup", "[%s] Removing old backup: %s", backup.Name, backups[i].path)
 			if err := os.Remove(backups[i].path); err != nil {
 				s.log.Error("Backup", "[%s] Failed to remove old backup: %s: %v", backup.Name, backups[i].path, err)
@@ -135,8 +259,101 @@ func (s *BackupService) cleanupOldBackups(backup config.BackupConfig) error {
 
 // CreateBackup creates a backup of the specified backup configuration
 func (s *BackupService) CreateBackup(backup config.BackupConfig) error {
+	_, err := s.RunBackup(backup)
+	return err
+}
+
+// RunBackup creates a backup of the specified backup configuration and
+// returns the run record, which is also stored in the run history.
+// It returns ErrBackupRunning if a run of the same backup is in progress.
+func (s *BackupService) RunBackup(backup config.BackupConfig) (*history.Run, error) {
+	if !s.markRunning(backup.Name) {
+		return nil, ErrBackupRunning
+	}
+	return s.runReserved(backup)
+}
+
+// StartBackup runs a backup in the background and calls done with the
+// outcome, if not nil. The run is reserved before StartBackup returns: it
+// returns ErrBackupRunning, starting nothing, if a run of the same backup is
+// in progress.
+func (s *BackupService) StartBackup(backup config.BackupConfig, done func(run *history.Run, err error)) error {
+	if !s.markRunning(backup.Name) {
+		return ErrBackupRunning
+	}
+	go func() {
+		run, err := s.runReserved(backup)
+		if done != nil {
+			done(run, err)
+		}
+	}()
+	return nil
+}
+
+// runReserved runs a backup marked as running by markRunning, and clears the mark
+func (s *BackupService) runReserved(backup config.BackupConfig) (*history.Run, error) {
+	defer s.markDone(backup.Name)
+
+	run := &history.Run{
+		Backup:    backup.Name,
+		StartedAt: time.Now(),
+	}
+
+	err := s.runBackup(backup, run)
+	run.FinishedAt = time.Now()
+	if err != nil {
+		run.Status = history.StatusFailed
+		run.Error = logger.Redact(err.Error())
+	} else if failed := failedDatabases(run.Databases); len(failed) > 0 {
+		run.Status = history.StatusPartial
+		run.Error = fmt.Sprintf("failed to dump databases: %s", strings.Join(failed, ", "))
+		s.log.Warn("[%s] Backup completed without %d of %d databases: %s", backup.Name, len(failed), len(run.Databases), strings.Join(failed, ", "))
+	} else {
+		run.Status = history.StatusSuccess
+	}
+
+	if s.history != nil {
+		if recordErr := s.history.Record(run); recordErr != nil {
+			s.log.Error("Backup", "[%s] Failed to record run history: %v", backup.Name, recordErr)
+		}
+	}
+	return run, err
+}
+
+// resolveSecrets returns a copy of a backup with secret references in its
+// settings replaced by their values, fetched for this run only. Secrets are
+// registered with the logger so they are redacted from logs and errors.
+func resolveSecrets(backup config.BackupConfig) (config.BackupConfig, error) {
+	if backup.DB == nil {
+		return backup, nil
+	}
+
+	db := *backup.DB
+	password, err := secrets.Resolve(db.Password)
+	if err != nil {
+		return backup, fmt.Errorf("failed to resolve database password: %v", err)
+	}
+	logger.RegisterSecret(password)
+	db.Password = password
+	uri, err := secrets.Resolve(db.URI)
+	if err != nil {
+		return backup, fmt.Errorf("failed to resolve database URI: %v", err)
+	}
+	if parsed, err := url.Parse(uri); err == nil && parsed.User != nil {
+		if uriPassword, ok := parsed.User.Password(); ok {
+			logger.RegisterSecret(uriPassword)
+		}
+	}
+	db.URI = uri
+	backup.DB = &db
+	return backup, nil
+}
+
+func (s *BackupService) runBackup(backup config.BackupConfig, run *history.Run) error {
 	s.log.Info("Backup", "[%s] Starting backup process for %s (type: %s, source: %s)", backup.Name, backup.Name, backup.Type, backup.SourcePath)
+	storageService := s.Storage()
 
+	run.Stage = history.StageBackup
 	backupDir := filepath.Join("backups", backup.Name)
 	if err := os.MkdirAll(backupDir, 0755); err != nil {
 		return fmt.Errorf("failed to create backup directory: %v", err)
@@ -150,38 +367,123 @@ func (s *BackupService) CreateBackup(backup config.BackupConfig) error {
 	switch backup.Type {
 	case "mysql":
 		task = &MySQLBackup{archiveService: s.archiveService}
+	case "mysql_binlog":
+		task = &MySQLBinlogBackup{archiveService: s.archiveService}
+	case "mysql_physical":
+		task = &MySQLPhysicalBackup{archiveService: s.archiveService}
 	case "postgres":
 		task = &PostgresBackup{archiveService: s.archiveService}
+	case "postgres_basebackup":
+		task = &PostgresBaseBackup{archiveService: s.archiveService}
+	case "postgres_wal":
+		task = &PostgresWALBackup{archiveService: s.archiveService}
+	case "mongodb":
+		task = &MongoDBBackup{archiveService: s.archiveService}
+	case "redis":
+		task = &RedisBackup{archiveService: s.archiveService}
+	case "sqlite":
+		task = &SQLiteBackup{archiveService: s.archiveService}
 	case "folder", "":
 		task = &FolderBackup{archiveService: s.archiveService}
 	default:
 		return fmt.Errorf("unsupported backup type: %s", backup.Type)
 	}
+	backup, err := resolveSecrets(backup)
+	if err != nil {
+		return err
+	}
+
 	// Run backup, only create file if source is valid
-	if err := task.Run(backup, backupDir, backupFile, s.log); err != nil {
+	err = task.Run(backup, backupDir, backupFile, s.log)
+	if dbTask, ok := task.(databaseTask); ok {
+		run.Databases = dbTask.DatabaseResults()
+	}
+	if errors.Is(err, errNoNewData) {
+		os.Remove(backupFile)
+		run.Stage = ""
+		s.log.Info("Backup", "[%s] Backup completed, nothing new to back up: %s", backup.Name, backup.Name)
+		return nil
+	}
+	if err != nil {
 		os.Remove(backupFile) // Ensure no leftover file
 		return err
 	}
+	run.Archive = filepath.Base(backupFile)
+
+	run.Stage = history.StageChecksum
+	checksum, size, err := fileChecksum(backupFile)
+	if err != nil {
+		os.Remove(backupFile)
+		return fmt.Errorf("failed to compute archive checksum: %v", err)
+	}
+	run.Checksum = checksum
+	run.Size = size
 
 	// Only send to storage if backup file exists
 	if len(backup.Storage) > 0 {
-		if err := s.storageService.SendToStorage(backupFile, backup); err != nil {
+		run.Stage = history.StageUpload
+		uploads, err := storageService.SendToStorageWithResults(backupFile, backup)
+		for _, upload := range uploads {
+			result := history.UploadResult{Storage: upload.Storage, Success: upload.Err == nil}
+			if upload.Err != nil {
+				result.Error = logger.Redact(upload.Err.Error())
+			}
+			run.Uploads = append(run.Uploads, result)
+		}
+		if err != nil {
 			os.Remove(backupFile) // Remove only the new backup file
 			return fmt.Errorf("failed to send backup to storage: %v", err)
 		}
-		if err := s.storageService.CleanupRemoteRetention(backup); err != nil {
+
+		run.Stage = history.StageRetention
+		pinned, err := s.pinnedArchives(backup)
+		var deletions []storage.RetentionResult
+		if err == nil {
+			deletions, err = storageService.CleanupRemoteRetentionWithResults(backup, pinned)
+		}
+		for _, deletion := range deletions {
+			result := history.RetentionResult{Storage: deletion.Storage, Deleted: deletion.Deleted}
+			if deletion.Err != nil {
+				result.Error = logger.Redact(deletion.Err.Error())
+			}
+			run.Retention = append(run.Retention, result)
+		}
+		if err != nil {
 			s.log.Error("Backup", "[%s] Failed to clean up remote backups: %v", backup.Name, err)
 		}
 	}
 
+	if stateTask, ok := task.(statefulTask); ok {
+		if err := stateTask.SaveState(); err != nil {
+			s.log.Error("Backup", "[%s] Failed to save backup state: %v", backup.Name, err)
+		}
+	}
+
 	if err := s.cleanupOldBackups(backup); err != nil {
 		s.log.Error("Backup", "[%s] Failed to clean up old backups: %v", backup.Name, err)
 	}
 
+	run.Stage = ""
 	s.log.Info("Backup", "[%s] Backup completed successfully: %s", backup.Name, backup.Name)
 	return nil
 }
 
+// fileChecksum returns the hex encoded SHA-256 and the size of a file
+func fileChecksum(path string) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
 func (s *BackupService) backupFolder(backup config.BackupConfig, backupDir string) error {
 	s.log.Info("Archive", "Starting folder backup for %s (source: %s, backup_dir: %s)", backup.Name, backup.SourcePath, backupDir)
 
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"backupdb/config"
+	"backupdb/history"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -370,3 +371,49 @@ func TestShouldIgnoreFile(t *testing.T) {
 	assert.True(t, service.shouldIgnoreFile(tempDir, cfg.Backups[0]))
 	assert.False(t, service.shouldIgnoreFile(testDir, cfg.Backups[0]))
 }
+
+func TestRunBackupRecordsHistory(t *testing.T) {
+	testDir := "test_data_history"
+	os.MkdirAll(testDir, 0755)
+	defer os.RemoveAll(testDir)
+	os.WriteFile(filepath.Join(testDir, "test.txt"), []byte("test content"), 0644)
+	defer os.RemoveAll("backups")
+
+	service := NewBackupService(&config.Config{})
+	store := history.NewStore(filepath.Join(t.TempDir(), "history.db"))
+	service.SetHistory(store)
+
+	run, err := service.RunBackup(config.BackupConfig{Name: "history-test", SourcePath: testDir})
+	assert.NoError(t, err)
+	assert.Equal(t, history.StatusSuccess, run.Status)
+	assert.Len(t, run.Checksum, 64)
+	assert.Greater(t, run.Size, int64(0))
+
+	_, err = service.RunBackup(config.BackupConfig{Name: "history-test", SourcePath: "non_existent_dir"})
+	assert.Error(t, err)
+
+	runs, err := store.List("history-test", 0)
+	assert.NoError(t, err)
+	assert.Len(t, runs, 2)
+	assert.Equal(t, history.StatusFailed, runs[0].Status)
+	assert.Equal(t, history.StageBackup, runs[0].Stage)
+	assert.Equal(t, run.Archive, runs[1].Archive)
+}
+
+func TestResolveSecrets(t *testing.T) {
+	backupCfg := config.BackupConfig{
+		Name: "secret-test",
+		Type: "mysql",
+		DB:   &config.DBConfig{Name: "app", Password: "exec:echo from-command"},
+	}
+
+	resolved, err := resolveSecrets(backupCfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "from-command", resolved.DB.Password)
+	// The long-lived configuration keeps the reference
+	assert.Equal(t, "exec:echo from-command", backupCfg.DB.Password)
+
+	backupCfg.DB.Password = "exec:exit 1"
+	_, err = resolveSecrets(backupCfg)
+	assert.ErrorContains(t, err, "failed to resolve database password")
+}
@@ -0,0 +1,276 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"backupdb/archive"
+	"backupdb/config"
+	"backupdb/logger"
+	"backupdb/storage"
+)
+
+// walRestoreDir is the directory of the restored data directory the archived
+// WAL files are fetched into, read by restore_command during recovery
+const walRestoreDir = "restore_wal"
+
+// PostgresBaseBackup implements BackupTask for physical backups of a Postgres
+// cluster with pg_basebackup, in tar format with the WAL streamed alongside
+type PostgresBaseBackup struct {
+	archiveService *archive.ArchiveService
+	client         PostgresBackup // Runs the PostgreSQL client programs
+}
+
+// Run takes a base backup of the cluster into base/ of the archive
+func (t *PostgresBaseBackup) Run(backup config.BackupConfig, backupDir, backupFile string, log *logger.Logger) error {
+	if backup.DB == nil {
+		return fmt.Errorf("missing DB config for base backup")
+	}
+
+	conn, closeConn, err := openDBConnection(backup, config.SSHModeExec, 5432)
+	if err != nil {
+		return err
+	}
+	defer closeConn()
+
+	tempDir := filepath.Join(backupDir, "temp_basebackup")
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return fmt.Errorf("failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	bin := "pg_basebackup"
+	if backup.DB.PGBasebackupPath != "" {
+		bin = backup.DB.PGBasebackupPath
+	}
+	args := append(postgresUserArgs(backup.DB), "-Ft", "-X", "stream", "-l", backup.Name)
+	args = append(args, backup.DB.DumpOptions...)
+
+	log.Info("Backup", "[%s] Taking base backup with pg_basebackup", backup.Name)
+	start := time.Now()
+	if !conn.remote() {
+		err = t.client.runClientTo(backup, bin, append(args, "-D", filepath.Join(tempDir, "base")), conn, nil, io.Discard)
+	} else {
+		// The tar files are written to a temporary directory on the SSH host and streamed back
+		script := func(command string) string {
+			return `BASE_DIR=$(mktemp -d) || exit 1; ` + command + ` -D "$BASE_DIR"/base && tar -C "$BASE_DIR" -cf - base; status=$?; rm -rf "$BASE_DIR"; exit $status`
+		}
+		err = extractTarStream(t.archiveService, tempDir, func(stdout io.Writer) error {
+			return t.client.runClientTo(backup, bin, args, conn, script, stdout)
+		})
+	}
+	if err != nil {
+		log.Error("Backup", "[%s] Base backup failed: %v", backup.Name, err)
+		return fmt.Errorf("failed to take base backup: %v", err)
+	}
+	size := pathSize(filepath.Join(tempDir, "base"))
+	log.Info("Backup", "[%s] Base backup taken in %s (%d bytes)", backup.Name, time.Since(start).Round(time.Millisecond), size)
+
+	err = t.archiveService.CreateBackupArchive(config.BackupConfig{
+		Name:       backup.Name,
+		SourcePath: tempDir,
+	}, backupFile)
+	if err != nil {
+		os.Remove(backupFile)
+		return fmt.Errorf("failed to create archive for base backup: %v", err)
+	}
+	return nil
+}
+
+// Kind returns the type of backup
+func (t *PostgresBaseBackup) Kind() string { return "postgres_basebackup" }
+
+// PostgresWALBackup implements BackupTask for the WAL archive of a Postgres
+// cluster. Each run archives the single WAL file in source_path, set by
+// -wal-push when Postgres runs it as its archive_command.
+type PostgresWALBackup struct {
+	archiveService *archive.ArchiveService
+}
+
+// Run archives the WAL file
+func (t *PostgresWALBackup) Run(backup config.BackupConfig, backupDir, backupFile string, log *logger.Logger) error {
+	if backup.SourcePath == "" {
+		return fmt.Errorf("no WAL file to archive, postgres_wal backups run from archive_command with -wal-push")
+	}
+	info, err := os.Stat(backup.SourcePath)
+	if err != nil {
+		return fmt.Errorf("failed to access WAL file: %v", err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("WAL file %s is not a regular file", backup.SourcePath)
+	}
+
+	tempDir, err := os.MkdirTemp(backupDir, "temp_wal_")
+	if err != nil {
+		return fmt.Errorf("failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	if err := copyFile(backup.SourcePath, filepath.Join(tempDir, info.Name())); err != nil {
+		return fmt.Errorf("failed to copy WAL file: %v", err)
+	}
+
+	err = t.archiveService.CreateBackupArchive(config.BackupConfig{
+		Name:       backup.Name,
+		SourcePath: tempDir,
+	}, backupFile)
+	if err != nil {
+		os.Remove(backupFile)
+		return fmt.Errorf("failed to create archive for WAL file: %v", err)
+	}
+	log.Info("Backup", "[%s] Archived WAL file %s", backup.Name, info.Name())
+	return nil
+}
+
+// Kind returns the type of backup
+func (t *PostgresWALBackup) Kind() string { return "postgres_wal" }
+
+// PushWAL archives a WAL file with a postgres_wal backup, for archive_command.
+// It fails unless the file reached at least one storage, so Postgres retries.
+func (s *BackupService) PushWAL(backup config.BackupConfig, walPath string) error {
+	if backup.Type != "postgres_wal" {
+		return fmt.Errorf("%s is not a postgres_wal backup", backup.Name)
+	}
+	backup.SourcePath = walPath
+	_, err := s.RunBackup(backup)
+	return err
+}
+
+// backupLabelPattern matches the first WAL file of a base backup in its backup_label
+var backupLabelPattern = regexp.MustCompile(`START WAL LOCATION: \S+ \(file ([0-9A-F]{24})\)`)
+
+// preparePostgresRecovery turns an extracted base backup into a data
+// directory: base.tar and pg_wal.tar are unpacked into the target directory.
+// With a WAL backup, its files are fetched into restore_wal/ and recovery is
+// configured to replay them, up to opts.Until if set, when the server starts.
+func (s *BackupService) preparePostgresRecovery(opts RestoreOptions) error {
+	baseDir := filepath.Join(opts.TargetDir, "base")
+	entries, err := os.ReadDir(baseDir)
+	if err != nil {
+		return fmt.Errorf("no base backup in the archive: %v", err)
+	}
+	var tablespaces []string
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(baseDir, name)
+		switch name {
+		case "base.tar", "base.tar.gz":
+			err = s.extractTarFile(path, opts.TargetDir)
+		case "pg_wal.tar", "pg_wal.tar.gz":
+			err = s.extractTarFile(path, filepath.Join(opts.TargetDir, "pg_wal"))
+		case "backup_manifest":
+			err = os.Rename(path, filepath.Join(opts.TargetDir, name))
+		default:
+			tablespaces = append(tablespaces, name)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to unpack %s: %v", name, err)
+		}
+		os.Remove(path)
+	}
+	if len(tablespaces) == 0 {
+		os.Remove(baseDir)
+	} else {
+		s.log.Warn("[Restore] Tablespaces %s are left in %s, extract them to their locations", strings.Join(tablespaces, ", "), baseDir)
+	}
+	// Postgres refuses to start on a data directory readable by others
+	if err := os.Chmod(opts.TargetDir, 0700); err != nil {
+		return fmt.Errorf("failed to restrict data directory permissions: %v", err)
+	}
+	if opts.WALBackup == "" {
+		return nil
+	}
+
+	walBackup, ok := s.FindBackup(opts.WALBackup)
+	if !ok || walBackup.Type != "postgres_wal" {
+		return fmt.Errorf("%s is not a postgres_wal backup", opts.WALBackup)
+	}
+	label, err := os.ReadFile(filepath.Join(opts.TargetDir, "backup_label"))
+	if err != nil {
+		return fmt.Errorf("failed to read backup_label: %v", err)
+	}
+	matches := backupLabelPattern.FindSubmatch(label)
+	if matches == nil {
+		return fmt.Errorf("no start WAL location in backup_label")
+	}
+	walDir, err := filepath.Abs(filepath.Join(opts.TargetDir, walRestoreDir))
+	if err != nil {
+		return fmt.Errorf("failed to resolve WAL directory: %v", err)
+	}
+	if err := s.fetchWAL(walBackup, opts.Storage, walDir, string(matches[1])); err != nil {
+		return err
+	}
+
+	restoreCommand := "cp " + shellQuote(walDir) + "/%f %p"
+	settings := fmt.Sprintf("\n# Recovery from %s, added by backupdb\nrestore_command = %s\n", walBackup.Name, postgresConfigQuote(restoreCommand))
+	if !opts.Until.IsZero() {
+		settings += fmt.Sprintf("recovery_target_time = '%s'\nrecovery_target_action = 'promote'\n", opts.Until.Format("2006-01-02 15:04:05-07:00"))
+	}
+	autoConf, err := os.OpenFile(filepath.Join(opts.TargetDir, "postgresql.auto.conf"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open postgresql.auto.conf: %v", err)
+	}
+	_, err = autoConf.WriteString(settings)
+	if closeErr := autoConf.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write recovery settings: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(opts.TargetDir, "recovery.signal"), nil, 0600); err != nil {
+		return fmt.Errorf("failed to write recovery.signal: %v", err)
+	}
+	return nil
+}
+
+// extractTarFile extracts a tar file, gzipped if its name ends with .gz
+func (s *BackupService) extractTarFile(path, dir string) error {
+	if strings.HasSuffix(path, ".gz") {
+		return s.archiveService.ExtractArchive(path, dir)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return s.archiveService.ExtractTar(file, dir)
+}
+
+// fetchWAL downloads the archives of a WAL backup, newest first, until the one
+// holding the start WAL file, and extracts them into dir
+func (s *BackupService) fetchWAL(walBackup config.BackupConfig, storageName, dir, start string) error {
+	if storageName == "" {
+		storageName = storage.LocalStorageName
+	}
+	archives, err := s.Storage().ListArchives(storageName, walBackup)
+	if err != nil {
+		return fmt.Errorf("failed to list WAL archives: %v", err)
+	}
+
+	for i, remoteArchive := range archives {
+		archivePath, cleanup, err := s.fetchArchive(walBackup, storageName, remoteArchive.Name, time.Time{})
+		if err != nil {
+			return err
+		}
+		err = s.archiveService.ExtractArchive(archivePath, dir)
+		cleanup()
+		if err != nil {
+			return fmt.Errorf("failed to extract WAL archive %s: %v", remoteArchive.Name, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, start)); err == nil {
+			s.log.Info("Restore", "[%s] Fetched %d WAL archives from %s on", walBackup.Name, i+1, start)
+			return nil
+		}
+	}
+	return fmt.Errorf("WAL file %s is not in the archives of %s", start, walBackup.Name)
+}
+
+// postgresConfigQuote quotes a value for a single quoted postgresql.conf string
+func postgresConfigQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
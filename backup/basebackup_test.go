@@ -0,0 +1,82 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"backupdb/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPostgresBaseBackup_RestoreWithWAL(t *testing.T) {
+	defer os.RemoveAll("backups")
+	// A fake pg_basebackup writing base.tar and pg_wal.tar into the -D directory
+	dir := t.TempDir()
+	fakeBasebackup := filepath.Join(dir, "pg_basebackup")
+	script := `#!/bin/sh
+out=""
+prev=""
+for arg; do
+  [ "$prev" = "-D" ] && out="$arg"
+  prev="$arg"
+done
+stage=$(mktemp -d)
+mkdir -p "$stage/data" "$stage/wal" "$out"
+echo 16 > "$stage/data/PG_VERSION"
+printf 'START WAL LOCATION: 0/2000028 (file 000000010000000000000002)\nLABEL: %s\n' "$*" > "$stage/data/backup_label"
+echo wal > "$stage/wal/000000010000000000000002"
+tar -C "$stage/data" -cf "$out/base.tar" . && tar -C "$stage/wal" -cf "$out/pg_wal.tar" .
+status=$?
+rm -rf "$stage"
+exit $status
+`
+	assert.NoError(t, os.WriteFile(fakeBasebackup, []byte(script), 0755))
+
+	baseCfg := config.BackupConfig{
+		Name: "pg-base",
+		Type: "postgres_basebackup",
+		DB:   &config.DBConfig{User: "replicator", PGBasebackupPath: fakeBasebackup},
+	}
+	walCfg := config.BackupConfig{Name: "pg-wal", Type: "postgres_wal"}
+	service := NewBackupService(&config.Config{Backups: []config.BackupConfig{baseCfg, walCfg}})
+	run, err := service.RunBackup(baseCfg)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, run.Archive)
+
+	// Postgres archives each WAL file with -wal-push
+	walDir := filepath.Join(dir, "pg_wal")
+	assert.NoError(t, os.MkdirAll(walDir, 0755))
+	for segment := 1; segment <= 4; segment++ {
+		walFile := filepath.Join(walDir, fmt.Sprintf("0000000100000000000000%02d", segment))
+		assert.NoError(t, os.WriteFile(walFile, []byte("wal"), 0600))
+		assert.NoError(t, service.PushWAL(walCfg, walFile))
+	}
+	assert.ErrorContains(t, service.PushWAL(baseCfg, filepath.Join(walDir, "000000010000000000000001")), "pg-base is not a postgres_wal backup")
+
+	until := time.Now().Add(time.Hour)
+	target := filepath.Join(dir, "data")
+	err = service.Restore(baseCfg, RestoreOptions{TargetDir: target, WALBackup: "pg-wal", Until: until})
+	assert.NoError(t, err)
+
+	assert.FileExists(t, filepath.Join(target, "PG_VERSION"))
+	assert.FileExists(t, filepath.Join(target, "pg_wal", "000000010000000000000002"))
+	assert.NoDirExists(t, filepath.Join(target, "base"))
+	info, err := os.Stat(target)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	// Fetched from the newest archive down to the start of the base backup
+	assert.FileExists(t, filepath.Join(target, walRestoreDir, "000000010000000000000002"))
+	assert.FileExists(t, filepath.Join(target, walRestoreDir, "000000010000000000000004"))
+	assert.NoFileExists(t, filepath.Join(target, walRestoreDir, "000000010000000000000001"))
+	assert.FileExists(t, filepath.Join(target, "recovery.signal"))
+	autoConf, err := os.ReadFile(filepath.Join(target, "postgresql.auto.conf"))
+	assert.NoError(t, err)
+	absTarget, _ := filepath.Abs(target)
+	assert.Contains(t, string(autoConf), "restore_command = 'cp "+filepath.Join(absTarget, walRestoreDir)+"/%f %p'\n")
+	assert.Contains(t, string(autoConf), "recovery_target_time = '"+until.Format("2006-01-02 15:04:05-07:00")+"'\n")
+}
@@ -0,0 +1,483 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"backupdb/archive"
+	"backupdb/config"
+	"backupdb/logger"
+	"backupdb/storage"
+)
+
+const (
+	binlogManifestFile = "binlogs.json"      // Binlogs of an archive, in the archive
+	binlogStateFile    = "binlog_state.json" // Newest stored binlog, in the local backup directory
+)
+
+// MySQLBinlogBackup implements BackupTask for MySQL binary log archiving.
+// Each run archives the binlogs closed since the previous run, fetched with
+// mysqlbinlog --read-from-remote-server --raw.
+type MySQLBinlogBackup struct {
+	archiveService *archive.ArchiveService
+	client         MySQLBackup // Runs the MySQL client programs
+	statePath      string
+	state          binlogState // Saved once the archive of the run is stored
+}
+
+// binlogFile is a binary log of the server
+type binlogFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// binlogManifest lists the binlogs of an archive
+type binlogManifest struct {
+	Backup    string       `json:"backup"`
+	CreatedAt time.Time    `json:"created_at"`
+	Files     []binlogFile `json:"files"`
+}
+
+// binlogState records where the next run starts
+type binlogState struct {
+	LastFile string `json:"last_file"` // Newest binlog archived and stored
+}
+
+// Run archives the binlogs closed since the last stored archive
+func (t *MySQLBinlogBackup) Run(backup config.BackupConfig, backupDir, backupFile string, log *logger.Logger) error {
+	if backup.DB == nil {
+		return fmt.Errorf("missing DB config for binlog backup")
+	}
+
+	t.statePath = filepath.Join(backupDir, binlogStateFile)
+	state, err := loadBinlogState(t.statePath)
+	if err != nil {
+		return err
+	}
+
+	conn, closeConn, err := openDBConnection(backup, config.SSHModeTunnel, 3306)
+	if err != nil {
+		return err
+	}
+	defer closeConn()
+
+	serverFiles, err := t.listBinlogs(backup, conn)
+	if err != nil {
+		return err
+	}
+	active := serverFiles[len(serverFiles)-1]
+	if state.LastFile != "" && compareBinlogs(active.Name, state.LastFile) < 0 {
+		log.Warn("[%s] The server binlogs restart at %s before the last archived %s, archiving them from the oldest", backup.Name, serverFiles[0].Name, state.LastFile)
+		state.LastFile = ""
+	}
+	files := pendingBinlogs(serverFiles[:len(serverFiles)-1], state.LastFile, backup.DB.BinlogStartFile)
+	if len(files) == 0 {
+		log.Info("Backup", "[%s] No closed binlog since %s, %s is still being written", backup.Name, state.LastFile, active.Name)
+		return errNoNewData
+	}
+	if state.LastFile != "" {
+		if _, last := binlogSequence(state.LastFile); last >= 0 {
+			if _, first := binlogSequence(files[0].Name); first != last+1 {
+				log.Warn("[%s] Binlogs between %s and %s were purged from the server before being archived", backup.Name, state.LastFile, files[0].Name)
+			}
+		}
+	}
+
+	tempDir := filepath.Join(backupDir, "temp_binlogs")
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return fmt.Errorf("failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	names := make([]string, len(files))
+	for i, file := range files {
+		names[i] = file.Name
+	}
+	log.Info("Backup", "[%s] Fetching %d binlogs: %s to %s", backup.Name, len(names), names[0], names[len(names)-1])
+	if err := t.fetchBinlogs(backup, names, tempDir, conn); err != nil {
+		log.Error("Backup", "[%s] Binlog fetch failed: %v", backup.Name, err)
+		return fmt.Errorf("failed to fetch binlogs: %v", err)
+	}
+
+	manifest := binlogManifest{Backup: backup.Name, CreatedAt: time.Now(), Files: files}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode binlog manifest: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tempDir, binlogManifestFile), data, 0644); err != nil {
+		return fmt.Errorf("failed to write binlog manifest: %v", err)
+	}
+
+	err = t.archiveService.CreateBackupArchive(config.BackupConfig{
+		Name:       backup.Name,
+		SourcePath: tempDir,
+	}, backupFile)
+	if err != nil {
+		os.Remove(backupFile)
+		return fmt.Errorf("failed to create archive for binlog backup: %v", err)
+	}
+
+	t.state = binlogState{LastFile: names[len(names)-1]}
+	log.Info("Backup", "[%s] Successfully created backup archive with %d binlogs", backup.Name, len(names))
+	return nil
+}
+
+// listBinlogs returns the binlogs of the server, the last one being written.
+// With flush_binlogs the current binlog is rotated first so it is closed.
+func (t *MySQLBinlogBackup) listBinlogs(backup config.BackupConfig, conn *dbConnection) ([]binlogFile, error) {
+	bin := "mysql"
+	if backup.DB.MySQLPath != "" {
+		bin = backup.DB.MySQLPath
+	}
+	if backup.DB.FlushBinlogs {
+		if _, err := t.client.runClient(backup, bin, []string{"-e", "FLUSH BINARY LOGS"}, conn); err != nil {
+			return nil, fmt.Errorf("failed to flush binlogs: %v", err)
+		}
+	}
+	out, err := t.client.runClient(backup, bin, []string{"-N", "-e", "SHOW BINARY LOGS"}, conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list binlogs: %v", err)
+	}
+
+	var files []binlogFile
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		size, _ := strconv.ParseInt(fields[1], 10, 64)
+		files = append(files, binlogFile{Name: fields[0], Size: size})
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("the server has no binlogs, is binary logging enabled?")
+	}
+	return files, nil
+}
+
+// fetchBinlogs copies binlogs of the server into dir. On the SSH host they are
+// written to a temporary directory sent back as a tar stream.
+func (t *MySQLBinlogBackup) fetchBinlogs(backup config.BackupConfig, names []string, dir string, conn *dbConnection) error {
+	bin := "mysqlbinlog"
+	if backup.DB.MysqlbinlogPath != "" {
+		bin = backup.DB.MysqlbinlogPath
+	}
+	args := []string{"--read-from-remote-server", "--raw"}
+	if !conn.remote() {
+		// The result file is a prefix the binlog names are appended to
+		args = append(args, "--result-file="+dir+string(filepath.Separator))
+		return t.client.runClientTo(backup, bin, append(args, names...), conn, nil, nil, io.Discard)
+	}
+
+	script := func(command string) string {
+		return `BINLOG_DIR=$(mktemp -d) || exit 1; ` + command + ` --result-file="$BINLOG_DIR"/ ` + shellJoin(names) +
+			` && tar -C "$BINLOG_DIR" -cf - ` + shellJoin(names) + `; status=$?; rm -rf "$BINLOG_DIR"; exit $status`
+	}
+	return extractTarStream(t.archiveService, dir, func(stdout io.Writer) error {
+		return t.client.runClientTo(backup, bin, args, conn, script, nil, stdout)
+	})
+}
+
+// SaveState records the newest archived binlog, once the archive is stored
+func (t *MySQLBinlogBackup) SaveState() error {
+	if t.state.LastFile == "" {
+		return nil
+	}
+	if err := writeStateFile(t.statePath, t.state); err != nil {
+		return fmt.Errorf("failed to write binlog state: %v", err)
+	}
+	return nil
+}
+
+// Kind returns the type of backup
+func (t *MySQLBinlogBackup) Kind() string { return "mysql_binlog" }
+
+// loadBinlogState reads the state of a binlog backup, empty before its first stored archive
+func loadBinlogState(path string) (binlogState, error) {
+	var state binlogState
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("failed to read binlog state: %v", err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("failed to parse binlog state %s: %v", path, err)
+	}
+	return state, nil
+}
+
+// pendingBinlogs returns the closed binlogs after lastFile or, before the
+// first archive, from startFile on
+func pendingBinlogs(closed []binlogFile, lastFile, startFile string) []binlogFile {
+	var pending []binlogFile
+	for _, file := range closed {
+		if lastFile != "" && compareBinlogs(file.Name, lastFile) <= 0 {
+			continue
+		}
+		if lastFile == "" && startFile != "" && compareBinlogs(file.Name, startFile) < 0 {
+			continue
+		}
+		pending = append(pending, file)
+	}
+	return pending
+}
+
+// binlogSequence splits a binlog name, <base>.<number>, returning -1 as the
+// number if it has none
+func binlogSequence(name string) (string, int) {
+	i := strings.LastIndex(name, ".")
+	if i < 0 {
+		return name, -1
+	}
+	number, err := strconv.Atoi(name[i+1:])
+	if err != nil {
+		return name, -1
+	}
+	return name[:i], number
+}
+
+// compareBinlogs orders binlog names by their sequence number, which may
+// outgrow the zero padding
+func compareBinlogs(a, b string) int {
+	aBase, aNumber := binlogSequence(a)
+	bBase, bNumber := binlogSequence(b)
+	if aBase != bBase || aNumber < 0 || bNumber < 0 {
+		return strings.Compare(a, b)
+	}
+	switch {
+	case aNumber < bNumber:
+		return -1
+	case aNumber > bNumber:
+		return 1
+	}
+	return 0
+}
+
+// binlogPosition is the binlog coordinates a dump was taken at
+type binlogPosition struct {
+	File     string
+	Position int64
+}
+
+// binlogPositionPattern matches the coordinates written by mysqldump --source-data
+// (CHANGE REPLICATION SOURCE TO) or its older --master-data (CHANGE MASTER TO)
+var binlogPositionPattern = regexp.MustCompile(`(?:MASTER|SOURCE)_LOG_FILE='([^']+)',\s*(?:MASTER|SOURCE)_LOG_POS=(\d+)`)
+
+// readBinlogPosition reads the binlog coordinates from the header of a dump
+func readBinlogPosition(dumpPath string) (binlogPosition, error) {
+	file, err := os.Open(dumpPath)
+	if err != nil {
+		return binlogPosition{}, fmt.Errorf("failed to open dump: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if matches := binlogPositionPattern.FindStringSubmatch(line); matches != nil {
+			position, _ := strconv.ParseInt(matches[2], 10, 64)
+			return binlogPosition{File: matches[1], Position: position}, nil
+		}
+		// The coordinates come before any table
+		if strings.HasPrefix(line, "CREATE TABLE") || strings.HasPrefix(line, "INSERT INTO") {
+			break
+		}
+	}
+	return binlogPosition{}, fmt.Errorf("no binlog position in %s, dump with --source-data=2 (or --master-data=2)", filepath.Base(dumpPath))
+}
+
+// restoreMySQLDatabase restores the dump of a database, extracted into the
+// restore target directory, then replays the binlogs of opts.BinlogBackup
+// from the position of the dump up to opts.Until
+func (s *BackupService) restoreMySQLDatabase(backup config.BackupConfig, opts RestoreOptions) error {
+	dumpPath := filepath.Join(opts.TargetDir, opts.Database+".sql")
+	if _, err := os.Stat(dumpPath); err != nil {
+		return fmt.Errorf("no dump of database %s in the archive", opts.Database)
+	}
+
+	var position binlogPosition
+	var binlogs []string
+	if opts.BinlogBackup != "" {
+		binlogBackup, ok := s.FindBackup(opts.BinlogBackup)
+		if !ok || binlogBackup.Type != "mysql_binlog" {
+			return fmt.Errorf("%s is not a mysql_binlog backup", opts.BinlogBackup)
+		}
+		var err error
+		position, err = readBinlogPosition(dumpPath)
+		if err != nil {
+			return err
+		}
+		s.log.Info("Restore", "[%s] Dump of %s taken at %s position %d", backup.Name, opts.Database, position.File, position.Position)
+		binlogs, err = s.fetchBinlogs(binlogBackup, opts.Storage, filepath.Join(opts.TargetDir, "binlogs"), position.File)
+		if err != nil {
+			return err
+		}
+	}
+
+	backup, err := resolveSecrets(backup)
+	if err != nil {
+		return err
+	}
+	task := &MySQLBackup{archiveService: s.archiveService}
+	return task.restoreDatabase(backup, dumpPath, opts, position, binlogs)
+}
+
+// fetchBinlogs downloads the archives of a binlog backup, newest first, until
+// the one holding the start binlog, and extracts them into dir. It returns the
+// paths of the binlogs from start on, in order.
+func (s *BackupService) fetchBinlogs(binlogBackup config.BackupConfig, storageName, dir, start string) ([]string, error) {
+	if storageName == "" {
+		storageName = storage.LocalStorageName
+	}
+	archives, err := s.Storage().ListArchives(storageName, binlogBackup)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list binlog archives: %v", err)
+	}
+
+	binlogs := make(map[string]string)
+	found := false
+	for _, remoteArchive := range archives {
+		archivePath, cleanup, err := s.fetchArchive(binlogBackup, storageName, remoteArchive.Name, time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		archiveDir := filepath.Join(dir, strings.TrimSuffix(remoteArchive.Name, ".tar.gz"))
+		err = s.archiveService.ExtractArchive(archivePath, archiveDir)
+		cleanup()
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract binlog archive %s: %v", remoteArchive.Name, err)
+		}
+
+		var manifest binlogManifest
+		data, err := os.ReadFile(filepath.Join(archiveDir, binlogManifestFile))
+		if err == nil {
+			err = json.Unmarshal(data, &manifest)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the binlog manifest of %s: %v", remoteArchive.Name, err)
+		}
+		for _, file := range manifest.Files {
+			if compareBinlogs(file.Name, start) >= 0 {
+				binlogs[file.Name] = filepath.Join(archiveDir, file.Name)
+			}
+			found = found || file.Name == start
+		}
+		if found {
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("binlog %s is not in the archives of %s", start, binlogBackup.Name)
+	}
+
+	names := make([]string, 0, len(binlogs))
+	for name := range binlogs {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return compareBinlogs(names[i], names[j]) < 0 })
+	paths := make([]string, len(names))
+	for i, name := range names {
+		if i > 0 {
+			_, previous := binlogSequence(names[i-1])
+			if _, number := binlogSequence(name); number != previous+1 {
+				return nil, fmt.Errorf("binlogs between %s and %s are missing from the archives of %s", names[i-1], name, binlogBackup.Name)
+			}
+		}
+		paths[i] = binlogs[name]
+	}
+	s.log.Info("Restore", "[%s] Fetched %d binlogs: %s to %s", binlogBackup.Name, len(names), names[0], names[len(names)-1])
+	return paths, nil
+}
+
+// restoreDatabase loads a dump into the target database, created if needed,
+// then pipes the binlogs decoded by mysqlbinlog from the position of the dump
+// into mysql. The clients run on this machine, through an SSH tunnel if the
+// backup uses SSH.
+func (t *MySQLBackup) restoreDatabase(backup config.BackupConfig, dumpPath string, opts RestoreOptions, position binlogPosition, binlogs []string) error {
+	if backup.SSH != nil {
+		sshCfg := *backup.SSH
+		sshCfg.Mode = config.SSHModeTunnel
+		backup.SSH = &sshCfg
+	}
+	conn, closeConn, err := openDBConnection(backup, config.SSHModeTunnel, 3306)
+	if err != nil {
+		return err
+	}
+	defer closeConn()
+
+	mysqlBin := "mysql"
+	if backup.DB.MySQLPath != "" {
+		mysqlBin = backup.DB.MySQLPath
+	}
+	target := opts.TargetDatabase
+	if target == "" {
+		target = opts.Database
+	}
+	if _, err := t.runClient(backup, mysqlBin, []string{"-e", "CREATE DATABASE IF NOT EXISTS " + mysqlQuoteIdentifier(target)}, conn); err != nil {
+		return fmt.Errorf("failed to create database %s: %v", target, err)
+	}
+	dump, err := os.Open(dumpPath)
+	if err != nil {
+		return fmt.Errorf("failed to open dump: %v", err)
+	}
+	defer dump.Close()
+	if err := t.runClientTo(backup, mysqlBin, []string{target}, conn, nil, dump, io.Discard); err != nil {
+		return fmt.Errorf("failed to restore database %s into %s: %v", opts.Database, target, err)
+	}
+	if len(binlogs) == 0 {
+		return nil
+	}
+
+	bin := "mysqlbinlog"
+	if backup.DB.MysqlbinlogPath != "" {
+		bin = backup.DB.MysqlbinlogPath
+	}
+	// GTIDs are skipped so the server assigns new ones to the replayed transactions
+	args := []string{"--skip-gtids", "--start-position=" + strconv.FormatInt(position.Position, 10)}
+	if !opts.Until.IsZero() {
+		args = append(args, "--stop-datetime="+opts.Until.Local().Format("2006-01-02 15:04:05"))
+	}
+	if target != opts.Database {
+		args = append(args, "--rewrite-db="+opts.Database+"->"+target)
+	}
+	args = append(args, "--database="+target)
+	decoder := exec.Command(bin, append(args, binlogs...)...)
+	var stderr bytes.Buffer
+	decoder.Stderr = &stderr
+	events, err := decoder.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to start mysqlbinlog: %v", err)
+	}
+	if err := decoder.Start(); err != nil {
+		return fmt.Errorf("failed to start mysqlbinlog: %v", err)
+	}
+	applyErr := t.runClientTo(backup, mysqlBin, []string{target}, conn, nil, events, io.Discard)
+	// Unblock mysqlbinlog if mysql stopped reading early
+	events.Close()
+	decodeErr := decoder.Wait()
+	if applyErr != nil {
+		return fmt.Errorf("failed to replay binlogs into %s: %v", target, applyErr)
+	}
+	if decodeErr != nil {
+		return fmt.Errorf("failed to decode binlogs: %v, output: %s", decodeErr, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// mysqlQuoteIdentifier quotes a database or table name for a MySQL statement
+func mysqlQuoteIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
@@ -0,0 +1,148 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"backupdb/archive"
+	"backupdb/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeFakeBinlogClients writes a fake mysql listing the binlogs of dir/binlogs
+// and logging what it runs to dir/applied, and a fake mysqlbinlog
+func writeFakeBinlogClients(t *testing.T, dir string) (string, string) {
+	fakeMySQL := filepath.Join(dir, "mysql")
+	script := `#!/bin/sh
+for last; do :; done
+case "$*" in
+*"SHOW BINARY LOGS"*) cat ` + dir + `/binlogs ;;
+*" -e "*) echo "$last" >> ` + dir + `/applied ;;
+*) echo "mysql $last:" >> ` + dir + `/applied; cat >> ` + dir + `/applied ;;
+esac
+`
+	assert.NoError(t, os.WriteFile(fakeMySQL, []byte(script), 0755))
+
+	// Fetching writes each binlog into the --result-file prefix, decoding prints the arguments
+	fakeBinlog := filepath.Join(dir, "mysqlbinlog")
+	script = `#!/bin/sh
+prefix=""
+for arg; do case "$arg" in --result-file=*) prefix="${arg#--result-file=}" ;; esac; done
+if [ -z "$prefix" ]; then echo "-- mysqlbinlog $*"; exit 0; fi
+for arg; do case "$arg" in binlog.*) echo "events of $arg" > "$prefix$arg" ;; esac; done
+`
+	assert.NoError(t, os.WriteFile(fakeBinlog, []byte(script), 0755))
+	return fakeMySQL, fakeBinlog
+}
+
+func TestMySQLBinlogBackup_ArchivesClosedBinlogs(t *testing.T) {
+	defer os.RemoveAll("backups")
+	dir := t.TempDir()
+	fakeMySQL, fakeBinlog := writeFakeBinlogClients(t, dir)
+	binlogs := filepath.Join(dir, "binlogs")
+	assert.NoError(t, os.WriteFile(binlogs, []byte("binlog.000001\t100\tNo\nbinlog.000002\t200\tNo\nbinlog.000003\t50\tNo\n"), 0644))
+
+	backupCfg := config.BackupConfig{
+		Name: "mysql-binlogs",
+		Type: "mysql_binlog",
+		DB:   &config.DBConfig{MySQLPath: fakeMySQL, MysqlbinlogPath: fakeBinlog},
+	}
+	service := NewBackupService(&config.Config{})
+	run, err := service.RunBackup(backupCfg)
+	assert.NoError(t, err)
+	restoreDir := filepath.Join(dir, "restored")
+	assert.NoError(t, archive.NewArchiveService().ExtractArchive(filepath.Join("backups", "mysql-binlogs", run.Archive), restoreDir))
+	assert.FileExists(t, filepath.Join(restoreDir, "binlog.000001"))
+	assert.FileExists(t, filepath.Join(restoreDir, "binlog.000002"))
+	assert.FileExists(t, filepath.Join(restoreDir, binlogManifestFile))
+	// The binlog being written waits for the next run
+	assert.NoFileExists(t, filepath.Join(restoreDir, "binlog.000003"))
+
+	// Nothing closed since: the run succeeds without an archive
+	run, err = service.RunBackup(backupCfg)
+	assert.NoError(t, err)
+	assert.Empty(t, run.Archive)
+
+	assert.NoError(t, os.WriteFile(binlogs, []byte("binlog.000002\t200\tNo\nbinlog.000003\t80\tNo\nbinlog.000004\t50\tNo\n"), 0644))
+	run, err = service.RunBackup(backupCfg)
+	assert.NoError(t, err)
+	restoreDir = filepath.Join(dir, "restored-next")
+	assert.NoError(t, archive.NewArchiveService().ExtractArchive(filepath.Join("backups", "mysql-binlogs", run.Archive), restoreDir))
+	assert.FileExists(t, filepath.Join(restoreDir, "binlog.000003"))
+	assert.NoFileExists(t, filepath.Join(restoreDir, "binlog.000002"))
+	state, err := loadBinlogState(filepath.Join("backups", "mysql-binlogs", binlogStateFile))
+	assert.NoError(t, err)
+	assert.Equal(t, "binlog.000003", state.LastFile)
+}
+
+func TestMySQLBackup_RestoreWithBinlogs(t *testing.T) {
+	defer os.RemoveAll("backups")
+	dir := t.TempDir()
+	fakeMySQL, fakeBinlog := writeFakeBinlogClients(t, dir)
+	fakeDump := filepath.Join(dir, "mysqldump")
+	assert.NoError(t, os.WriteFile(fakeDump, []byte("#!/bin/sh\necho \"-- CHANGE REPLICATION SOURCE TO SOURCE_LOG_FILE='binlog.000002', SOURCE_LOG_POS=157;\"\necho 'CREATE TABLE orders;'\n"), 0755))
+
+	dumpCfg := config.BackupConfig{
+		Name: "mysql-pitr",
+		Type: "mysql",
+		DB:   &config.DBConfig{Name: "shop", MySQLPath: fakeMySQL, MysqldumpPath: fakeDump, MysqlbinlogPath: fakeBinlog},
+	}
+	binlogCfg := config.BackupConfig{
+		Name: "mysql-pitr-binlogs",
+		Type: "mysql_binlog",
+		DB:   &config.DBConfig{MySQLPath: fakeMySQL, MysqlbinlogPath: fakeBinlog},
+	}
+	service := NewBackupService(&config.Config{Backups: []config.BackupConfig{dumpCfg, binlogCfg}})
+	_, err := service.RunBackup(dumpCfg)
+	assert.NoError(t, err)
+	binlogs := filepath.Join(dir, "binlogs")
+	assert.NoError(t, os.WriteFile(binlogs, []byte("binlog.000001\t100\tNo\nbinlog.000002\t200\tNo\nbinlog.000003\t50\tNo\n"), 0644))
+	_, err = service.RunBackup(binlogCfg)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(binlogs, []byte("binlog.000003\t80\tNo\nbinlog.000004\t50\tNo\n"), 0644))
+	_, err = service.RunBackup(binlogCfg)
+	assert.NoError(t, err)
+
+	until := time.Now().Add(time.Hour)
+	err = service.Restore(dumpCfg, RestoreOptions{
+		TargetDir:      filepath.Join(dir, "restored"),
+		Database:       "shop",
+		TargetDatabase: "shop_restored",
+		BinlogBackup:   "mysql-pitr-binlogs",
+		Until:          until,
+	})
+	assert.NoError(t, err)
+
+	applied, err := os.ReadFile(filepath.Join(dir, "applied"))
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(applied)), "\n")
+	assert.Len(t, lines, 6)
+	assert.Equal(t, "CREATE DATABASE IF NOT EXISTS `shop_restored`", lines[0])
+	assert.Equal(t, "mysql shop_restored:", lines[1])
+	assert.Equal(t, "CREATE TABLE orders;", lines[3])
+	assert.Equal(t, "mysql shop_restored:", lines[4])
+	assert.Contains(t, lines[5], "--skip-gtids --start-position=157 --stop-datetime="+until.Format("2006-01-02 15:04:05")+" --rewrite-db=shop->shop_restored --database=shop_restored ")
+	assert.NotContains(t, lines[5], "binlog.000001")
+	assert.Regexp(t, `/binlog\.000002 \S+/binlog\.000003$`, lines[5])
+
+	// The dump must record its binlog position
+	assert.NoError(t, os.WriteFile(fakeDump, []byte("#!/bin/sh\necho 'CREATE TABLE orders;'\n"), 0755))
+	_, err = service.RunBackup(dumpCfg)
+	assert.NoError(t, err)
+	err = service.Restore(dumpCfg, RestoreOptions{TargetDir: filepath.Join(dir, "restored-again"), Database: "shop", BinlogBackup: "mysql-pitr-binlogs"})
+	assert.ErrorContains(t, err, "no binlog position in shop.sql, dump with --source-data=2")
+}
+
+func TestCompareBinlogs(t *testing.T) {
+	assert.Equal(t, -1, compareBinlogs("binlog.999999", "binlog.1000000"))
+	assert.Equal(t, 0, compareBinlogs("binlog.000042", "binlog.000042"))
+	assert.Equal(t, 1, compareBinlogs("binlog.000010", "binlog.000009"))
+
+	closed := []binlogFile{{Name: "binlog.000001"}, {Name: "binlog.000002"}, {Name: "binlog.000003"}}
+	assert.Equal(t, closed[1:], pendingBinlogs(closed, "", "binlog.000002"))
+	assert.Equal(t, closed[2:], pendingBinlogs(closed, "binlog.000002", "binlog.000001"))
+}
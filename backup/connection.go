@@ -0,0 +1,89 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"backupdb/archive"
+	"backupdb/config"
+	"backupdb/sshclient"
+)
+
+// dbConnection is how the database client programs reach the server: locally,
+// through a local port forwarded over SSH, or by running on the SSH host
+type dbConnection struct {
+	ssh    *sshclient.Client // Set when the clients run on the SSH host
+	host   string            // Server host given to the clients, empty for their default
+	port   int               // Server port given to the clients, 0 for their default
+	socket string            // Unix socket given to the clients instead of host and port
+}
+
+// openDBConnection connects to the SSH host of the backup, if any, in the
+// configured mode or defaultMode. In tunnel mode the server at db.host and
+// db.port (defaultPort if unset), as seen from the SSH host, is forwarded to
+// a local port. The returned function closes the connection.
+func openDBConnection(backup config.BackupConfig, defaultMode string, defaultPort int) (*dbConnection, func(), error) {
+	if backup.SSH == nil {
+		return &dbConnection{host: backup.DB.Host, port: backup.DB.Port, socket: backup.DB.Socket}, func() {}, nil
+	}
+
+	mode := backup.SSH.Mode
+	if mode == "" {
+		mode = defaultMode
+	}
+	client, err := sshclient.Dial(backup.SSH)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to SSH host: %v", err)
+	}
+	if mode == config.SSHModeExec {
+		conn := &dbConnection{ssh: client, host: backup.DB.Host, port: backup.DB.Port, socket: backup.DB.Socket}
+		return conn, func() { client.Close() }, nil
+	}
+
+	remoteHost := backup.DB.Host
+	if remoteHost == "" {
+		remoteHost = "127.0.0.1"
+	}
+	remotePort := backup.DB.Port
+	if remotePort == 0 {
+		remotePort = defaultPort
+	}
+	localAddr, stop, err := client.Forward(net.JoinHostPort(remoteHost, strconv.Itoa(remotePort)))
+	if err != nil {
+		client.Close()
+		return nil, nil, fmt.Errorf("failed to start SSH tunnel: %v", err)
+	}
+	closeTunnel := func() {
+		stop()
+		client.Close()
+	}
+	host, localPort, _ := net.SplitHostPort(localAddr)
+	port, _ := strconv.Atoi(localPort)
+	return &dbConnection{host: host, port: port}, closeTunnel, nil
+}
+
+// remote reports whether the clients run on the SSH host
+func (c *dbConnection) remote() bool {
+	return c != nil && c.ssh != nil
+}
+
+// extractTarStream extracts into dir the tar stream a command run on the SSH
+// host writes to stdout, the way files created there are brought back
+func extractTarStream(archiveService *archive.ArchiveService, dir string, run func(stdout io.Writer) error) error {
+	reader, writer := io.Pipe()
+	extracted := make(chan error, 1)
+	go func() {
+		err := archiveService.ExtractTar(reader, dir)
+		// Drain the stream so the command never blocks on a failed extraction
+		io.Copy(io.Discard, reader)
+		extracted <- err
+	}()
+	err := run(writer)
+	writer.Close()
+	if extractErr := <-extracted; err == nil && extractErr != nil {
+		err = fmt.Errorf("failed to extract tar stream: %v", extractErr)
+	}
+	return err
+}
@@ -0,0 +1,89 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"backupdb/config"
+)
+
+// writeSecretFile writes content to a new temporary file readable only by the
+// current user. The returned cleanup function removes the file.
+func writeSecretFile(pattern, content string) (string, func(), error) {
+	file, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create credentials file: %v", err)
+	}
+	cleanup := func() { os.Remove(file.Name()) }
+
+	// CreateTemp already uses 0600, chmod guards against a permissive umask on exotic systems
+	if err := file.Chmod(0600); err != nil {
+		file.Close()
+		cleanup()
+		return "", nil, fmt.Errorf("failed to restrict credentials file permissions: %v", err)
+	}
+	if _, err := file.WriteString(content); err != nil {
+		file.Close()
+		cleanup()
+		return "", nil, fmt.Errorf("failed to write credentials file: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to write credentials file: %v", err)
+	}
+	return file.Name(), cleanup, nil
+}
+
+// mysqlOptionFile returns a MySQL option file with the client credentials,
+// passed with --defaults-extra-file instead of -p on the command line
+func mysqlOptionFile(db *config.DBConfig) string {
+	var b strings.Builder
+	b.WriteString("[client]\n")
+	if db.User != "" {
+		fmt.Fprintf(&b, "user=%s\n", mysqlOptionValue(db.User))
+	}
+	if db.Password != "" {
+		fmt.Fprintf(&b, "password=%s\n", mysqlOptionValue(db.Password))
+	}
+	return b.String()
+}
+
+// mysqlOptionValue quotes an option file value, escaping backslashes and quotes
+func mysqlOptionValue(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return `"` + value + `"`
+}
+
+// pgpassFile returns a .pgpass entry matching any server with the password,
+// passed with PGPASSFILE instead of PGPASSWORD or the command line
+func pgpassFile(db *config.DBConfig) string {
+	password := strings.ReplaceAll(db.Password, `\`, `\\`)
+	password = strings.ReplaceAll(password, ":", `\:`)
+	return "*:*:*:*:" + password + "\n"
+}
+
+// remoteSecretFileCommand returns a remote shell command that stores its stdin in
+// a private temporary file, runs command with the file path in $SECRET_FILE and
+// removes the file when the command exits
+func remoteSecretFileCommand(command string) string {
+	return `umask 077; SECRET_FILE=$(mktemp) || exit 1; trap 'rm -f "$SECRET_FILE"' EXIT; cat > "$SECRET_FILE" || exit 1; ` + command
+}
+
+// shellQuote quotes an argument for a POSIX shell
+func shellQuote(arg string) string {
+	if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_=./:,@%+") == "" {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// shellJoin quotes and joins a command line for a POSIX shell
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,72 @@
+package backup
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"backupdb/config"
+	"backupdb/logger"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteSecretFile(t *testing.T) {
+	path, cleanup, err := writeSecretFile("test-*.cnf", "secret")
+	assert.NoError(t, err)
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	cleanup()
+	assert.NoFileExists(t, path)
+}
+
+func TestCredentialFiles(t *testing.T) {
+	db := &config.DBConfig{User: "backup", Password: `p"a\ss:word`}
+
+	assert.Equal(t, "[client]\nuser=\"backup\"\npassword=\"p\\\"a\\\\ss:word\"\n", mysqlOptionFile(db))
+	assert.Equal(t, "*:*:*:*:p\"a\\\\ss\\:word\n", pgpassFile(db))
+}
+
+func TestRemoteSecretFileCommand(t *testing.T) {
+	// Run the remote script with a local shell, as ssh would on the remote host
+	script := remoteSecretFileCommand(`stat -c %a "$SECRET_FILE"; cat "$SECRET_FILE"; echo "$SECRET_FILE" >&2`)
+	cmd := exec.Command("sh", "-c", script)
+	cmd.Stdin = strings.NewReader("secret-content")
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	assert.NoError(t, err)
+	assert.Equal(t, "600\nsecret-content", string(out))
+	assert.NoFileExists(t, strings.TrimSpace(stderr.String()))
+}
+
+func TestShellJoin(t *testing.T) {
+	assert.Equal(t, `pg_dump -Uapp '--exclude-table=audit log' 'it'\''s'`, shellJoin([]string{"pg_dump", "-Uapp", "--exclude-table=audit log", "it's"}))
+}
+
+func TestMySQLDumpPassesPasswordInOptionFile(t *testing.T) {
+	// A fake mysqldump printing its arguments and the option file it was given
+	dir := t.TempDir()
+	fakeDump := filepath.Join(dir, "mysqldump")
+	assert.NoError(t, os.WriteFile(fakeDump, []byte("#!/bin/sh\necho \"args: $*\"\ncat \"${1#--defaults-extra-file=}\"\n"), 0755))
+
+	backupCfg := config.BackupConfig{
+		Name: "mysql-credentials",
+		DB:   &config.DBConfig{User: "root", Password: "hunter22", MysqldumpPath: fakeDump},
+	}
+	dumpFile := filepath.Join(dir, "app.sql")
+	task := &MySQLBackup{}
+	assert.NoError(t, task.dumpDatabase(backupCfg, "app", dumpFile, logger.Get(), &dbConnection{}))
+
+	dump, err := os.ReadFile(dumpFile)
+	assert.NoError(t, err)
+	lines := strings.SplitN(string(dump), "\n", 2)
+	assert.Contains(t, lines[0], "--defaults-extra-file=")
+	assert.NotContains(t, lines[0], "hunter22")
+	assert.Contains(t, lines[1], `password="hunter22"`)
+}
@@ -0,0 +1,207 @@
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"backupdb/config"
+	"backupdb/history"
+	"backupdb/logger"
+)
+
+// allDatabases as db.name backs up every database of the server
+const allDatabases = "__ALL__"
+
+// manifestFile lists the dumped and failed databases at the root of database archives
+const manifestFile = "manifest.json"
+
+// dumpManifest is the content of manifest.json
+type dumpManifest struct {
+	Backup    string                   `json:"backup"`
+	Type      string                   `json:"type"`
+	Format    string                   `json:"format,omitempty"`
+	CreatedAt time.Time                `json:"created_at"`
+	Complete  bool                     `json:"complete"` // Every database was dumped
+	Databases []history.DatabaseResult `json:"databases"`
+}
+
+// selectDatabases returns the databases to back up: db.databases, every
+// database listed by listAll when db.name is __ALL__, or db.name, without
+// db.exclude_databases
+func selectDatabases(db *config.DBConfig, listAll func() ([]string, error)) ([]string, error) {
+	var databases []string
+	if len(db.Databases) > 0 {
+		databases = db.Databases
+	} else if db.Name == allDatabases {
+		allDBs, err := listAll()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get databases list: %v", err)
+		}
+		databases = allDBs
+	} else if db.Name != "" {
+		databases = []string{db.Name}
+	} else {
+		return nil, fmt.Errorf("no database specified for backup")
+	}
+
+	if len(db.ExcludeDatabases) > 0 {
+		databases = filterExcludedDatabases(databases, db.ExcludeDatabases)
+	}
+	if len(databases) == 0 {
+		return nil, fmt.Errorf("no databases to backup after filtering")
+	}
+	return databases, nil
+}
+
+// filterExcludedDatabases removes excluded databases from the list
+func filterExcludedDatabases(databases, excluded []string) []string {
+	excludedMap := make(map[string]bool)
+	for _, db := range excluded {
+		excludedMap[db] = true
+	}
+
+	var filtered []string
+	for _, db := range databases {
+		if !excludedMap[db] {
+			filtered = append(filtered, db)
+		}
+	}
+	return filtered
+}
+
+// dumpDatabases runs dump for every database, up to parallelism at a time, and
+// returns the outcome of each dump in the order of databases. dump returns the
+// path of the file or directory it wrote.
+func dumpDatabases(backupName string, log *logger.Logger, databases []string, parallelism int, dump func(dbName string) (string, error)) []history.DatabaseResult {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	if parallelism > len(databases) {
+		parallelism = len(databases)
+	}
+
+	results := make([]history.DatabaseResult, len(databases))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				dbName := databases[index]
+				start := time.Now()
+				path, err := dump(dbName)
+				elapsed := time.Since(start)
+				result := history.DatabaseResult{Database: dbName, Success: err == nil, DurationMs: elapsed.Milliseconds()}
+				if err != nil {
+					result.Error = logger.Redact(err.Error())
+					log.Error("Backup", "[%s] Failed to dump database %s after %s: %v", backupName, dbName, elapsed.Round(time.Millisecond), err)
+				} else {
+					result.Size = pathSize(path)
+					log.Info("Backup", "[%s] Successfully dumped database %s in %s (%d bytes)", backupName, dbName, elapsed.Round(time.Millisecond), result.Size)
+				}
+				results[index] = result
+			}
+		}()
+	}
+	for index := range databases {
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+	return results
+}
+
+// pathSize returns the size of a file, or of the files in a directory
+func pathSize(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// failedDatabases returns the databases whose dump failed
+func failedDatabases(results []history.DatabaseResult) []string {
+	var failed []string
+	for _, result := range results {
+		if !result.Success {
+			failed = append(failed, result.Database)
+		}
+	}
+	return failed
+}
+
+// checkPartialFailure applies db.on_partial_failure to the dump results: an
+// error with the fail policy, a warning otherwise. A run where no database
+// was dumped fails whatever the policy.
+func checkPartialFailure(backup config.BackupConfig, log *logger.Logger, results []history.DatabaseResult) error {
+	failed := failedDatabases(results)
+	if len(failed) == 0 {
+		return nil
+	}
+	if len(failed) == len(results) {
+		if len(results) == 1 {
+			return errors.New(results[0].Error)
+		}
+		return fmt.Errorf("failed to dump all %d databases: %s", len(results), strings.Join(failed, ", "))
+	}
+	if backup.DB.OnPartialFailure == config.PartialFailureFail {
+		return fmt.Errorf("failed to dump %d of %d databases: %s", len(failed), len(results), strings.Join(failed, ", "))
+	}
+	log.Warn("[%s] %d of %d databases failed to dump, the archive is incomplete: %s", backup.Name, len(failed), len(results), strings.Join(failed, ", "))
+	return nil
+}
+
+// writeManifest writes manifest.json into the directory of the dumps
+func writeManifest(dir string, backup config.BackupConfig, results []history.DatabaseResult) error {
+	data, err := json.MarshalIndent(dumpManifest{
+		Backup:    backup.Name,
+		Type:      backup.Type,
+		Format:    backup.DB.Format,
+		CreatedAt: time.Now().UTC(),
+		Complete:  len(failedDatabases(results)) == 0,
+		Databases: results,
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, manifestFile), append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+	return nil
+}
+
+// tablePatterns returns the table filter patterns applying to a database: the
+// unqualified ones and the ones prefixed with "<database>:", without the prefix
+func tablePatterns(patterns []string, dbName string) []string {
+	var applying []string
+	for _, pattern := range patterns {
+		if prefix, table, qualified := strings.Cut(pattern, ":"); !qualified {
+			applying = append(applying, pattern)
+		} else if prefix == dbName {
+			applying = append(applying, table)
+		}
+	}
+	return applying
+}
+
+// matchTable reports whether a table name matches any of the glob patterns
+func matchTable(patterns []string, table string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, table); matched {
+			return true
+		}
+	}
+	return false
+}
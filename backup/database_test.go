@@ -0,0 +1,75 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"backupdb/config"
+	"backupdb/logger"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectDatabases(t *testing.T) {
+	listAll := func() ([]string, error) { return []string{"a", "b", "c"}, nil }
+
+	databases, err := selectDatabases(&config.DBConfig{Name: "__ALL__", ExcludeDatabases: []string{"b"}}, listAll)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "c"}, databases)
+
+	databases, err = selectDatabases(&config.DBConfig{Name: "a", Databases: []string{"x", "y"}}, listAll)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"x", "y"}, databases)
+
+	_, err = selectDatabases(&config.DBConfig{Databases: []string{"x"}, ExcludeDatabases: []string{"x"}}, listAll)
+	assert.ErrorContains(t, err, "no databases to backup after filtering")
+}
+
+func TestDumpDatabasesInParallel(t *testing.T) {
+	dir := t.TempDir()
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+
+	databases := []string{"db1", "db2", "db3", "db4", "db5"}
+	results := dumpDatabases("parallel", logger.Get(), databases, 2, func(dbName string) (string, error) {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+
+		if dbName == "db3" {
+			return "", fmt.Errorf("access denied")
+		}
+		dumpFile := filepath.Join(dir, dbName+".sql")
+		return dumpFile, os.WriteFile(dumpFile, []byte(dbName), 0644)
+	})
+
+	assert.Equal(t, 2, maxRunning)
+	assert.Len(t, results, len(databases))
+	for i, result := range results {
+		assert.Equal(t, databases[i], result.Database)
+		assert.GreaterOrEqual(t, result.DurationMs, int64(20))
+	}
+	assert.True(t, results[0].Success)
+	assert.Equal(t, int64(3), results[0].Size)
+	assert.False(t, results[2].Success)
+	assert.Equal(t, "access denied", results[2].Error)
+}
+
+func TestTablePatterns(t *testing.T) {
+	patterns := []string{"audit_*", "app:sessions", "logs:*"}
+	assert.Equal(t, []string{"audit_*", "sessions"}, tablePatterns(patterns, "app"))
+	assert.Equal(t, []string{"audit_*", "*"}, tablePatterns(patterns, "logs"))
+	assert.True(t, matchTable(tablePatterns(patterns, "app"), "audit_2024"))
+	assert.False(t, matchTable(tablePatterns(patterns, "app"), "users"))
+}
@@ -0,0 +1,330 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"backupdb/archive"
+	"backupdb/config"
+	"backupdb/history"
+	"backupdb/logger"
+)
+
+// mongoInstanceArchive is the dump of the whole instance, for db.name __ALL__
+const mongoInstanceArchive = "all.archive.gz"
+
+// MongoDBBackup implements BackupTask for MongoDB, dumped with mongodump
+// --archive --gzip: one archive per database, or one of the whole instance
+type MongoDBBackup struct {
+	archiveService *archive.ArchiveService
+	results        []history.DatabaseResult // Outcome of each database dump of the last run
+}
+
+// Run dumps every database and archives the dumps
+func (t *MongoDBBackup) Run(backup config.BackupConfig, backupDir, backupFile string, log *logger.Logger) error {
+	if backup.DB == nil {
+		return fmt.Errorf("missing DB config for database backup")
+	}
+
+	conn, closeConn, err := openDBConnection(backup, config.SSHModeExec, 27017)
+	if err != nil {
+		return err
+	}
+	defer closeConn()
+
+	// Listing databases needs more than mongodump, __ALL__ is a dump of the instance
+	databases := []string{allDatabases}
+	if backup.DB.Name != allDatabases {
+		databases, err = selectDatabases(backup.DB, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Info("Backup", "[%s] Backing up %d databases: %v", backup.Name, len(databases), databases)
+
+	tempDir := filepath.Join(backupDir, "temp_dumps")
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return fmt.Errorf("failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	t.results = dumpDatabases(backup.Name, log, databases, backup.DB.Parallelism, func(dbName string) (string, error) {
+		return t.dumpDatabase(backup, dbName, tempDir, conn)
+	})
+	if err := checkPartialFailure(backup, log, t.results); err != nil {
+		return err
+	}
+	if err := writeManifest(tempDir, backup, t.results); err != nil {
+		return err
+	}
+
+	err = t.archiveService.CreateBackupArchive(config.BackupConfig{
+		Name:       backup.Name,
+		SourcePath: tempDir,
+	}, backupFile)
+	if err != nil {
+		os.Remove(backupFile)
+		return fmt.Errorf("failed to create archive for db backup: %v", err)
+	}
+
+	log.Info("Backup", "[%s] Successfully created backup archive with %d databases", backup.Name, len(databases))
+	return nil
+}
+
+// DatabaseResults returns the outcome of each database dump of the last run
+func (t *MongoDBBackup) DatabaseResults() []history.DatabaseResult { return t.results }
+
+// Kind returns the type of backup
+func (t *MongoDBBackup) Kind() string { return "mongodb" }
+
+// dumpDatabase dumps a database into <database>.archive.gz of dir, or the
+// instance without the excluded namespaces into all.archive.gz. mongodump takes a single --collection, so
+// with included collections each one is dumped into
+// <database>/<collection>.archive.gz. It returns the path written.
+func (t *MongoDBBackup) dumpDatabase(backup config.BackupConfig, dbName, dir string, conn *dbConnection) (string, error) {
+	bin := "mongodump"
+	if backup.DB.MongodumpPath != "" {
+		bin = backup.DB.MongodumpPath
+	}
+	args := append(mongoConnectionArgs(backup.DB, conn), "--archive", "--gzip")
+
+	if dbName == allDatabases {
+		if backup.DB.Oplog {
+			args = append(args, "--oplog")
+		}
+		args = append(args, mongoInstanceExcludes(backup.DB)...)
+		dumpPath := filepath.Join(dir, mongoInstanceArchive)
+		return dumpPath, t.dumpTo(backup, bin, append(args, backup.DB.DumpOptions...), conn, dumpPath)
+	}
+
+	args = append(args, "--db="+dbName)
+	included := tablePatterns(backup.DB.IncludeTables, dbName)
+	if len(included) == 0 {
+		for _, pattern := range tablePatterns(backup.DB.ExcludeTables, dbName) {
+			if prefix := strings.TrimSuffix(pattern, "*"); prefix != pattern {
+				args = append(args, "--excludeCollectionsWithPrefix="+prefix)
+			} else {
+				args = append(args, "--excludeCollection="+pattern)
+			}
+		}
+		dumpPath := filepath.Join(dir, dbName+".archive.gz")
+		return dumpPath, t.dumpTo(backup, bin, append(args, backup.DB.DumpOptions...), conn, dumpPath)
+	}
+
+	dbDir := filepath.Join(dir, dbName)
+	if err := os.MkdirAll(dbDir, 0755); err != nil {
+		return dbDir, fmt.Errorf("failed to create dump directory: %v", err)
+	}
+	excluded := tablePatterns(backup.DB.ExcludeTables, dbName)
+	dumped := 0
+	for _, collection := range included {
+		if matchTable(excluded, collection) {
+			continue
+		}
+		collectionArgs := append(append([]string{}, args...), "--collection="+collection)
+		collectionArgs = append(collectionArgs, backup.DB.DumpOptions...)
+		if err := t.dumpTo(backup, bin, collectionArgs, conn, filepath.Join(dbDir, collection+".archive.gz")); err != nil {
+			return dbDir, fmt.Errorf("failed to dump collection %s: %v", collection, err)
+		}
+		dumped++
+	}
+	if dumped == 0 {
+		return dbDir, fmt.Errorf("no collection left to dump after filtering")
+	}
+	return dbDir, nil
+}
+
+// mongoInstanceExcludes returns the --nsExclude options leaving the excluded
+// databases and collections out of a whole instance dump. A collection
+// pattern without a database prefix applies to every database.
+func mongoInstanceExcludes(db *config.DBConfig) []string {
+	var args []string
+	for _, excluded := range db.ExcludeDatabases {
+		args = append(args, "--nsExclude="+excluded+".*")
+	}
+	for _, pattern := range db.ExcludeTables {
+		dbName, collection, qualified := strings.Cut(pattern, ":")
+		if !qualified {
+			dbName, collection = "*", pattern
+		}
+		args = append(args, "--nsExclude="+dbName+"."+collection)
+	}
+	return args
+}
+
+// dumpTo runs mongodump, writing the archive it streams to stdout into dumpPath
+func (t *MongoDBBackup) dumpTo(backup config.BackupConfig, bin string, args []string, conn *dbConnection, dumpPath string) error {
+	file, err := os.Create(dumpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create dump file: %v", err)
+	}
+	err = runMongoTool(backup, bin, args, conn, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// runMongoTool runs a MongoDB database tool locally, or on the SSH host in exec
+// mode. The password and URI are passed in a --config file instead of the
+// command line, which needs the database tools 100.3 or later.
+func runMongoTool(backup config.BackupConfig, bin string, args []string, conn *dbConnection, stdout io.Writer) error {
+	configFile := mongoConfigFile(backup.DB)
+
+	var stderr bytes.Buffer
+	if conn.remote() {
+		remoteCommand := shellQuote(bin) + " " + shellJoin(args)
+		if configFile != "" {
+			remoteCommand = remoteSecretFileCommand(shellQuote(bin) + ` --config="$SECRET_FILE" ` + shellJoin(args))
+		}
+		err := conn.ssh.Run(remoteCommand, strings.NewReader(configFile), stdout, &stderr)
+		if err != nil {
+			return fmt.Errorf("%v, output: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return nil
+	}
+
+	if configFile != "" {
+		configPath, cleanup, err := writeSecretFile("mongodb-*.yaml", configFile)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		args = append([]string{"--config=" + configPath}, args...)
+	}
+	cmd := exec.Command(bin, args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v, output: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// mongoConfigFile returns the YAML --config file of the database tools with
+// the password and URI, empty if there is neither
+func mongoConfigFile(db *config.DBConfig) string {
+	var b strings.Builder
+	for _, entry := range []struct{ key, value string }{{"uri", db.URI}, {"password", db.Password}} {
+		if entry.value != "" {
+			// A JSON string is a valid YAML double-quoted scalar
+			value, _ := json.Marshal(entry.value)
+			fmt.Fprintf(&b, "%s: %s\n", entry.key, value)
+		}
+	}
+	return b.String()
+}
+
+// mongoConnectionArgs returns the database tools options selecting the server,
+// the user and the TLS settings, with the URI in the --config file if set
+func mongoConnectionArgs(db *config.DBConfig, conn *dbConnection) []string {
+	var args []string
+	if db.URI == "" {
+		if conn.socket != "" {
+			args = append(args, "--host="+conn.socket)
+		}
+		if conn.host != "" {
+			args = append(args, "--host="+conn.host)
+		}
+		if conn.port != 0 {
+			args = append(args, "--port="+strconv.Itoa(conn.port))
+		}
+	}
+	if db.User != "" {
+		authSource := db.AuthSource
+		if authSource == "" {
+			authSource = "admin"
+		}
+		args = append(args, "--username="+db.User, "--authenticationDatabase="+authSource)
+	}
+	switch db.SSLMode {
+	case "require":
+		args = append(args, "--ssl", "--sslAllowInvalidCertificates")
+	case "verify-ca":
+		args = append(args, "--ssl", "--sslAllowInvalidHostnames")
+	case "verify-full":
+		args = append(args, "--ssl")
+	}
+	if db.SSLCA != "" {
+		args = append(args, "--sslCAFile="+db.SSLCA)
+	}
+	if db.SSLCert != "" {
+		args = append(args, "--sslPEMKeyFile="+db.SSLCert)
+	}
+	return args
+}
+
+// restoreDatabase restores the dump of a database from the extracted archive
+// with mongorestore, from its own archive or the one of the whole instance.
+// __ALL__ restores every database of an instance dump, replaying its oplog.
+func (t *MongoDBBackup) restoreDatabase(backup config.BackupConfig, dir string, opts RestoreOptions) error {
+	var dumps []string
+	instanceDump := filepath.Join(dir, mongoInstanceArchive)
+	if _, err := os.Stat(filepath.Join(dir, opts.Database+".archive.gz")); err == nil && opts.Database != allDatabases {
+		dumps = []string{filepath.Join(dir, opts.Database+".archive.gz")}
+	} else if collections, _ := filepath.Glob(filepath.Join(dir, opts.Database, "*.archive.gz")); len(collections) > 0 && opts.Database != allDatabases {
+		sort.Strings(collections)
+		dumps = collections
+	} else if _, err := os.Stat(instanceDump); err == nil {
+		dumps = []string{instanceDump}
+	} else {
+		return fmt.Errorf("no dump of database %s in the archive", opts.Database)
+	}
+	target := opts.TargetDatabase
+	if target == "" {
+		target = opts.Database
+	}
+	if opts.Database == allDatabases && target != allDatabases {
+		return fmt.Errorf("the whole instance cannot be restored into database %s", target)
+	}
+
+	if backup.SSH != nil {
+		if backup.DB.URI != "" {
+			return fmt.Errorf("restoring a mongodb backup with db.uri through SSH is not supported, restore from a host reaching the server")
+		}
+		sshCfg := *backup.SSH
+		sshCfg.Mode = config.SSHModeTunnel
+		backup.SSH = &sshCfg
+	}
+	conn, closeConn, err := openDBConnection(backup, config.SSHModeTunnel, 27017)
+	if err != nil {
+		return err
+	}
+	defer closeConn()
+
+	bin := "mongorestore"
+	if backup.DB.MongorestorePath != "" {
+		bin = backup.DB.MongorestorePath
+	}
+	for _, dumpPath := range dumps {
+		args := append(mongoConnectionArgs(backup.DB, conn), "--archive="+dumpPath, "--gzip")
+		if opts.Database == allDatabases {
+			if backup.DB.Oplog {
+				args = append(args, "--oplogReplay")
+			}
+		} else {
+			if len(opts.Tables) == 0 {
+				args = append(args, "--nsInclude="+opts.Database+".*")
+			}
+			for _, collection := range opts.Tables {
+				args = append(args, "--nsInclude="+opts.Database+"."+collection)
+			}
+			if target != opts.Database {
+				args = append(args, "--nsFrom="+opts.Database+".*", "--nsTo="+target+".*")
+			}
+		}
+		if err := runMongoTool(backup, bin, args, conn, io.Discard); err != nil {
+			return fmt.Errorf("failed to restore database %s into %s: %v", opts.Database, target, err)
+		}
+	}
+	return nil
+}
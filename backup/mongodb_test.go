@@ -0,0 +1,79 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"backupdb/archive"
+	"backupdb/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMongoDBBackup_RunAndRestore(t *testing.T) {
+	defer os.RemoveAll("backups")
+	// A fake mongodump streaming its config file and arguments as the archive
+	dir := t.TempDir()
+	fakeDump := filepath.Join(dir, "mongodump")
+	script := `#!/bin/sh
+case "$1" in --config=*) cat "${1#--config=}"; shift ;; esac
+echo "$*"
+`
+	assert.NoError(t, os.WriteFile(fakeDump, []byte(script), 0755))
+	fakeRestore := filepath.Join(dir, "mongorestore")
+	assert.NoError(t, os.WriteFile(fakeRestore, []byte("#!/bin/sh\necho \"$*\" >> "+dir+"/restored\n"), 0755))
+
+	backupCfg := config.BackupConfig{
+		Name: "mongo",
+		Type: "mongodb",
+		DB: &config.DBConfig{
+			Databases:        []string{"shop", "crm"},
+			IncludeTables:    []string{"crm:contacts", "crm:deals"},
+			ExcludeTables:    []string{"cache_*", "sessions", "crm:deals"},
+			User:             "backup",
+			Password:         "mongo-secret",
+			MongodumpPath:    fakeDump,
+			MongorestorePath: fakeRestore,
+		},
+	}
+	service := NewBackupService(&config.Config{})
+	run, err := service.RunBackup(backupCfg)
+	assert.NoError(t, err)
+	assert.Len(t, run.Databases, 2)
+
+	extractDir := filepath.Join(dir, "extracted")
+	assert.NoError(t, archive.NewArchiveService().ExtractArchive(filepath.Join("backups", "mongo", run.Archive), extractDir))
+	shop, err := os.ReadFile(filepath.Join(extractDir, "shop.archive.gz"))
+	assert.NoError(t, err)
+	assert.Equal(t, "password: \"mongo-secret\"\n--username=backup --authenticationDatabase=admin --archive --gzip --db=shop --excludeCollectionsWithPrefix=cache_ --excludeCollection=sessions\n", string(shop))
+	// mongodump takes a single collection, each included one has its own archive
+	contacts, err := os.ReadFile(filepath.Join(extractDir, "crm", "contacts.archive.gz"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(contacts), "--db=crm --collection=contacts\n")
+	assert.NoFileExists(t, filepath.Join(extractDir, "crm", "deals.archive.gz"))
+
+	err = service.Restore(backupCfg, RestoreOptions{TargetDir: filepath.Join(dir, "restore"), Database: "crm", TargetDatabase: "crm_copy"})
+	assert.NoError(t, err)
+	restored, err := os.ReadFile(filepath.Join(dir, "restored"))
+	assert.NoError(t, err)
+	assert.Regexp(t, `^--config=\S+ --username=backup --authenticationDatabase=admin --archive=\S+/crm/contacts\.archive\.gz --gzip --nsInclude=crm\.\* --nsFrom=crm\.\* --nsTo=crm_copy\.\*$`, strings.TrimSpace(string(restored)))
+}
+
+func TestMongoInstanceExcludes(t *testing.T) {
+	db := &config.DBConfig{Name: "__ALL__", ExcludeDatabases: []string{"local", "staging"}, ExcludeTables: []string{"cache_*", "shop:sessions"}}
+	assert.Equal(t, []string{
+		"--nsExclude=local.*", "--nsExclude=staging.*", "--nsExclude=*.cache_*", "--nsExclude=shop.sessions",
+	}, mongoInstanceExcludes(db))
+}
+
+func TestMongoConnectionArgs(t *testing.T) {
+	db := &config.DBConfig{URI: "mongodb://rs0.example.com/?replicaSet=rs0", Host: "ignored", SSLMode: "verify-ca", SSLCA: "/etc/ca.pem"}
+	assert.Equal(t, []string{"--ssl", "--sslAllowInvalidHostnames", "--sslCAFile=/etc/ca.pem"}, mongoConnectionArgs(db, &dbConnection{host: "ignored"}))
+	assert.Equal(t, "uri: \"mongodb://rs0.example.com/?replicaSet=rs0\"\n", mongoConfigFile(db))
+
+	db = &config.DBConfig{User: "backup", AuthSource: "shop"}
+	assert.Equal(t, []string{"--host=127.0.0.1", "--port=27018", "--username=backup", "--authenticationDatabase=shop"}, mongoConnectionArgs(db, &dbConnection{host: "127.0.0.1", port: 27018}))
+	assert.Empty(t, mongoConfigFile(db))
+}
@@ -3,61 +3,23 @@ package backup
 import (
 	"backupdb/archive"
 	"backupdb/config"
+	"backupdb/history"
 	"backupdb/logger"
 	"bytes"
 	"fmt"
-	"net"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
-	"time"
 )
 
 // MySQLBackup implements BackupTask for MySQL database backup
 // Handles backup of a MySQL database via SSH and mysqldump
 type MySQLBackup struct {
 	archiveService *archive.ArchiveService
-}
-
-// getFreePort finds a free TCP port for local tunnel
-func getFreePort() (int, error) {
-	l, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		return 0, err
-	}
-	defer l.Close()
-	return l.Addr().(*net.TCPAddr).Port, nil
-}
-
-// startSSHTunnel starts an SSH tunnel and returns the cmd process and local port
-func startSSHTunnel(sshCfg *config.SSHConfig, remoteHost string, remotePort int) (*exec.Cmd, int, error) {
-	localPort, err := getFreePort()
-	if err != nil {
-		return nil, 0, err
-	}
-	args := []string{"-N", "-L", fmt.Sprintf("%d:%s:%d", localPort, remoteHost, remotePort), "-p", fmt.Sprintf("%d", sshCfg.Port)}
-	if sshCfg.KeyFile != "" {
-		args = append(args, "-i", sshCfg.KeyFile)
-	}
-	args = append(args, fmt.Sprintf("%s@%s", sshCfg.User, sshCfg.Host))
-	cmd := exec.Command("ssh", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Start(); err != nil {
-		return nil, 0, err
-	}
-	// Wait a bit for tunnel to be ready
-	for i := 0; i < 10; i++ {
-		conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", localPort), 300*time.Millisecond)
-		if err == nil {
-			conn.Close()
-			return cmd, localPort, nil
-		}
-		time.Sleep(200 * time.Millisecond)
-	}
-	cmd.Process.Kill()
-	return nil, 0, fmt.Errorf("failed to establish SSH tunnel on port %d", localPort)
+	results        []history.DatabaseResult // Outcome of each database dump of the last run
 }
 
 // Run executes the MySQL backup logic
@@ -66,43 +28,17 @@ func (t *MySQLBackup) Run(backup config.BackupConfig, backupDir, backupFile stri
 		return fmt.Errorf("missing DB config for database backup")
 	}
 
-	var tunnelCmd *exec.Cmd
-	var localPort int
-	var err error
-	useTunnel := backup.SSH != nil
-	if useTunnel {
-		tunnelCmd, localPort, err = startSSHTunnel(backup.SSH, "127.0.0.1", 3306)
-		if err != nil {
-			return fmt.Errorf("failed to start SSH tunnel: %v", err)
-		}
-		defer func() {
-			if tunnelCmd != nil && tunnelCmd.Process != nil {
-				tunnelCmd.Process.Kill()
-			}
-		}()
-	}
-
-	// Determine which databases to backup
-	var databases []string
-	if len(backup.DB.Databases) > 0 {
-		databases = backup.DB.Databases
-	} else if backup.DB.Name == "__ALL__" {
-		allDBs, err := t.getAllDatabases(backup, log, localPort, useTunnel)
-		if err != nil {
-			return fmt.Errorf("failed to get databases list: %v", err)
-		}
-		databases = allDBs
-	} else if backup.DB.Name != "" {
-		databases = []string{backup.DB.Name}
-	} else {
-		return fmt.Errorf("no database specified for backup")
+	conn, closeConn, err := openDBConnection(backup, config.SSHModeTunnel, 3306)
+	if err != nil {
+		return err
 	}
+	defer closeConn()
 
-	if len(backup.DB.ExcludeDatabases) > 0 {
-		databases = t.filterExcludedDatabases(databases, backup.DB.ExcludeDatabases)
-	}
-	if len(databases) == 0 {
-		return fmt.Errorf("no databases to backup after filtering")
+	databases, err := selectDatabases(backup.DB, func() ([]string, error) {
+		return t.getAllDatabases(backup, log, conn)
+	})
+	if err != nil {
+		return err
 	}
 
 	log.Info("Backup", "[%s] Backing up %d databases: %v", backup.Name, len(databases), databases)
@@ -113,14 +49,15 @@ func (t *MySQLBackup) Run(backup config.BackupConfig, backupDir, backupFile stri
 	}
 	defer os.RemoveAll(tempDir)
 
-	for _, dbName := range databases {
+	t.results = dumpDatabases(backup.Name, log, databases, backup.DB.Parallelism, func(dbName string) (string, error) {
 		dumpFile := filepath.Join(tempDir, fmt.Sprintf("%s.sql", dbName))
-		err := t.dumpDatabase(backup, dbName, dumpFile, log, localPort, useTunnel)
-		if err != nil {
-			log.Error("Backup", "[%s] Failed to dump database %s: %v", backup.Name, dbName, err)
-			continue
-		}
-		log.Info("Backup", "[%s] Successfully dumped database: %s", backup.Name, dbName)
+		return dumpFile, t.dumpDatabase(backup, dbName, dumpFile, log, conn)
+	})
+	if err := checkPartialFailure(backup, log, t.results); err != nil {
+		return err
+	}
+	if err := writeManifest(tempDir, backup, t.results); err != nil {
+		return err
 	}
 
 	err = t.archiveService.CreateBackupArchive(config.BackupConfig{
@@ -138,52 +75,17 @@ func (t *MySQLBackup) Run(backup config.BackupConfig, backupDir, backupFile stri
 }
 
 // getAllDatabases gets list of all databases from MySQL server
-func (t *MySQLBackup) getAllDatabases(backup config.BackupConfig, log *logger.Logger, localPort int, useTunnel bool) ([]string, error) {
+func (t *MySQLBackup) getAllDatabases(backup config.BackupConfig, log *logger.Logger, conn *dbConnection) ([]string, error) {
 	bin := "mysql"
 	if backup.DB.MySQLPath != "" {
 		bin = backup.DB.MySQLPath
 	}
-	args := []string{"-u", backup.DB.User}
-	if backup.DB.Password != "" {
-		args = append(args, fmt.Sprintf("-p%s", backup.DB.Password))
-	}
-	args = append(args, "-e", "SHOW DATABASES;")
-	if useTunnel {
-		args = append([]string{"-h", "127.0.0.1", "-P", fmt.Sprintf("%d", localPort)}, args...)
-	} else if backup.SSH != nil {
-		sshArgs := []string{}
-		if backup.SSH.KeyFile != "" {
-			sshArgs = append(sshArgs, "-i", backup.SSH.KeyFile)
-		}
-		sshArgs = append(sshArgs, fmt.Sprintf("%s@%s", backup.SSH.User, backup.SSH.Host), bin)
-		sshArgs = append(sshArgs, args...)
-		cmd := exec.Command("ssh", sshArgs...)
-		var out bytes.Buffer
-		cmd.Stdout = &out
-		cmd.Stderr = &out
-		if err := cmd.Run(); err != nil {
-			log.Error("Backup", "[%s] Failed to get databases list: %v, output: %s", backup.Name, err, out.String())
-			return nil, fmt.Errorf("failed to get databases list: %v, output: %s", err, out.String())
-		}
-		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
-		var databases []string
-		for _, line := range lines {
-			line = strings.TrimSpace(line)
-			if line != "" && line != "Database" {
-				databases = append(databases, line)
-			}
-		}
-		return databases, nil
-	}
-	cmd := exec.Command(bin, args...)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &out
-	if err := cmd.Run(); err != nil {
-		log.Error("Backup", "[%s] Failed to get databases list: %v, output: %s", backup.Name, err, out.String())
-		return nil, fmt.Errorf("failed to get databases list: %v, output: %s", err, out.String())
+	out, err := t.runClient(backup, bin, []string{"-e", "SHOW DATABASES;"}, conn)
+	if err != nil {
+		log.Error("Backup", "[%s] Failed to get databases list: %v", backup.Name, err)
+		return nil, fmt.Errorf("failed to get databases list: %v", err)
 	}
-	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
 	var databases []string
 	for _, line := range lines {
 		line = strings.TrimSpace(line)
@@ -194,69 +96,220 @@ func (t *MySQLBackup) getAllDatabases(backup config.BackupConfig, log *logger.Lo
 	return databases, nil
 }
 
-// filterExcludedDatabases removes excluded databases from the list
-func (t *MySQLBackup) filterExcludedDatabases(databases, excluded []string) []string {
-	excludedMap := make(map[string]bool)
-	for _, db := range excluded {
-		excludedMap[db] = true
+// dumpDatabase dumps a single database, applying the table filters. Tables
+// dumped without data are appended by a second mysqldump run with --no-data.
+func (t *MySQLBackup) dumpDatabase(backup config.BackupConfig, dbName, dumpFile string, log *logger.Logger, conn *dbConnection) error {
+	bin := "mysqldump"
+	if backup.DB.MysqldumpPath != "" {
+		bin = backup.DB.MysqldumpPath
+	}
+	tables, err := t.selectTables(backup, dbName, conn)
+	if err != nil {
+		log.Error("Backup", "[%s] Failed to list tables of %s: %v", backup.Name, dbName, err)
+		return fmt.Errorf("failed to select tables of %s: %v", dbName, err)
+	}
+
+	var out []byte
+	if tables == nil || !tables.listed || len(tables.names) > 0 {
+		args := append([]string{}, backup.DB.DumpOptions...)
+		if backup.DB.SchemaOnly {
+			args = append(args, "--no-data")
+		}
+		if tables != nil {
+			for _, table := range tables.ignored {
+				args = append(args, "--ignore-table="+dbName+"."+table)
+			}
+		}
+		args = append(args, dbName)
+		if tables != nil {
+			args = append(args, tables.names...)
+		}
+		out, err = t.runClient(backup, bin, args, conn)
+		if err != nil {
+			log.Error("Backup", "[%s] DB dump failed for %s: %v", backup.Name, dbName, err)
+			return fmt.Errorf("failed to dump database %s: %v", dbName, err)
+		}
+	}
+	if tables != nil && len(tables.schemaOnly) > 0 {
+		args := append([]string{}, backup.DB.DumpOptions...)
+		args = append(args, "--no-data", dbName)
+		structure, err := t.runClient(backup, bin, append(args, tables.schemaOnly...), conn)
+		if err != nil {
+			log.Error("Backup", "[%s] DB dump failed for %s: %v", backup.Name, dbName, err)
+			return fmt.Errorf("failed to dump structure of %s: %v", dbName, err)
+		}
+		out = append(out, structure...)
+	}
+	if err := os.WriteFile(dumpFile, out, 0644); err != nil {
+		return fmt.Errorf("failed to write dump file for %s: %v", dbName, err)
+	}
+	return nil
+}
+
+// mysqlTables are the tables of a database selected by the table filters
+type mysqlTables struct {
+	listed     bool     // Whether the tables to dump are listed explicitly
+	names      []string // Tables to dump, listed when include_tables is set
+	ignored    []string // Tables skipped with --ignore-table otherwise
+	schemaOnly []string // Tables dumped without data in a second run
+}
+
+// selectTables applies the table filters to a database, listing its tables
+// with the mysql client. It returns nil when no filter applies, and an error
+// only when include_tables matches no table. A database left without tables
+// by exclude_tables is still dumped, with its views and routines.
+func (t *MySQLBackup) selectTables(backup config.BackupConfig, dbName string, conn *dbConnection) (*mysqlTables, error) {
+	include := tablePatterns(backup.DB.IncludeTables, dbName)
+	exclude := tablePatterns(backup.DB.ExcludeTables, dbName)
+	schemaOnly := tablePatterns(backup.DB.DataOnlyTables, dbName)
+	if backup.DB.SchemaOnly {
+		// Every table is dumped without data already
+		schemaOnly = nil
+	}
+	if len(include) == 0 && len(exclude) == 0 && len(schemaOnly) == 0 {
+		return nil, nil
+	}
+
+	bin := "mysql"
+	if backup.DB.MySQLPath != "" {
+		bin = backup.DB.MySQLPath
+	}
+	out, err := t.runClient(backup, bin, []string{"-N", "-e", "SHOW TABLES", dbName}, conn)
+	if err != nil {
+		return nil, err
 	}
 
-	var filtered []string
-	for _, db := range databases {
-		if !excludedMap[db] {
-			filtered = append(filtered, db)
+	tables := &mysqlTables{}
+	included := 0
+	for _, table := range strings.Split(string(out), "\n") {
+		if table = strings.TrimSpace(table); table == "" {
+			continue
+		}
+		if matchTable(include, table) {
+			included++
 		}
+		switch {
+		case len(include) > 0 && !matchTable(include, table), matchTable(exclude, table):
+			tables.ignored = append(tables.ignored, table)
+		case matchTable(schemaOnly, table):
+			tables.ignored = append(tables.ignored, table)
+			tables.schemaOnly = append(tables.schemaOnly, table)
+		default:
+			tables.names = append(tables.names, table)
+		}
+	}
+	if len(include) > 0 && included == 0 {
+		return nil, fmt.Errorf("no table matches include_tables %s", strings.Join(include, ", "))
+	}
+	if len(include) > 0 {
+		tables.listed = true
+		tables.ignored = nil
+	} else {
+		// Without include_tables the whole database is dumped, views and
+		// routines included, minus the ignored tables
+		tables.names = nil
 	}
-	return filtered
+	return tables, nil
 }
 
-// dumpDatabase dumps a single database
-func (t *MySQLBackup) dumpDatabase(backup config.BackupConfig, dbName, dumpFile string, log *logger.Logger, localPort int, useTunnel bool) error {
-	bin := "mysqldump"
-	if backup.DB.MysqldumpPath != "" {
-		bin = backup.DB.MysqldumpPath
+// runClient runs a MySQL client program and returns its stdout
+func (t *MySQLBackup) runClient(backup config.BackupConfig, bin string, args []string, conn *dbConnection) ([]byte, error) {
+	var stdout bytes.Buffer
+	if err := t.runClientTo(backup, bin, args, conn, nil, nil, &stdout); err != nil {
+		return nil, err
 	}
-	args := []string{"-u", backup.DB.User}
-	if backup.DB.Password != "" {
-		args = append(args, fmt.Sprintf("-p%s", backup.DB.Password))
-	}
-	args = append(args, backup.DB.DumpOptions...)
-	args = append(args, dbName)
-	if useTunnel {
-		args = append([]string{"-h", "127.0.0.1", "-P", fmt.Sprintf("%d", localPort)}, args...)
-	} else if backup.SSH != nil {
-		sshArgs := []string{}
-		if backup.SSH.KeyFile != "" {
-			sshArgs = append(sshArgs, "-i", backup.SSH.KeyFile)
+	return stdout.Bytes(), nil
+}
+
+// runClientTo runs a MySQL client program reading stdin and writing its stdout
+// to stdout. The credentials are passed in a private option file with
+// --defaults-extra-file so they never appear on a command line: a local
+// temporary file when running locally or through the SSH tunnel, a remote one
+// created from stdin when running on the SSH host. On the SSH host, script may
+// wrap the quoted client command into a larger shell script, and stdin must be
+// nil as it carries the option file.
+func (t *MySQLBackup) runClientTo(backup config.BackupConfig, bin string, args []string, conn *dbConnection, script func(command string) string, stdin io.Reader, stdout io.Writer) error {
+	args = append(mysqlConnectionArgs(backup.DB, conn), args...)
+	return runWithOptionFile(backup, bin, args, conn, script, stdin, stdout)
+}
+
+// runWithOptionFile runs a program taking a MySQL option file, with the
+// connection options already in args, as described for runClientTo
+func runWithOptionFile(backup config.BackupConfig, bin string, args []string, conn *dbConnection, script func(command string) string, stdin io.Reader, stdout io.Writer) error {
+	optionFile := mysqlOptionFile(backup.DB)
+
+	var stderr bytes.Buffer
+	if conn.remote() {
+		if stdin != nil {
+			return fmt.Errorf("cannot send input to %s on the SSH host", bin)
 		}
-		sshArgs = append(sshArgs, fmt.Sprintf("%s@%s", backup.SSH.User, backup.SSH.Host), bin)
-		sshArgs = append(sshArgs, args...)
-		dumpCmd := exec.Command("ssh", sshArgs...)
-		var out bytes.Buffer
-		dumpCmd.Stdout = &out
-		dumpCmd.Stderr = &out
-		if err := dumpCmd.Run(); err != nil {
-			log.Error("Backup", "[%s] DB dump failed for %s: %v, output: %s", backup.Name, dbName, err, out.String())
-			return fmt.Errorf("failed to dump database %s: %v, output: %s", dbName, err, out.String())
+		remoteCommand := shellQuote(bin) + ` --defaults-extra-file="$SECRET_FILE" ` + shellJoin(args)
+		if script != nil {
+			remoteCommand = script(remoteCommand)
 		}
-		if err := os.WriteFile(dumpFile, out.Bytes(), 0644); err != nil {
-			return fmt.Errorf("failed to write dump file for %s: %v", dbName, err)
+		err := conn.ssh.Run(remoteSecretFileCommand(remoteCommand), strings.NewReader(optionFile), stdout, &stderr)
+		if err != nil {
+			return fmt.Errorf("%v, output: %s", err, strings.TrimSpace(stderr.String()))
 		}
 		return nil
 	}
-	dumpCmd := exec.Command(bin, args...)
-	var out bytes.Buffer
-	dumpCmd.Stdout = &out
-	dumpCmd.Stderr = &out
-	if err := dumpCmd.Run(); err != nil {
-		log.Error("Backup", "[%s] DB dump failed for %s: %v, output: %s", backup.Name, dbName, err, out.String())
-		return fmt.Errorf("failed to dump database %s: %v, output: %s", dbName, err, out.String())
+
+	optionPath, cleanup, err := writeSecretFile("mysql-*.cnf", optionFile)
+	if err != nil {
+		return err
 	}
-	if err := os.WriteFile(dumpFile, out.Bytes(), 0644); err != nil {
-		return fmt.Errorf("failed to write dump file for %s: %v", dbName, err)
+	defer cleanup()
+	cmd := exec.Command(bin, append([]string{"--defaults-extra-file=" + optionPath}, args...)...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v, output: %s", err, strings.TrimSpace(stderr.String()))
 	}
 	return nil
 }
 
+// mysqlConnectionArgs returns the client options selecting the server and TLS settings
+func mysqlConnectionArgs(db *config.DBConfig, conn *dbConnection) []string {
+	var args []string
+	if conn.socket != "" {
+		args = append(args, "--socket="+conn.socket)
+	}
+	if conn.host != "" {
+		args = append(args, "-h", conn.host)
+	}
+	if conn.port != 0 {
+		args = append(args, "-P", strconv.Itoa(conn.port))
+	}
+	return append(args, mysqlSSLArgs(db)...)
+}
+
+// mysqlSSLArgs returns the client options of the TLS settings
+func mysqlSSLArgs(db *config.DBConfig) []string {
+	var args []string
+	if mode, ok := mysqlSSLModes[db.SSLMode]; ok {
+		args = append(args, "--ssl-mode="+mode)
+	}
+	if db.SSLCA != "" {
+		args = append(args, "--ssl-ca="+db.SSLCA)
+	}
+	if db.SSLCert != "" {
+		args = append(args, "--ssl-cert="+db.SSLCert, "--ssl-key="+db.SSLKey)
+	}
+	return args
+}
+
+// mysqlSSLModes maps the ssl_mode values, named after libpq, to MySQL client modes
+var mysqlSSLModes = map[string]string{
+	"disable":     "DISABLED",
+	"prefer":      "PREFERRED",
+	"require":     "REQUIRED",
+	"verify-ca":   "VERIFY_CA",
+	"verify-full": "VERIFY_IDENTITY",
+}
+
+// DatabaseResults returns the outcome of each database dump of the last run
+func (t *MySQLBackup) DatabaseResults() []history.DatabaseResult { return t.results }
+
 // Kind returns the type of backup
 func (t *MySQLBackup) Kind() string { return "mysql" }
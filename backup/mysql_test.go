@@ -3,7 +3,9 @@ package backup
 import (
 	"backupdb/archive"
 	"backupdb/config"
+	"backupdb/history"
 	"backupdb/logger"
+	"encoding/json"
 	"os"
 	"path/filepath"
 	"testing"
@@ -40,10 +42,9 @@ func TestMySQLBackup_DumpLocalSingleDB(t *testing.T) {
 	}
 	task := &MySQLBackup{archiveService: archive.NewArchiveService()}
 	err := task.Run(cfg, backupDir, backupFile, logger.Get())
-	// Should succeed in creating archive even if dump fails
-	assert.NoError(t, err)
-	// Check that archive was created
-	assert.FileExists(t, backupFile)
+	// Should fail without an archive when the only database fails to dump
+	assert.ErrorContains(t, err, "failed to dump database testdb")
+	assert.NoFileExists(t, backupFile)
 }
 
 func TestMySQLBackup_DumpMultipleDBs_Exclude(t *testing.T) {
@@ -64,10 +65,9 @@ func TestMySQLBackup_DumpMultipleDBs_Exclude(t *testing.T) {
 	}
 	task := &MySQLBackup{archiveService: archive.NewArchiveService()}
 	err := task.Run(cfg, backupDir, backupFile, logger.Get())
-	// Should succeed in creating archive even if dumps fail
-	assert.NoError(t, err)
-	// Check that archive was created
-	assert.FileExists(t, backupFile)
+	// Should fail without an archive when every database fails to dump
+	assert.ErrorContains(t, err, "failed to dump all 2 databases: db1, db3")
+	assert.NoFileExists(t, backupFile)
 }
 
 func TestMySQLBackup_CleanupMaxBackups(t *testing.T) {
@@ -104,3 +104,107 @@ func TestMySQLBackup_CleanupMaxBackups(t *testing.T) {
 	entries, _ := os.ReadDir(backupDir)
 	assert.LessOrEqual(t, len(entries), 2)
 }
+
+func TestMySQLConnectionArgs(t *testing.T) {
+	db := &config.DBConfig{SSLMode: "verify-full", SSLCA: "/certs/ca.pem", SSLCert: "/certs/client.pem", SSLKey: "/certs/client.key"}
+	assert.Equal(t, []string{
+		"-h", "127.0.0.1", "-P", "40000",
+		"--ssl-mode=VERIFY_IDENTITY", "--ssl-ca=/certs/ca.pem", "--ssl-cert=/certs/client.pem", "--ssl-key=/certs/client.key",
+	}, mysqlConnectionArgs(db, &dbConnection{host: "127.0.0.1", port: 40000}))
+
+	assert.Equal(t, []string{"--socket=/run/mysqld/mysqld.sock"}, mysqlConnectionArgs(&config.DBConfig{}, &dbConnection{socket: "/run/mysqld/mysqld.sock"}))
+}
+
+func TestMySQLBackup_PartialFailurePolicy(t *testing.T) {
+	defer os.RemoveAll("backups")
+	// A fake mysqldump failing for db2
+	dir := t.TempDir()
+	fakeDump := filepath.Join(dir, "mysqldump")
+	assert.NoError(t, os.WriteFile(fakeDump, []byte("#!/bin/sh\nfor last; do :; done\n[ \"$last\" = db2 ] && { echo 'access denied' >&2; exit 2; }\necho \"dump of $last\"\n"), 0755))
+
+	backupCfg := config.BackupConfig{
+		Name: "mysql-partial",
+		Type: "mysql",
+		DB:   &config.DBConfig{Databases: []string{"db1", "db2", "db3"}, MysqldumpPath: fakeDump, Parallelism: 2},
+	}
+	service := NewBackupService(&config.Config{})
+	run, err := service.RunBackup(backupCfg)
+	assert.NoError(t, err)
+	assert.Equal(t, history.StatusPartial, run.Status)
+	assert.Equal(t, "failed to dump databases: db2", run.Error)
+	assert.Len(t, run.Databases, 3)
+
+	restoreDir := filepath.Join(dir, "restored")
+	assert.NoError(t, archive.NewArchiveService().ExtractArchive(filepath.Join("backups", "mysql-partial", run.Archive), restoreDir))
+	var manifest dumpManifest
+	data, err := os.ReadFile(filepath.Join(restoreDir, manifestFile))
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(data, &manifest))
+	assert.False(t, manifest.Complete)
+	assert.Equal(t, "db2", manifest.Databases[1].Database)
+	assert.False(t, manifest.Databases[1].Success)
+	assert.Contains(t, manifest.Databases[1].Error, "access denied")
+	assert.NoFileExists(t, filepath.Join(restoreDir, "db2.sql"))
+	assert.FileExists(t, filepath.Join(restoreDir, "db3.sql"))
+
+	backupCfg.DB.OnPartialFailure = config.PartialFailureFail
+	run, err = service.RunBackup(backupCfg)
+	assert.ErrorContains(t, err, "failed to dump 1 of 3 databases: db2")
+	assert.Equal(t, history.StatusFailed, run.Status)
+	assert.Empty(t, run.Archive)
+
+	// A run where no database was dumped fails whatever the policy
+	backupCfg.DB.OnPartialFailure = config.PartialFailureWarn
+	backupCfg.DB.Databases = []string{"db2"}
+	run, err = service.RunBackup(backupCfg)
+	assert.ErrorContains(t, err, "access denied")
+	assert.Equal(t, history.StatusFailed, run.Status)
+	assert.Empty(t, run.Archive)
+
+	backupCfg.DB.Databases = []string{"db2", "db2"}
+	run, err = service.RunBackup(backupCfg)
+	assert.ErrorContains(t, err, "failed to dump all 2 databases: db2, db2")
+	assert.Equal(t, history.StatusFailed, run.Status)
+}
+
+func TestMySQLBackup_TableFilters(t *testing.T) {
+	// Fake clients: mysql lists the tables, mysqldump echoes its arguments
+	dir := t.TempDir()
+	fakeMySQL := filepath.Join(dir, "mysql")
+	assert.NoError(t, os.WriteFile(fakeMySQL, []byte("#!/bin/sh\nprintf 'orders\\nsessions\\ntmp_import\\nusers\\n'\n"), 0755))
+	fakeDump := filepath.Join(dir, "mysqldump")
+	assert.NoError(t, os.WriteFile(fakeDump, []byte("#!/bin/sh\nshift\necho \"$*\"\n"), 0755))
+
+	backupCfg := config.BackupConfig{
+		Name: "mysql-tables",
+		DB: &config.DBConfig{
+			MySQLPath:      fakeMySQL,
+			MysqldumpPath:  fakeDump,
+			ExcludeTables:  []string{"tmp_*", "other:users"},
+			DataOnlyTables: []string{"shop:sessions"},
+		},
+	}
+	task := &MySQLBackup{}
+	dumpFile := filepath.Join(dir, "shop.sql")
+	assert.NoError(t, task.dumpDatabase(backupCfg, "shop", dumpFile, logger.Get(), &dbConnection{}))
+	data, err := os.ReadFile(dumpFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "--ignore-table=shop.sessions --ignore-table=shop.tmp_import shop\n--no-data shop sessions\n", string(data))
+
+	backupCfg.DB.IncludeTables = []string{"o*", "sessions"}
+	assert.NoError(t, task.dumpDatabase(backupCfg, "shop", dumpFile, logger.Get(), &dbConnection{}))
+	data, err = os.ReadFile(dumpFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "shop orders\n--no-data shop sessions\n", string(data))
+
+	backupCfg.DB.IncludeTables = []string{"missing_*"}
+	assert.ErrorContains(t, task.dumpDatabase(backupCfg, "shop", dumpFile, logger.Get(), &dbConnection{}), "no table matches include_tables missing_*")
+
+	// Excluding every table still dumps the views and routines of the database
+	backupCfg.DB.IncludeTables = nil
+	backupCfg.DB.ExcludeTables = []string{"*"}
+	assert.NoError(t, task.dumpDatabase(backupCfg, "shop", dumpFile, logger.Get(), &dbConnection{}))
+	data, err = os.ReadFile(dumpFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "--ignore-table=shop.orders --ignore-table=shop.sessions --ignore-table=shop.tmp_import --ignore-table=shop.users shop\n", string(data))
+}
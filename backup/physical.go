@@ -0,0 +1,469 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"backupdb/archive"
+	"backupdb/config"
+	"backupdb/logger"
+	"backupdb/storage"
+)
+
+const (
+	physicalStreamFile   = "backup.xbstream"     // xtrabackup stream, in the archive
+	physicalManifestFile = "physical.json"       // LSN range of the stream, in the archive
+	physicalStateFile    = "physical_state.json" // End of the newest stored backup, in the local backup directory
+	checkpointsFile      = "xtrabackup_checkpoints"
+)
+
+// MySQLPhysicalBackup implements BackupTask for physical MySQL backups with
+// Percona XtraBackup or mariabackup, streamed in xbstream format. With
+// db.incremental_runs, runs between two full backups only copy the pages
+// changed since the previous run.
+type MySQLPhysicalBackup struct {
+	archiveService *archive.ArchiveService
+	statePath      string
+	state          physicalState // Saved once the archive of the run is stored
+}
+
+// physicalManifest describes the backup of an archive
+type physicalManifest struct {
+	Backup      string    `json:"backup"`
+	Archive     string    `json:"archive"` // Name of the archive, to find the ones an incremental backup builds on
+	CreatedAt   time.Time `json:"created_at"`
+	Incremental bool      `json:"incremental"`
+	FromLSN     uint64    `json:"from_lsn"`
+	ToLSN       uint64    `json:"to_lsn"`
+	Compressed  bool      `json:"compressed"` // Taken with --compress, decompressed before prepare
+}
+
+// physicalState records where the next incremental backup starts
+type physicalState struct {
+	ToLSN        uint64 `json:"to_lsn"`       // Last LSN of the newest stored backup
+	Incrementals int    `json:"incrementals"` // Incremental backups stored since the last full backup
+}
+
+// Run streams a full or incremental backup into backup.xbstream of the archive
+func (t *MySQLPhysicalBackup) Run(backup config.BackupConfig, backupDir, backupFile string, log *logger.Logger) error {
+	if backup.DB == nil {
+		return fmt.Errorf("missing DB config for physical backup")
+	}
+	if backup.SSH != nil && backup.SSH.Mode == config.SSHModeTunnel {
+		return fmt.Errorf("mysql_physical backups run xtrabackup on the database host, set ssh.mode to exec")
+	}
+
+	t.statePath = filepath.Join(backupDir, physicalStateFile)
+	state, err := loadPhysicalState(t.statePath)
+	if err != nil {
+		return err
+	}
+
+	conn, closeConn, err := openDBConnection(backup, config.SSHModeExec, 3306)
+	if err != nil {
+		return err
+	}
+	defer closeConn()
+
+	tempDir := filepath.Join(backupDir, "temp_physical")
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return fmt.Errorf("failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// xtrabackup keeps its temporary files and writes xtrabackup_checkpoints there
+	lsnDir, removeLSNDir, err := makeXtrabackupDir(conn)
+	if err != nil {
+		return err
+	}
+	defer removeLSNDir()
+
+	incremental := backup.DB.IncrementalRuns > 0 && state.ToLSN > 0 && state.Incrementals < backup.DB.IncrementalRuns
+	args := []string{"--backup", "--stream=xbstream", "--target-dir=" + lsnDir, "--extra-lsndir=" + lsnDir}
+	if incremental {
+		args = append(args, "--incremental-lsn="+strconv.FormatUint(state.ToLSN, 10))
+	}
+	args = append(args, xtrabackupConnectionArgs(backup.DB, conn)...)
+	args = append(args, backup.DB.DumpOptions...)
+
+	if incremental {
+		log.Info("Backup", "[%s] Taking incremental backup from LSN %d with xtrabackup", backup.Name, state.ToLSN)
+	} else {
+		log.Info("Backup", "[%s] Taking full backup with xtrabackup", backup.Name)
+	}
+	start := time.Now()
+	stream, err := os.Create(filepath.Join(tempDir, physicalStreamFile))
+	if err != nil {
+		return fmt.Errorf("failed to create stream file: %v", err)
+	}
+	err = runWithOptionFile(backup, xtrabackupBin(backup.DB), args, conn, nil, nil, stream)
+	if closeErr := stream.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Error("Backup", "[%s] Physical backup failed: %v", backup.Name, err)
+		return fmt.Errorf("failed to take physical backup: %v", err)
+	}
+
+	checkpoints, err := readXtrabackupCheckpoints(conn, lsnDir)
+	if err != nil {
+		return err
+	}
+	fromLSN, toLSN, err := parseCheckpoints(checkpoints)
+	if err != nil {
+		return err
+	}
+	size := pathSize(filepath.Join(tempDir, physicalStreamFile))
+	log.Info("Backup", "[%s] Physical backup of LSN %d to %d taken in %s (%d bytes)", backup.Name, fromLSN, toLSN, time.Since(start).Round(time.Millisecond), size)
+
+	manifest := physicalManifest{
+		Backup:      backup.Name,
+		Archive:     filepath.Base(backupFile),
+		CreatedAt:   time.Now(),
+		Incremental: incremental,
+		FromLSN:     fromLSN,
+		ToLSN:       toLSN,
+		Compressed:  hasOption(backup.DB.DumpOptions, "--compress"),
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode physical backup manifest: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tempDir, physicalManifestFile), data, 0644); err != nil {
+		return fmt.Errorf("failed to write physical backup manifest: %v", err)
+	}
+
+	err = t.archiveService.CreateBackupArchive(config.BackupConfig{
+		Name:       backup.Name,
+		SourcePath: tempDir,
+	}, backupFile)
+	if err != nil {
+		os.Remove(backupFile)
+		return fmt.Errorf("failed to create archive for physical backup: %v", err)
+	}
+
+	t.state = physicalState{ToLSN: toLSN}
+	if incremental {
+		t.state.Incrementals = state.Incrementals + 1
+	}
+	return nil
+}
+
+// SaveState records the end of the backup, once the archive is stored
+func (t *MySQLPhysicalBackup) SaveState() error {
+	if t.state.ToLSN == 0 {
+		return nil
+	}
+	if err := writeStateFile(t.statePath, t.state); err != nil {
+		return fmt.Errorf("failed to write physical backup state: %v", err)
+	}
+	return nil
+}
+
+// Kind returns the type of backup
+func (t *MySQLPhysicalBackup) Kind() string { return "mysql_physical" }
+
+// loadPhysicalState reads the state of a physical backup, empty before its first stored archive
+func loadPhysicalState(path string) (physicalState, error) {
+	var state physicalState
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("failed to read physical backup state: %v", err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("failed to parse physical backup state %s: %v", path, err)
+	}
+	return state, nil
+}
+
+// writeStateFile atomically replaces a JSON state file
+func writeStateFile(path string, state interface{}) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tempPath := path + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
+
+// xtrabackupBin returns the xtrabackup binary, db.xtrabackup_path if set
+func xtrabackupBin(db *config.DBConfig) string {
+	if db.XtrabackupPath != "" {
+		return db.XtrabackupPath
+	}
+	return "xtrabackup"
+}
+
+// xtrabackupConnectionArgs returns the xtrabackup options selecting the
+// server and TLS settings. Unlike the mysql clients, -h is the data directory.
+func xtrabackupConnectionArgs(db *config.DBConfig, conn *dbConnection) []string {
+	var args []string
+	if conn.socket != "" {
+		args = append(args, "--socket="+conn.socket)
+	}
+	if conn.host != "" {
+		args = append(args, "--host="+conn.host)
+	}
+	if conn.port != 0 {
+		args = append(args, "--port="+strconv.Itoa(conn.port))
+	}
+	return append(args, mysqlSSLArgs(db)...)
+}
+
+// makeXtrabackupDir creates a temporary directory where xtrabackup runs, on
+// the SSH host in exec mode. The returned function removes it.
+func makeXtrabackupDir(conn *dbConnection) (string, func(), error) {
+	if !conn.remote() {
+		dir, err := os.MkdirTemp("", "xtrabackup-*")
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to create xtrabackup directory: %v", err)
+		}
+		return dir, func() { os.RemoveAll(dir) }, nil
+	}
+	var stdout, stderr bytes.Buffer
+	if err := conn.ssh.Run("mktemp -d", nil, &stdout, &stderr); err != nil {
+		return "", nil, fmt.Errorf("failed to create xtrabackup directory on the SSH host: %v, output: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	dir := strings.TrimSpace(stdout.String())
+	return dir, func() { conn.ssh.Run("rm -rf "+shellQuote(dir), nil, io.Discard, io.Discard) }, nil
+}
+
+// readXtrabackupCheckpoints reads the xtrabackup_checkpoints written to dir
+func readXtrabackupCheckpoints(conn *dbConnection, dir string) ([]byte, error) {
+	if !conn.remote() {
+		data, err := os.ReadFile(filepath.Join(dir, checkpointsFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", checkpointsFile, err)
+		}
+		return data, nil
+	}
+	var stdout, stderr bytes.Buffer
+	if err := conn.ssh.Run("cat "+shellQuote(dir+"/"+checkpointsFile), nil, &stdout, &stderr); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v, output: %s", checkpointsFile, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// parseCheckpoints returns the LSN range of xtrabackup_checkpoints
+func parseCheckpoints(data []byte) (uint64, uint64, error) {
+	values := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if key, value, ok := strings.Cut(scanner.Text(), "="); ok {
+			values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	fromLSN, err := strconv.ParseUint(values["from_lsn"], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid from_lsn in %s: %q", checkpointsFile, values["from_lsn"])
+	}
+	toLSN, err := strconv.ParseUint(values["to_lsn"], 10, 64)
+	if err != nil || toLSN == 0 {
+		return 0, 0, fmt.Errorf("invalid to_lsn in %s: %q", checkpointsFile, values["to_lsn"])
+	}
+	return fromLSN, toLSN, nil
+}
+
+// hasOption reports whether options set the named option, with or without a value
+func hasOption(options []string, name string) bool {
+	for _, option := range options {
+		if option == name || strings.HasPrefix(option, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareMySQLPhysical turns an extracted physical backup into a MySQL data
+// directory in data/ of the target directory. The archives an incremental
+// backup builds on are fetched, back to the last full backup, and applied in
+// order with xtrabackup --prepare.
+func (s *BackupService) prepareMySQLPhysical(backup config.BackupConfig, opts RestoreOptions) error {
+	if backup.DB == nil {
+		return fmt.Errorf("missing DB config for physical backup")
+	}
+	manifest, err := readPhysicalManifest(opts.TargetDir)
+	if err != nil {
+		return err
+	}
+
+	// Directories holding the stream of each backup, newest first
+	chain := []string{opts.TargetDir}
+	compressed := manifest.Compressed
+	if manifest.Incremental {
+		storageName := opts.Storage
+		if storageName == "" {
+			storageName = storage.LocalStorageName
+		}
+		archives, err := s.Storage().ListArchives(storageName, backup)
+		if err != nil {
+			return fmt.Errorf("failed to list archives: %v", err)
+		}
+		index := -1
+		for i, remoteArchive := range archives {
+			if remoteArchive.Name == manifest.Archive {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return fmt.Errorf("archive %s is not in storage %s", manifest.Archive, storageName)
+		}
+
+		needed, base := manifest, false
+		for _, remoteArchive := range archives[index+1:] {
+			dir := filepath.Join(opts.TargetDir, "chain", strconv.Itoa(len(chain)))
+			archivePath, cleanup, err := s.fetchArchive(backup, storageName, remoteArchive.Name, time.Time{})
+			if err != nil {
+				return err
+			}
+			err = s.archiveService.ExtractArchive(archivePath, dir)
+			cleanup()
+			if err != nil {
+				return fmt.Errorf("failed to extract archive %s: %v", remoteArchive.Name, err)
+			}
+			previous, err := readPhysicalManifest(dir)
+			if err != nil {
+				return err
+			}
+			if previous.ToLSN != needed.FromLSN {
+				return fmt.Errorf("archive %s ends at LSN %d, %s starts at LSN %d", remoteArchive.Name, previous.ToLSN, needed.Archive, needed.FromLSN)
+			}
+			chain = append(chain, dir)
+			compressed = compressed || previous.Compressed
+			if !previous.Incremental {
+				base = true
+				break
+			}
+			needed = previous
+		}
+		if !base {
+			return fmt.Errorf("no full backup before %s in storage %s", manifest.Archive, storageName)
+		}
+		s.log.Info("Restore", "[%s] Applying %d incremental backups to the full backup", backup.Name, len(chain)-1)
+	}
+
+	// The full backup is unpacked into data/, the incremental ones into incremental/<n>/
+	dataDir := filepath.Join(opts.TargetDir, "data")
+	targets := make([]string, len(chain))
+	for i := range chain {
+		n := len(chain) - 1 - i
+		targets[i] = dataDir
+		if n > 0 {
+			targets[i] = filepath.Join(opts.TargetDir, "incremental", strconv.Itoa(n))
+		}
+		if err := s.unpackXbstream(backup.DB, filepath.Join(chain[i], physicalStreamFile), targets[i]); err != nil {
+			return err
+		}
+		if compressed {
+			if err := runXtrabackup(backup.DB, "--decompress", "--remove-original", "--target-dir="+targets[i]); err != nil {
+				return fmt.Errorf("failed to decompress backup: %v", err)
+			}
+		}
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		args := []string{"--prepare"}
+		if i > 0 {
+			// Every backup but the last one keeps its uncommitted transactions
+			args = append(args, "--apply-log-only")
+		}
+		args = append(args, "--target-dir="+dataDir)
+		if targets[i] != dataDir {
+			args = append(args, "--incremental-dir="+targets[i])
+		}
+		if err := runXtrabackup(backup.DB, args...); err != nil {
+			return fmt.Errorf("failed to prepare backup: %v", err)
+		}
+	}
+	os.RemoveAll(filepath.Join(opts.TargetDir, "chain"))
+	os.RemoveAll(filepath.Join(opts.TargetDir, "incremental"))
+	s.log.Info("Restore", "[%s] Prepared data directory %s, up to LSN %d", backup.Name, dataDir, manifest.ToLSN)
+	return nil
+}
+
+// physicalChainLength returns how many of the older archives, newest first,
+// the kept archive builds on: the incremental backups before it back to their
+// full backup, which retention must keep for it to be restored
+func (s *BackupService) physicalChainLength(backup config.BackupConfig, kept string, older []string) int {
+	for i, archivePath := range append([]string{kept}, older...) {
+		data, err := s.archiveService.ReadFile(archivePath, physicalManifestFile)
+		var manifest physicalManifest
+		if err == nil {
+			err = json.Unmarshal(data, &manifest)
+		}
+		if err != nil {
+			s.log.Error("Backup", "[%s] Failed to read the physical backup manifest of %s: %v", backup.Name, archivePath, err)
+			return i
+		}
+		if !manifest.Incremental {
+			return i
+		}
+	}
+	return len(older)
+}
+
+// readPhysicalManifest reads the manifest of an extracted physical backup
+func readPhysicalManifest(dir string) (physicalManifest, error) {
+	var manifest physicalManifest
+	data, err := os.ReadFile(filepath.Join(dir, physicalManifestFile))
+	if err != nil {
+		return manifest, fmt.Errorf("no physical backup in the archive: %v", err)
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("failed to parse %s: %v", physicalManifestFile, err)
+	}
+	return manifest, nil
+}
+
+// unpackXbstream extracts an xbstream file into dir with xbstream -x, then removes it
+func (s *BackupService) unpackXbstream(db *config.DBConfig, streamPath, dir string) error {
+	bin := "xbstream"
+	if db.XbstreamPath != "" {
+		bin = db.XbstreamPath
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	stream, err := os.Open(streamPath)
+	if err != nil {
+		return fmt.Errorf("failed to open stream file: %v", err)
+	}
+	defer stream.Close()
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(bin, "-x", "-C", dir)
+	cmd.Stdin = stream
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to unpack %s: %v, output: %s", streamPath, err, strings.TrimSpace(stderr.String()))
+	}
+	os.Remove(streamPath)
+	return nil
+}
+
+// runXtrabackup runs xtrabackup on local files, without a server connection
+func runXtrabackup(db *config.DBConfig, args ...string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command(xtrabackupBin(db), args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v, output: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"backupdb/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMySQLPhysicalBackup_IncrementalRestore(t *testing.T) {
+	defer os.RemoveAll("backups")
+	dir := t.TempDir()
+	fakeXtrabackup, fakeXbstream := writeFakeXtrabackup(t, dir)
+
+	backupCfg := config.BackupConfig{
+		Name: "mysql-physical",
+		Type: "mysql_physical",
+		DB:   &config.DBConfig{User: "backup", XtrabackupPath: fakeXtrabackup, XbstreamPath: fakeXbstream, IncrementalRuns: 2},
+	}
+	service := NewBackupService(&config.Config{Backups: []config.BackupConfig{backupCfg}})
+	var archives []string
+	for i := 0; i < 4; i++ {
+		run, err := service.RunBackup(backupCfg)
+		assert.NoError(t, err)
+		archives = append(archives, run.Archive)
+	}
+	// Two incremental runs, then a full backup again
+	state, err := loadPhysicalState(filepath.Join("backups", "mysql-physical", physicalStateFile))
+	assert.NoError(t, err)
+	assert.Equal(t, physicalState{ToLSN: 100}, state)
+
+	target := filepath.Join(dir, "restored")
+	err = service.Restore(backupCfg, RestoreOptions{TargetDir: target, Archive: archives[2]})
+	assert.NoError(t, err)
+	data, err := os.ReadFile(filepath.Join(target, "data", "stream"))
+	assert.NoError(t, err)
+	assert.Equal(t, "stream from 0\n", string(data))
+	assert.NoDirExists(t, filepath.Join(target, "incremental"))
+	assert.NoDirExists(t, filepath.Join(target, "chain"))
+
+	prepared, err := os.ReadFile(filepath.Join(dir, "prepared"))
+	assert.NoError(t, err)
+	dataDir := filepath.Join(target, "data")
+	assert.Equal(t, []string{
+		"--prepare --apply-log-only --target-dir=" + dataDir,
+		"--prepare --apply-log-only --target-dir=" + dataDir + " --incremental-dir=" + filepath.Join(target, "incremental", "1"),
+		"--prepare --target-dir=" + dataDir + " --incremental-dir=" + filepath.Join(target, "incremental", "2"),
+	}, strings.Split(strings.TrimSpace(string(prepared)), "\n"))
+
+	// An incremental backup needs the archives it builds on
+	assert.NoError(t, os.Remove(filepath.Join("backups", "mysql-physical", archives[1])))
+	err = service.Restore(backupCfg, RestoreOptions{TargetDir: filepath.Join(dir, "broken"), Archive: archives[2]})
+	assert.ErrorContains(t, err, "ends at LSN 100, "+archives[2]+" starts at LSN 200")
+}
+
+func TestMySQLPhysicalBackup_RetentionKeepsChain(t *testing.T) {
+	defer os.RemoveAll("backups")
+	dir := t.TempDir()
+	fakeXtrabackup, fakeXbstream := writeFakeXtrabackup(t, dir)
+
+	backupCfg := config.BackupConfig{
+		Name: "mysql-physical",
+		Type: "mysql_physical",
+		DB:   &config.DBConfig{XtrabackupPath: fakeXtrabackup, XbstreamPath: fakeXbstream, IncrementalRuns: 3},
+	}
+	backupCfg.Scheduler.MaxBackups = 2
+	service := NewBackupService(&config.Config{Backups: []config.BackupConfig{backupCfg}})
+	var archives []string
+	for i := 0; i < 5; i++ {
+		run, err := service.RunBackup(backupCfg)
+		assert.NoError(t, err)
+		archives = append(archives, run.Archive)
+	}
+	// The newest full backup is followed by the third incremental one of the
+	// previous chain, which needs every archive before it
+	backupDir := filepath.Join("backups", "mysql-physical")
+	for _, name := range archives {
+		assert.FileExists(t, filepath.Join(backupDir, name))
+	}
+	err := service.Restore(backupCfg, RestoreOptions{TargetDir: filepath.Join(dir, "restored"), Archive: archives[3]})
+	assert.NoError(t, err)
+
+	// Once both kept archives build on the newest full backup, the previous chain goes
+	run, err := service.RunBackup(backupCfg)
+	assert.NoError(t, err)
+	entries, err := filepath.Glob(filepath.Join(backupDir, "*.tar.gz"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(backupDir, archives[4]), filepath.Join(backupDir, run.Archive)}, entries)
+}
+
+func TestParseCheckpoints(t *testing.T) {
+	fromLSN, toLSN, err := parseCheckpoints([]byte("backup_type = incremental\nfrom_lsn = 18834498\nto_lsn = 18840311\nlast_lsn = 18840320\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(18834498), fromLSN)
+	assert.Equal(t, uint64(18840311), toLSN)
+	_, _, err = parseCheckpoints([]byte("backup_type = full-backuped\n"))
+	assert.ErrorContains(t, err, "invalid from_lsn")
+}
+
+// writeFakeXtrabackup writes a fake xtrabackup streaming the LSN it starts
+// from and logging prepare runs into dir/prepared, and a fake xbstream
+func writeFakeXtrabackup(t *testing.T, dir string) (string, string) {
+	fakeXtrabackup := filepath.Join(dir, "xtrabackup")
+	script := `#!/bin/sh
+case "$*" in
+*--prepare*) echo "$*" >> ` + dir + `/prepared; exit 0 ;;
+esac
+lsndir=""
+from=0
+for arg; do
+  case "$arg" in
+  --extra-lsndir=*) lsndir="${arg#--extra-lsndir=}" ;;
+  --incremental-lsn=*) from="${arg#--incremental-lsn=}" ;;
+  esac
+done
+printf 'backup_type = full-backuped\nfrom_lsn = %s\nto_lsn = %s\n' "$from" $((from + 100)) > "$lsndir/xtrabackup_checkpoints"
+echo "stream from $from"
+`
+	assert.NoError(t, os.WriteFile(fakeXtrabackup, []byte(script), 0755))
+	fakeXbstream := filepath.Join(dir, "xbstream")
+	assert.NoError(t, os.WriteFile(fakeXbstream, []byte("#!/bin/sh\ncat > \"$3/stream\"\n"), 0755))
+	return fakeXtrabackup, fakeXbstream
+}
@@ -3,55 +3,376 @@ package backup
 import (
 	"backupdb/archive"
 	"backupdb/config"
+	"backupdb/history"
 	"backupdb/logger"
 	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
 )
 
+// globalsFile is the dump of the roles and tablespaces, recorded in the
+// results and the manifest as a database
+const globalsFile = "globals.sql"
+
 // PostgresBackup implements BackupTask for PostgreSQL database backup
-// Handles backup of a PostgreSQL database via SSH and pg_dump
+// Handles backup of a PostgreSQL database with pg_dump, run locally, through
+// an SSH tunnel or on the SSH host
 type PostgresBackup struct {
 	archiveService *archive.ArchiveService
+	results        []history.DatabaseResult // Outcome of each database dump of the last run
 }
 
 // Run executes the PostgreSQL backup logic
 func (t *PostgresBackup) Run(backup config.BackupConfig, backupDir, backupFile string, log *logger.Logger) error {
-	if backup.SSH == nil || backup.DB == nil {
-		return fmt.Errorf("missing SSH or DB config for database backup")
+	if backup.DB == nil {
+		return fmt.Errorf("missing DB config for database backup")
 	}
-	dumpFile := filepath.Join(backupDir, fmt.Sprintf("%s.sql", backup.Name))
-	args := []string{"-i", backup.SSH.KeyFile, fmt.Sprintf("%s@%s", backup.SSH.User, backup.SSH.Host), "pg_dump"}
-	args = append(args, fmt.Sprintf("-U%s", backup.DB.User))
-	args = append(args, backup.DB.DumpOptions...)
-	args = append(args, backup.DB.Name)
-	dumpCmd := exec.Command("ssh", args...)
-	if backup.DB.Password != "" {
-		dumpCmd.Env = append(os.Environ(), fmt.Sprintf("PGPASSWORD=%s", backup.DB.Password))
+
+	conn, closeConn, err := openDBConnection(backup, config.SSHModeExec, 5432)
+	if err != nil {
+		return err
 	}
-	var out bytes.Buffer
-	dumpCmd.Stdout = &out
-	dumpCmd.Stderr = &out
-	err := dumpCmd.Run()
+	defer closeConn()
+
+	databases, err := selectDatabases(backup.DB, func() ([]string, error) {
+		return t.getAllDatabases(backup, conn)
+	})
 	if err != nil {
-		log.Error("Backup", "[%s] DB dump failed: %v, output: %s", backup.Name, err, out.String())
-		return fmt.Errorf("failed to dump database: %v, output: %s", err, out.String())
+		return err
+	}
+
+	log.Info("Backup", "[%s] Backing up %d databases: %v", backup.Name, len(databases), databases)
+
+	tempDir := filepath.Join(backupDir, "temp_dumps")
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return fmt.Errorf("failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	t.results = dumpDatabases(backup.Name, log, databases, backup.DB.Parallelism, func(dbName string) (string, error) {
+		return t.dumpDatabase(backup, dbName, tempDir, conn)
+	})
+	dumped := len(t.results) - len(failedDatabases(t.results))
+	// The roles and tablespaces are recorded as one more dump, so that a
+	// failure makes the run partial or fails it with on_partial_failure
+	if (backup.DB.Globals || backup.DB.Name == allDatabases) && dumped > 0 {
+		t.results = append(t.results, dumpDatabases(backup.Name, log, []string{globalsFile}, 1, func(name string) (string, error) {
+			dumpPath := filepath.Join(tempDir, name)
+			return dumpPath, t.dumpGlobals(backup, dumpPath, conn)
+		})...)
+	}
+	if err := checkPartialFailure(backup, log, t.results); err != nil {
+		return err
 	}
-	if err := os.WriteFile(dumpFile, out.Bytes(), 0644); err != nil {
-		return fmt.Errorf("failed to write dump file: %v", err)
+
+	if err := writeManifest(tempDir, backup, t.results); err != nil {
+		return err
 	}
+
 	err = t.archiveService.CreateBackupArchive(config.BackupConfig{
 		Name:       backup.Name,
-		SourcePath: backupDir,
+		SourcePath: tempDir,
 		Ignore:     backup.Ignore,
 	}, backupFile)
 	if err != nil {
 		os.Remove(backupFile)
 		return fmt.Errorf("failed to create archive for db backup: %v", err)
 	}
-	os.Remove(dumpFile)
+
+	log.Info("Backup", "[%s] Successfully created backup archive with %d databases", backup.Name, dumped)
+	return nil
+}
+
+// postgresUserArgs returns the client option selecting the database user
+func postgresUserArgs(db *config.DBConfig) []string {
+	if db.User == "" {
+		return nil
+	}
+	return []string{fmt.Sprintf("-U%s", db.User)}
+}
+
+// getAllDatabases lists the databases of the server accepting connections, without templates
+func (t *PostgresBackup) getAllDatabases(backup config.BackupConfig, conn *dbConnection) ([]string, error) {
+	bin := "psql"
+	if backup.DB.PSQLPath != "" {
+		bin = backup.DB.PSQLPath
+	}
+	args := append(postgresUserArgs(backup.DB), "-At", "-d", "postgres",
+		"-c", "SELECT datname FROM pg_database WHERE datallowconn AND NOT datistemplate ORDER BY datname")
+	out, err := t.runClient(backup, bin, args, conn)
+	if err != nil {
+		return nil, err
+	}
+	var databases []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			databases = append(databases, line)
+		}
+	}
+	return databases, nil
+}
+
+// dumpDatabase dumps a single database with pg_dump into tempDir, as
+// <name>.sql, <name>.dump or a <name> directory depending on the format, and
+// returns the path of the dump
+func (t *PostgresBackup) dumpDatabase(backup config.BackupConfig, dbName, tempDir string, conn *dbConnection) (string, error) {
+	bin := "pg_dump"
+	if backup.DB.PGDumpPath != "" {
+		bin = backup.DB.PGDumpPath
+	}
+	args := postgresUserArgs(backup.DB)
+
+	switch backup.DB.Format {
+	case config.DumpFormatDirectory:
+		args = append(args, "-Fd")
+		if backup.DB.Jobs > 1 {
+			args = append(args, "-j", strconv.Itoa(backup.DB.Jobs))
+		}
+		args = append(args, postgresTableArgs(backup.DB, dbName)...)
+		args = append(args, backup.DB.DumpOptions...)
+		if err := t.dumpDirectory(backup, bin, args, dbName, tempDir, conn); err != nil {
+			return "", fmt.Errorf("failed to dump database %s: %v", dbName, err)
+		}
+		return filepath.Join(tempDir, dbName), nil
+	case config.DumpFormatCustom:
+		args = append(args, "-Fc")
+	}
+	args = append(args, postgresTableArgs(backup.DB, dbName)...)
+	args = append(args, backup.DB.DumpOptions...)
+	args = append(args, dbName)
+
+	dumpFile := filepath.Join(tempDir, dbName+postgresDumpExtension(backup.DB.Format))
+	file, err := os.Create(dumpFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to create dump file for %s: %v", dbName, err)
+	}
+	defer file.Close()
+	if err := t.runClientTo(backup, bin, args, conn, nil, file); err != nil {
+		return "", fmt.Errorf("failed to dump database %s: %v", dbName, err)
+	}
+	if err := file.Close(); err != nil {
+		return "", fmt.Errorf("failed to write dump file for %s: %v", dbName, err)
+	}
+	return dumpFile, nil
+}
+
+// postgresTableArgs returns the pg_dump options applying the table filters to
+// a database. pg_dump matches the patterns itself, * and ? included.
+func postgresTableArgs(db *config.DBConfig, dbName string) []string {
+	var args []string
+	if db.SchemaOnly {
+		args = append(args, "-s")
+	}
+	for _, pattern := range tablePatterns(db.IncludeTables, dbName) {
+		args = append(args, "-t", pattern)
+	}
+	for _, pattern := range tablePatterns(db.ExcludeTables, dbName) {
+		args = append(args, "-T", pattern)
+	}
+	if !db.SchemaOnly {
+		for _, pattern := range tablePatterns(db.DataOnlyTables, dbName) {
+			args = append(args, "--exclude-table-data="+pattern)
+		}
+	}
+	return args
+}
+
+// dumpDirectory runs a directory format pg_dump writing into tempDir/<dbName>.
+// On the SSH host the dump goes to a temporary directory sent back as a tar stream.
+func (t *PostgresBackup) dumpDirectory(backup config.BackupConfig, bin string, args []string, dbName, tempDir string, conn *dbConnection) error {
+	if !conn.remote() {
+		args = append(args, "-f", filepath.Join(tempDir, dbName), dbName)
+		return t.runClientTo(backup, bin, args, conn, nil, io.Discard)
+	}
+
+	script := func(command string) string {
+		return `DUMP_DIR=$(mktemp -d) || exit 1; ` + command + ` -f "$DUMP_DIR"/` + shellQuote(dbName) + " " + shellQuote(dbName) +
+			` && tar -C "$DUMP_DIR" -cf - ` + shellQuote(dbName) + `; status=$?; rm -rf "$DUMP_DIR"; exit $status`
+	}
+	return extractTarStream(t.archiveService, tempDir, func(stdout io.Writer) error {
+		return t.runClientTo(backup, bin, args, conn, script, stdout)
+	})
+}
+
+// postgresDumpExtension returns the file extension of the dumps of a format
+func postgresDumpExtension(format string) string {
+	if format == config.DumpFormatCustom {
+		return ".dump"
+	}
+	return ".sql"
+}
+
+// dumpGlobals dumps the roles and tablespaces of the cluster with pg_dumpall --globals-only
+func (t *PostgresBackup) dumpGlobals(backup config.BackupConfig, dumpFile string, conn *dbConnection) error {
+	bin := "pg_dumpall"
+	if backup.DB.PGDumpAllPath != "" {
+		bin = backup.DB.PGDumpAllPath
+	}
+	out, err := t.runClient(backup, bin, append(postgresUserArgs(backup.DB), "--globals-only"), conn)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(dumpFile, out, 0644); err != nil {
+		return fmt.Errorf("failed to write globals dump file: %v", err)
+	}
+	return nil
+}
+
+// runClient runs a PostgreSQL client program and returns its stdout
+func (t *PostgresBackup) runClient(backup config.BackupConfig, bin string, args []string, conn *dbConnection) ([]byte, error) {
+	var stdout bytes.Buffer
+	if err := t.runClientTo(backup, bin, args, conn, nil, &stdout); err != nil {
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// runClientTo runs a PostgreSQL client program writing its stdout to stdout.
+// The password is passed in a private .pgpass file set with PGPASSFILE so it
+// never appears on a command line or in the environment: a local temporary
+// file when running locally or through the SSH tunnel, a remote one created
+// from stdin when running on the SSH host. On the SSH host, script may wrap
+// the quoted client command into a larger shell script.
+func (t *PostgresBackup) runClientTo(backup config.BackupConfig, bin string, args []string, conn *dbConnection, script func(command string) string, stdout io.Writer) error {
+	args = append(postgresConnectionArgs(conn), args...)
+	env := postgresSSLEnv(backup.DB)
+
+	var stderr bytes.Buffer
+	if conn.remote() {
+		// The environment is not forwarded over SSH, set it in the command
+		var remoteCommand string
+		for _, variable := range env {
+			name, value, _ := strings.Cut(variable, "=")
+			remoteCommand += name + "=" + shellQuote(value) + " "
+		}
+		remoteCommand += shellQuote(bin) + " " + shellJoin(args)
+		if backup.DB.Password != "" {
+			remoteCommand = `PGPASSFILE="$SECRET_FILE" ` + remoteCommand
+		}
+		if script != nil {
+			remoteCommand = script(remoteCommand)
+		}
+		var stdin io.Reader
+		if backup.DB.Password != "" {
+			remoteCommand = remoteSecretFileCommand(remoteCommand)
+			stdin = strings.NewReader(pgpassFile(backup.DB))
+		}
+		if err := conn.ssh.Run(remoteCommand, stdin, stdout, &stderr); err != nil {
+			return fmt.Errorf("%v, output: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return nil
+	}
+
+	cmd := exec.Command(bin, args...)
+	cmd.Env = append(os.Environ(), env...)
+	if backup.DB.Password != "" {
+		passFile, cleanup, err := writeSecretFile("pgpass-*", pgpassFile(backup.DB))
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		cmd.Env = append(cmd.Env, "PGPASSFILE="+passFile)
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v, output: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// postgresConnectionArgs returns the client options selecting the server
+func postgresConnectionArgs(conn *dbConnection) []string {
+	var args []string
+	if conn.socket != "" {
+		// libpq takes the socket directory as the host
+		args = append(args, "-h", conn.socket)
+	}
+	if conn.host != "" {
+		args = append(args, "-h", conn.host)
+	}
+	if conn.port != 0 {
+		args = append(args, "-p", strconv.Itoa(conn.port))
+	}
+	return args
+}
+
+// postgresSSLEnv returns the libpq environment variables of the TLS settings
+func postgresSSLEnv(db *config.DBConfig) []string {
+	var env []string
+	for _, setting := range []struct{ name, value string }{
+		{"PGSSLMODE", db.SSLMode},
+		{"PGSSLROOTCERT", db.SSLCA},
+		{"PGSSLCERT", db.SSLCert},
+		{"PGSSLKEY", db.SSLKey},
+	} {
+		if setting.value != "" {
+			env = append(env, setting.name+"="+setting.value)
+		}
+	}
+	return env
+}
+
+// DatabaseResults returns the outcome of each database dump of the last run
+func (t *PostgresBackup) DatabaseResults() []history.DatabaseResult { return t.results }
+
+// restoreDatabase restores the custom or directory format dump of a database,
+// extracted into dir, with pg_restore. pg_restore runs on this machine,
+// through an SSH tunnel if the backup uses SSH.
+func (t *PostgresBackup) restoreDatabase(backup config.BackupConfig, dir string, opts RestoreOptions) error {
+	dumpPath := filepath.Join(dir, opts.Database+".dump")
+	if _, err := os.Stat(dumpPath); err != nil {
+		dumpPath = filepath.Join(dir, opts.Database)
+		if info, err := os.Stat(dumpPath); err != nil || !info.IsDir() {
+			if _, err := os.Stat(filepath.Join(dir, opts.Database+".sql")); err == nil {
+				return fmt.Errorf("database %s was dumped as plain SQL, restore it with psql -f %s.sql", opts.Database, opts.Database)
+			}
+			return fmt.Errorf("no dump of database %s in the archive", opts.Database)
+		}
+	}
+
+	if backup.SSH != nil {
+		sshCfg := *backup.SSH
+		sshCfg.Mode = config.SSHModeTunnel
+		backup.SSH = &sshCfg
+	}
+	conn, closeConn, err := openDBConnection(backup, config.SSHModeTunnel, 5432)
+	if err != nil {
+		return err
+	}
+	defer closeConn()
+
+	bin := "pg_restore"
+	if backup.DB.PGRestorePath != "" {
+		bin = backup.DB.PGRestorePath
+	}
+	target := opts.TargetDatabase
+	if target == "" {
+		target = opts.Database
+	}
+	jobs := opts.Jobs
+	if jobs == 0 {
+		jobs = backup.DB.Jobs
+	}
+	args := append(postgresUserArgs(backup.DB), "-d", target)
+	if jobs > 1 {
+		args = append(args, "-j", strconv.Itoa(jobs))
+	}
+	for _, schema := range opts.Schemas {
+		args = append(args, "-n", schema)
+	}
+	for _, table := range opts.Tables {
+		args = append(args, "-t", table)
+	}
+	args = append(args, dumpPath)
+	if _, err := t.runClient(backup, bin, args, conn); err != nil {
+		return fmt.Errorf("failed to restore database %s into %s: %v", opts.Database, target, err)
+	}
 	return nil
 }
 
@@ -1,7 +1,13 @@
 package backup
 
 import (
+	"backupdb/archive"
 	"backupdb/config"
+	"backupdb/logger"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -16,5 +22,191 @@ func TestPostgresBackup_ConfigValidation(t *testing.T) {
 	task := &PostgresBackup{}
 	err := task.Run(backup, "", "", nil)
 	assert.Error(t, err)
-	assert.Contains(t, err.Error(), "missing SSH or DB config")
+	assert.Contains(t, err.Error(), "missing DB config")
+}
+
+func TestPostgresBackup_LocalDumpWithHostAndPassword(t *testing.T) {
+	// A fake pg_dump printing its arguments and the .pgpass file it was given
+	dir := t.TempDir()
+	fakeDump := filepath.Join(dir, "pg_dump")
+	assert.NoError(t, os.WriteFile(fakeDump, []byte("#!/bin/sh\necho \"args: $*\"\necho \"sslmode: $PGSSLMODE\"\ncat \"$PGPASSFILE\"\n"), 0755))
+
+	backupDir := filepath.Join(dir, "backups")
+	assert.NoError(t, os.MkdirAll(backupDir, 0755))
+	backupFile := filepath.Join(dir, "postgres-local.tar.gz")
+	cfg := config.BackupConfig{
+		Name: "postgres-local",
+		DB: &config.DBConfig{
+			Name:       "app",
+			Host:       "db.internal",
+			Port:       6432,
+			User:       "backup",
+			Password:   "hunter22",
+			SSLMode:    "require",
+			PGDumpPath: fakeDump,
+		},
+	}
+	task := &PostgresBackup{archiveService: archive.NewArchiveService()}
+	assert.NoError(t, task.Run(cfg, backupDir, backupFile, logger.Get()))
+
+	restoreDir := filepath.Join(dir, "restored")
+	assert.NoError(t, archive.NewArchiveService().ExtractArchive(backupFile, restoreDir))
+	dump, err := os.ReadFile(filepath.Join(restoreDir, "app.sql"))
+	assert.NoError(t, err)
+	lines := strings.SplitN(string(dump), "\n", 3)
+	assert.Equal(t, "args: -h db.internal -p 6432 -Ubackup app", lines[0])
+	assert.Equal(t, "sslmode: require", lines[1])
+	assert.Equal(t, "*:*:*:*:hunter22\n", lines[2])
+}
+
+func TestPostgresBackup_AllDatabasesWithGlobals(t *testing.T) {
+	// Fake clients: psql lists three databases, pg_dump and pg_dumpall print what they dump
+	dir := t.TempDir()
+	fakePSQL := filepath.Join(dir, "psql")
+	assert.NoError(t, os.WriteFile(fakePSQL, []byte("#!/bin/sh\nprintf 'app\\nlogs\\nreports\\n'\n"), 0755))
+	fakeDump := filepath.Join(dir, "pg_dump")
+	assert.NoError(t, os.WriteFile(fakeDump, []byte("#!/bin/sh\nfor last; do :; done\necho \"dump of $last\"\n"), 0755))
+	fakeDumpAll := filepath.Join(dir, "pg_dumpall")
+	assert.NoError(t, os.WriteFile(fakeDumpAll, []byte("#!/bin/sh\necho \"globals: $*\"\n"), 0755))
+
+	backupDir := filepath.Join(dir, "backups")
+	assert.NoError(t, os.MkdirAll(backupDir, 0755))
+	backupFile := filepath.Join(dir, "postgres-all.tar.gz")
+	cfg := config.BackupConfig{
+		Name: "postgres-all",
+		DB: &config.DBConfig{
+			Name:             "__ALL__",
+			ExcludeDatabases: []string{"logs"},
+			User:             "postgres",
+			PSQLPath:         fakePSQL,
+			PGDumpPath:       fakeDump,
+			PGDumpAllPath:    fakeDumpAll,
+		},
+	}
+	task := &PostgresBackup{archiveService: archive.NewArchiveService()}
+	assert.NoError(t, task.Run(cfg, backupDir, backupFile, logger.Get()))
+
+	restoreDir := filepath.Join(dir, "restored")
+	assert.NoError(t, archive.NewArchiveService().ExtractArchive(backupFile, restoreDir))
+	entries, err := os.ReadDir(restoreDir)
+	assert.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{"app.sql", "globals.sql", "manifest.json", "reports.sql"}, names)
+
+	dump, err := os.ReadFile(filepath.Join(restoreDir, "reports.sql"))
+	assert.NoError(t, err)
+	assert.Equal(t, "dump of reports\n", string(dump))
+	globals, err := os.ReadFile(filepath.Join(restoreDir, "globals.sql"))
+	assert.NoError(t, err)
+	assert.Equal(t, "globals: -Upostgres --globals-only\n", string(globals))
+}
+
+func TestPostgresBackup_GlobalsFailure(t *testing.T) {
+	// A fake pg_dumpall denied access to the roles
+	dir := t.TempDir()
+	fakeDump := filepath.Join(dir, "pg_dump")
+	assert.NoError(t, os.WriteFile(fakeDump, []byte("#!/bin/sh\nfor last; do :; done\necho \"dump of $last\"\n"), 0755))
+	fakeDumpAll := filepath.Join(dir, "pg_dumpall")
+	assert.NoError(t, os.WriteFile(fakeDumpAll, []byte("#!/bin/sh\necho 'permission denied for table pg_authid' >&2\nexit 1\n"), 0755))
+
+	backupDir := filepath.Join(dir, "backups")
+	assert.NoError(t, os.MkdirAll(backupDir, 0755))
+	backupFile := filepath.Join(dir, "postgres-globals.tar.gz")
+	cfg := config.BackupConfig{
+		Name: "postgres-globals",
+		DB:   &config.DBConfig{Name: "app", Globals: true, PGDumpPath: fakeDump, PGDumpAllPath: fakeDumpAll},
+	}
+	task := &PostgresBackup{archiveService: archive.NewArchiveService()}
+	assert.NoError(t, task.Run(cfg, backupDir, backupFile, logger.Get()))
+	assert.Len(t, task.DatabaseResults(), 2)
+	assert.Equal(t, []string{"globals.sql"}, failedDatabases(task.DatabaseResults()))
+	assert.Contains(t, task.DatabaseResults()[1].Error, "permission denied for table pg_authid")
+
+	restoreDir := filepath.Join(dir, "restored")
+	assert.NoError(t, archive.NewArchiveService().ExtractArchive(backupFile, restoreDir))
+	assert.NoFileExists(t, filepath.Join(restoreDir, "globals.sql"))
+	var manifest dumpManifest
+	data, err := os.ReadFile(filepath.Join(restoreDir, manifestFile))
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(data, &manifest))
+	assert.False(t, manifest.Complete)
+
+	cfg.DB.OnPartialFailure = config.PartialFailureFail
+	err = task.Run(cfg, backupDir, backupFile, logger.Get())
+	assert.ErrorContains(t, err, "failed to dump 1 of 2 databases: globals.sql")
+}
+
+func TestPostgresBackup_CustomAndDirectoryFormats(t *testing.T) {
+	// A fake pg_dump writing its arguments to stdout, or to a file in the -f directory
+	dir := t.TempDir()
+	fakeDump := filepath.Join(dir, "pg_dump")
+	script := `#!/bin/sh
+out=""
+prev=""
+for arg; do
+  [ "$prev" = "-f" ] && out="$arg"
+  prev="$arg"
+done
+if [ -n "$out" ]; then mkdir -p "$out" && echo "$*" > "$out/toc.dat"; else echo "$*"; fi
+`
+	assert.NoError(t, os.WriteFile(fakeDump, []byte(script), 0755))
+	task := &PostgresBackup{archiveService: archive.NewArchiveService()}
+
+	custom := config.BackupConfig{Name: "custom", DB: &config.DBConfig{User: "app", Format: "custom", PGDumpPath: fakeDump}}
+	dumpPath, err := task.dumpDatabase(custom, "orders", dir, &dbConnection{})
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "orders.dump"), dumpPath)
+	dump, err := os.ReadFile(dumpPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "-Uapp -Fc orders\n", string(dump))
+
+	directory := config.BackupConfig{Name: "directory", DB: &config.DBConfig{User: "app", Format: "directory", Jobs: 4, PGDumpPath: fakeDump}}
+	dumpPath, err = task.dumpDatabase(directory, "orders", dir, &dbConnection{})
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "orders"), dumpPath)
+	toc, err := os.ReadFile(filepath.Join(dir, "orders", "toc.dat"))
+	assert.NoError(t, err)
+	assert.Equal(t, "-Uapp -Fd -j 4 -f "+filepath.Join(dir, "orders")+" orders\n", string(toc))
+}
+
+func TestPostgresBackup_RestoreDatabase(t *testing.T) {
+	dir := t.TempDir()
+	fakeRestore := filepath.Join(dir, "pg_restore")
+	argsFile := filepath.Join(dir, "args")
+	assert.NoError(t, os.WriteFile(fakeRestore, []byte("#!/bin/sh\necho \"$*\" > "+argsFile+"\n"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "orders.dump"), []byte("dump"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "logs.sql"), []byte("dump"), 0644))
+
+	backupCfg := config.BackupConfig{Name: "pg", Type: "postgres", DB: &config.DBConfig{User: "app", Jobs: 2, PGRestorePath: fakeRestore}}
+	task := &PostgresBackup{}
+	err := task.restoreDatabase(backupCfg, dir, RestoreOptions{
+		Database:       "orders",
+		TargetDatabase: "orders_copy",
+		Schemas:        []string{"public"},
+		Tables:         []string{"customers", "invoices"},
+	})
+	assert.NoError(t, err)
+	args, err := os.ReadFile(argsFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "-Uapp -d orders_copy -j 2 -n public -t customers -t invoices "+filepath.Join(dir, "orders.dump")+"\n", string(args))
+
+	err = task.restoreDatabase(backupCfg, dir, RestoreOptions{Database: "logs"})
+	assert.ErrorContains(t, err, "database logs was dumped as plain SQL")
+	err = task.restoreDatabase(backupCfg, dir, RestoreOptions{Database: "missing"})
+	assert.ErrorContains(t, err, "no dump of database missing in the archive")
+}
+
+func TestPostgresTableArgs(t *testing.T) {
+	db := &config.DBConfig{
+		IncludeTables:  []string{"public.*"},
+		ExcludeTables:  []string{"app:public.tmp_*", "logs:*"},
+		DataOnlyTables: []string{"public.sessions"},
+	}
+	assert.Equal(t, []string{"-t", "public.*", "-T", "public.tmp_*", "--exclude-table-data=public.sessions"}, postgresTableArgs(db, "app"))
+
+	db.SchemaOnly = true
+	assert.Equal(t, []string{"-s", "-t", "public.*", "-T", "*"}, postgresTableArgs(db, "logs"))
 }
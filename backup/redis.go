@@ -0,0 +1,353 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"backupdb/archive"
+	"backupdb/config"
+	"backupdb/logger"
+)
+
+// How often LASTSAVE is polled while BGSAVE runs, and for how long
+var (
+	redisSavePollInterval = time.Second
+	redisSaveTimeout      = time.Hour
+)
+
+// RedisBackup implements BackupTask for Redis. With the bgsave method the
+// server writes a snapshot with BGSAVE, then its RDB file, and its AOF if
+// enabled, are copied. With the rdb method redis-cli --rdb receives a
+// snapshot over the connection, the way a replica does.
+type RedisBackup struct {
+	archiveService *archive.ArchiveService
+}
+
+// Run takes a snapshot of the server and archives it
+func (t *RedisBackup) Run(backup config.BackupConfig, backupDir, backupFile string, log *logger.Logger) error {
+	if backup.DB == nil {
+		return fmt.Errorf("missing DB config for redis backup")
+	}
+
+	conn, closeConn, err := openDBConnection(backup, config.SSHModeTunnel, 6379)
+	if err != nil {
+		return err
+	}
+	defer closeConn()
+
+	tempDir := filepath.Join(backupDir, "temp_redis")
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return fmt.Errorf("failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	start := time.Now()
+	method := redisMethod(backup)
+	if method == config.RedisMethodRDB {
+		log.Info("Backup", "[%s] Fetching RDB snapshot with redis-cli --rdb", backup.Name)
+		err = t.fetchRDB(backup, conn, filepath.Join(tempDir, "dump.rdb"))
+	} else {
+		log.Info("Backup", "[%s] Saving RDB snapshot with BGSAVE", backup.Name)
+		err = t.saveAndCopy(backup, conn, tempDir, log)
+	}
+	if err != nil {
+		log.Error("Backup", "[%s] Redis snapshot failed: %v", backup.Name, err)
+		return fmt.Errorf("failed to take redis snapshot: %v", err)
+	}
+	log.Info("Backup", "[%s] Redis snapshot taken in %s (%d bytes)", backup.Name, time.Since(start).Round(time.Millisecond), pathSize(tempDir))
+
+	err = t.archiveService.CreateBackupArchive(config.BackupConfig{
+		Name:       backup.Name,
+		SourcePath: tempDir,
+	}, backupFile)
+	if err != nil {
+		os.Remove(backupFile)
+		return fmt.Errorf("failed to create archive for redis backup: %v", err)
+	}
+	return nil
+}
+
+// Kind returns the type of backup
+func (t *RedisBackup) Kind() string { return "redis" }
+
+// redisMethod returns db.redis_method or, if unset, bgsave when the files of
+// the server are reachable: a local server or an SSH host in exec mode
+func redisMethod(backup config.BackupConfig) string {
+	if backup.DB.RedisMethod != "" {
+		return backup.DB.RedisMethod
+	}
+	if backup.SSH != nil {
+		if backup.SSH.Mode == config.SSHModeExec {
+			return config.RedisMethodBGSave
+		}
+		return config.RedisMethodRDB
+	}
+	switch backup.DB.Host {
+	case "", "localhost", "127.0.0.1", "::1":
+		return config.RedisMethodBGSave
+	}
+	return config.RedisMethodRDB
+}
+
+// fetchRDB writes a snapshot received with redis-cli --rdb to rdbPath
+func (t *RedisBackup) fetchRDB(backup config.BackupConfig, conn *dbConnection, rdbPath string) error {
+	if !conn.remote() {
+		_, err := runRedisCLI(backup, append(redisConnectionArgs(backup.DB, conn), "--rdb", rdbPath), conn, nil)
+		return err
+	}
+	// Written to a temporary file on the SSH host and streamed back
+	script := func(command string) string {
+		return `RDB_FILE=$(mktemp) || exit 1; ` + command + ` --rdb "$RDB_FILE" >&2 && cat "$RDB_FILE"; status=$?; rm -f "$RDB_FILE"; exit $status`
+	}
+	file, err := os.Create(rdbPath)
+	if err != nil {
+		return fmt.Errorf("failed to create RDB file: %v", err)
+	}
+	err = runRedisCLITo(backup, redisConnectionArgs(backup.DB, conn), conn, script, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// saveAndCopy runs BGSAVE, waits until LASTSAVE shows it finished, and copies
+// the RDB file and the AOF of the server into dir
+func (t *RedisBackup) saveAndCopy(backup config.BackupConfig, conn *dbConnection, dir string, log *logger.Logger) error {
+	lastSave, err := t.lastSave(backup, conn)
+	if err != nil {
+		return err
+	}
+	// SCHEDULE waits for a running AOF rewrite instead of failing
+	if _, err := t.command(backup, conn, "BGSAVE", "SCHEDULE"); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(redisSaveTimeout)
+	for {
+		time.Sleep(redisSavePollInterval)
+		saved, err := t.lastSave(backup, conn)
+		if err != nil {
+			return err
+		}
+		if saved > lastSave {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("BGSAVE did not finish within %s", redisSaveTimeout)
+		}
+	}
+	info, err := t.command(backup, conn, "INFO", "persistence")
+	if err != nil {
+		return err
+	}
+	if status := redisInfoField(info, "rdb_last_bgsave_status"); status != "ok" {
+		return fmt.Errorf("BGSAVE failed, rdb_last_bgsave_status is %q", status)
+	}
+
+	dataDir, err := t.configGet(backup, conn, "dir")
+	if err != nil {
+		return err
+	}
+	files := []string{}
+	rdbFile, err := t.configGet(backup, conn, "dbfilename")
+	if err != nil {
+		return err
+	}
+	files = append(files, rdbFile)
+	appendOnly, err := t.configGet(backup, conn, "appendonly")
+	if err != nil {
+		return err
+	}
+	if appendOnly == "yes" {
+		// Redis 7 keeps the AOF in a directory, earlier versions in a single file
+		aof, err := t.configGet(backup, conn, "appenddirname")
+		if err != nil {
+			return err
+		}
+		if aof == "" {
+			if aof, err = t.configGet(backup, conn, "appendfilename"); err != nil {
+				return err
+			}
+		}
+		log.Info("Backup", "[%s] Copying AOF %s along with the RDB file", backup.Name, aof)
+		files = append(files, aof)
+	}
+
+	if conn.remote() {
+		return extractTarStream(t.archiveService, dir, func(stdout io.Writer) error {
+			var stderr bytes.Buffer
+			command := "tar -C " + shellQuote(dataDir) + " -cf - " + shellJoin(files)
+			if err := conn.ssh.Run(command, nil, stdout, &stderr); err != nil {
+				return fmt.Errorf("failed to copy %s: %v, output: %s", strings.Join(files, ", "), err, strings.TrimSpace(stderr.String()))
+			}
+			return nil
+		})
+	}
+	for _, name := range files {
+		if err := copyTree(filepath.Join(dataDir, name), filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("failed to copy %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// lastSave returns the time of the last successful save, from LASTSAVE
+func (t *RedisBackup) lastSave(backup config.BackupConfig, conn *dbConnection) (int64, error) {
+	out, err := t.command(backup, conn, "LASTSAVE")
+	if err != nil {
+		return 0, err
+	}
+	saved, err := strconv.ParseInt(out, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected LASTSAVE reply %q", out)
+	}
+	return saved, nil
+}
+
+// configGet returns a setting of the server, empty if it does not know it
+func (t *RedisBackup) configGet(backup config.BackupConfig, conn *dbConnection, name string) (string, error) {
+	out, err := t.command(backup, conn, "CONFIG", "GET", name)
+	if err != nil {
+		return "", err
+	}
+	// The reply lists the name, then the value
+	lines := strings.Split(out, "\n")
+	if len(lines) < 2 {
+		return "", nil
+	}
+	return strings.TrimSpace(lines[1]), nil
+}
+
+// command runs a Redis command with redis-cli and returns its trimmed reply
+func (t *RedisBackup) command(backup config.BackupConfig, conn *dbConnection, args ...string) (string, error) {
+	out, err := runRedisCLI(backup, append(redisConnectionArgs(backup.DB, conn), args...), conn, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to run %s: %v", args[0], err)
+	}
+	reply := strings.TrimSpace(strings.ReplaceAll(string(out), "\r", ""))
+	// redis-cli prints error replies without failing on older versions
+	if code, _, _ := strings.Cut(reply, " "); redisErrorCodes[code] {
+		return "", fmt.Errorf("%s failed: %s", args[0], reply)
+	}
+	return reply, nil
+}
+
+// redisErrorCodes are the prefixes of Redis error replies
+var redisErrorCodes = map[string]bool{
+	"ERR": true, "NOAUTH": true, "WRONGPASS": true, "NOPERM": true,
+	"LOADING": true, "BUSY": true, "MISCONF": true, "READONLY": true,
+}
+
+// redisInfoField returns a field of an INFO reply
+func redisInfoField(info, name string) string {
+	for _, line := range strings.Split(info, "\n") {
+		if key, value, ok := strings.Cut(strings.TrimSpace(line), ":"); ok && key == name {
+			return value
+		}
+	}
+	return ""
+}
+
+// runRedisCLI runs redis-cli and returns its output
+func runRedisCLI(backup config.BackupConfig, args []string, conn *dbConnection, script func(command string) string) ([]byte, error) {
+	var stdout bytes.Buffer
+	if err := runRedisCLITo(backup, args, conn, script, &stdout); err != nil {
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// runRedisCLITo runs redis-cli locally, or on the SSH host in exec mode with
+// the command wrapped by script if set. The password is passed in
+// REDISCLI_AUTH instead of the command line.
+func runRedisCLITo(backup config.BackupConfig, args []string, conn *dbConnection, script func(command string) string, stdout io.Writer) error {
+	bin := "redis-cli"
+	if backup.DB.RedisCLIPath != "" {
+		bin = backup.DB.RedisCLIPath
+	}
+
+	var stderr bytes.Buffer
+	if conn.remote() {
+		remoteCommand := shellQuote(bin) + " " + shellJoin(args)
+		if script != nil {
+			remoteCommand = script(remoteCommand)
+		}
+		if backup.DB.Password != "" {
+			remoteCommand = remoteSecretFileCommand(`REDISCLI_AUTH=$(cat "$SECRET_FILE") || exit 1; export REDISCLI_AUTH; ` + remoteCommand)
+		}
+		err := conn.ssh.Run(remoteCommand, strings.NewReader(backup.DB.Password), stdout, &stderr)
+		if err != nil {
+			return fmt.Errorf("%v, output: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return nil
+	}
+
+	cmd := exec.Command(bin, args...)
+	if backup.DB.Password != "" {
+		cmd.Env = append(os.Environ(), "REDISCLI_AUTH="+backup.DB.Password)
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v, output: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// redisConnectionArgs returns the redis-cli options selecting the server, the
+// ACL user and the TLS settings
+func redisConnectionArgs(db *config.DBConfig, conn *dbConnection) []string {
+	var args []string
+	if conn.socket != "" {
+		args = append(args, "-s", conn.socket)
+	}
+	if conn.host != "" {
+		args = append(args, "-h", conn.host)
+	}
+	if conn.port != 0 {
+		args = append(args, "-p", strconv.Itoa(conn.port))
+	}
+	if db.User != "" {
+		args = append(args, "--user", db.User)
+	}
+	switch db.SSLMode {
+	case "require":
+		args = append(args, "--tls", "--insecure")
+	case "verify-ca", "verify-full":
+		args = append(args, "--tls")
+	}
+	if db.SSLCA != "" {
+		args = append(args, "--cacert", db.SSLCA)
+	}
+	if db.SSLCert != "" {
+		args = append(args, "--cert", db.SSLCert, "--key", db.SSLKey)
+	}
+	return args
+}
+
+// copyTree copies a file, or a directory with its files
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return copyFile(path, target)
+	})
+}
@@ -0,0 +1,77 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"backupdb/archive"
+	"backupdb/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisBackup_Run(t *testing.T) {
+	defer os.RemoveAll("backups")
+	defer func(interval time.Duration) { redisSavePollInterval = interval }(redisSavePollInterval)
+	redisSavePollInterval = time.Millisecond
+
+	// A fake redis-cli whose BGSAVE writes the RDB file a few polls later
+	dir := t.TempDir()
+	dataDir := filepath.Join(dir, "data")
+	assert.NoError(t, os.MkdirAll(filepath.Join(dataDir, "appendonlydir"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dataDir, "appendonlydir", "appendonly.aof.1.incr.aof"), []byte("aof"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "lastsave"), []byte("1700000000"), 0644))
+	fakeCLI := filepath.Join(dir, "redis-cli")
+	script := `#!/bin/sh
+[ "$REDISCLI_AUTH" = "redis-secret" ] || { echo "NOAUTH Authentication required."; exit 0; }
+for last; do :; done
+case "$*" in
+*"--rdb "*) echo "REDIS0011 replica" > "$last" ;;
+*LASTSAVE*)
+  if [ -f ` + dir + `/polls ]; then
+    echo x >> ` + dir + `/polls
+    if [ $(wc -l < ` + dir + `/polls) -ge 3 ]; then echo 1700000060 > ` + dir + `/lastsave; echo "REDIS0011 bgsave" > ` + dataDir + `/dump.rdb; fi
+  fi
+  cat ` + dir + `/lastsave ;;
+*"BGSAVE SCHEDULE"*) : > ` + dir + `/polls; echo "Background saving started" ;;
+*"INFO persistence"*) printf '# Persistence\r\nrdb_bgsave_in_progress:0\r\nrdb_last_bgsave_status:ok\r\n' ;;
+*"GET dir"*) printf 'dir\n` + dataDir + `\n' ;;
+*"GET dbfilename"*) printf 'dbfilename\ndump.rdb\n' ;;
+*"GET appendonly"*) printf 'appendonly\nyes\n' ;;
+*"GET appenddirname"*) printf 'appenddirname\nappendonlydir\n' ;;
+esac
+`
+	assert.NoError(t, os.WriteFile(fakeCLI, []byte(script), 0755))
+
+	backupCfg := config.BackupConfig{
+		Name: "redis",
+		Type: "redis",
+		DB:   &config.DBConfig{Password: "redis-secret", RedisCLIPath: fakeCLI},
+	}
+	service := NewBackupService(&config.Config{})
+	run, err := service.RunBackup(backupCfg)
+	assert.NoError(t, err)
+	restoreDir := filepath.Join(dir, "restored")
+	assert.NoError(t, archive.NewArchiveService().ExtractArchive(filepath.Join("backups", "redis", run.Archive), restoreDir))
+	rdb, err := os.ReadFile(filepath.Join(restoreDir, "dump.rdb"))
+	assert.NoError(t, err)
+	assert.Equal(t, "REDIS0011 bgsave\n", string(rdb))
+	assert.FileExists(t, filepath.Join(restoreDir, "appendonlydir", "appendonly.aof.1.incr.aof"))
+
+	// A remote server sends its snapshot to redis-cli --rdb
+	backupCfg.DB.Host = "cache.example.com"
+	run, err = service.RunBackup(backupCfg)
+	assert.NoError(t, err)
+	restoreDir = filepath.Join(dir, "restored-rdb")
+	assert.NoError(t, archive.NewArchiveService().ExtractArchive(filepath.Join("backups", "redis", run.Archive), restoreDir))
+	rdb, err = os.ReadFile(filepath.Join(restoreDir, "dump.rdb"))
+	assert.NoError(t, err)
+	assert.Equal(t, "REDIS0011 replica\n", string(rdb))
+
+	backupCfg.DB.Password = "wrong-password"
+	backupCfg.DB.RedisMethod = config.RedisMethodBGSave
+	_, err = service.RunBackup(backupCfg)
+	assert.ErrorContains(t, err, "LASTSAVE failed: NOAUTH Authentication required.")
+}
@@ -0,0 +1,195 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"backupdb/config"
+	"backupdb/storage"
+)
+
+// RestoreOptions selects the archive to restore and where to restore it
+type RestoreOptions struct {
+	Storage   string // Storage to fetch the archive from, "local" (default) for the local backups directory
+	Archive   string // Archive name, empty for the newest archive, or the newest before Until
+	TargetDir string // Directory the archive is extracted into, must be empty or not exist
+
+	// Database restore of a Postgres custom or directory format dump with
+	// pg_restore, of a MySQL dump with mysql, or of a MongoDB dump with mongorestore
+	Database       string   // Database whose dump is restored, empty to only extract the archive
+	TargetDatabase string   // Database restored into, defaults to Database. Must exist for Postgres.
+	Jobs           int      // Parallel pg_restore jobs, defaults to db.jobs
+	Tables         []string // Only restore these tables (Postgres) or collections (MongoDB)
+	Schemas        []string // Only restore these schemas (Postgres)
+
+	// Point-in-time recovery of a MySQL database or a Postgres cluster
+	BinlogBackup string    // mysql_binlog backup whose binlogs are replayed after the dump
+	WALBackup    string    // postgres_wal backup whose WAL files recover the base backup
+	Until        time.Time // Stop replaying at this time, zero to replay every archived binlog or WAL file
+}
+
+// Restore fetches an archive of a backup and extracts it into the target directory
+func (s *BackupService) Restore(backup config.BackupConfig, opts RestoreOptions) error {
+	if opts.TargetDir == "" {
+		return fmt.Errorf("restore target directory is required")
+	}
+	if opts.BinlogBackup != "" && (backup.Type != "mysql" || opts.Database == "") {
+		return fmt.Errorf("binlogs can only be replayed when restoring a database of a mysql backup")
+	}
+	if opts.WALBackup != "" && backup.Type != "postgres_basebackup" {
+		return fmt.Errorf("WAL files can only be replayed when restoring a postgres_basebackup backup")
+	}
+	if err := ensureEmptyDir(opts.TargetDir); err != nil {
+		return err
+	}
+
+	archivePath, cleanup, err := s.fetchArchive(backup, opts.Storage, opts.Archive, opts.Until)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	s.log.Info("Restore", "[%s] Restoring %s into %s", backup.Name, filepath.Base(archivePath), opts.TargetDir)
+	if err := s.archiveService.ExtractArchive(archivePath, opts.TargetDir); err != nil {
+		return fmt.Errorf("failed to extract archive: %v", err)
+	}
+
+	switch backup.Type {
+	case "postgres_basebackup":
+		if err := s.preparePostgresRecovery(opts); err != nil {
+			return err
+		}
+	case "mysql_physical":
+		if err := s.prepareMySQLPhysical(backup, opts); err != nil {
+			return err
+		}
+	}
+	if opts.Database != "" {
+		if err := s.restoreDatabase(backup, opts); err != nil {
+			return err
+		}
+	}
+
+	s.log.Info("Restore", "[%s] Restore completed successfully into %s", backup.Name, opts.TargetDir)
+	return nil
+}
+
+// restoreDatabase restores the dump of a database from the extracted archive
+func (s *BackupService) restoreDatabase(backup config.BackupConfig, opts RestoreOptions) error {
+	if backup.DB == nil {
+		return fmt.Errorf("database restore is only supported for mysql, postgres and mongodb backups")
+	}
+	switch backup.Type {
+	case "mysql":
+		s.log.Info("Restore", "[%s] Restoring database %s with mysql", backup.Name, opts.Database)
+		return s.restoreMySQLDatabase(backup, opts)
+	case "postgres":
+		backup, err := resolveSecrets(backup)
+		if err != nil {
+			return err
+		}
+		s.log.Info("Restore", "[%s] Restoring database %s with pg_restore", backup.Name, opts.Database)
+		task := &PostgresBackup{archiveService: s.archiveService}
+		return task.restoreDatabase(backup, opts.TargetDir, opts)
+	case "mongodb":
+		backup, err := resolveSecrets(backup)
+		if err != nil {
+			return err
+		}
+		s.log.Info("Restore", "[%s] Restoring database %s with mongorestore", backup.Name, opts.Database)
+		task := &MongoDBBackup{archiveService: s.archiveService}
+		return task.restoreDatabase(backup, opts.TargetDir, opts)
+	}
+	return fmt.Errorf("database restore is only supported for mysql, postgres and mongodb backups")
+}
+
+// fetchArchive returns a local path to an archive of a backup, downloading it from storage if needed.
+// Without an archive name, it is the newest archive created before until, if not zero.
+// The returned cleanup function removes any downloaded file.
+func (s *BackupService) fetchArchive(backup config.BackupConfig, storageName, archiveName string, until time.Time) (string, func(), error) {
+	if storageName == "" {
+		storageName = storage.LocalStorageName
+	}
+
+	if archiveName == "" {
+		archives, err := s.Storage().ListArchives(storageName, backup)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to list archives: %v", err)
+		}
+		if !until.IsZero() {
+			// Archive timestamps are the local time of their name
+			limit := until.Local().Format("20060102150405")
+			for len(archives) > 0 && archives[0].Timestamp.Format("20060102150405") > limit {
+				archives = archives[1:]
+			}
+		}
+		if len(archives) == 0 {
+			return "", nil, fmt.Errorf("no archives of %s found in storage %s", backup.Name, storageName)
+		}
+		archiveName = archives[0].Name
+	}
+
+	if storageName == storage.LocalStorageName {
+		archivePath := filepath.Join(storage.LocalBackupDir(backup), filepath.Base(archiveName))
+		if _, err := os.Stat(archivePath); err != nil {
+			return "", nil, fmt.Errorf("failed to access archive %s: %v", archiveName, err)
+		}
+		return archivePath, func() {}, nil
+	}
+
+	tempFile, err := os.CreateTemp("", "restore-*-"+filepath.Base(archiveName))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create temporary archive file: %v", err)
+	}
+	cleanup := func() { os.Remove(tempFile.Name()) }
+
+	s.log.Info("Restore", "[%s] Downloading %s from %s", backup.Name, archiveName, storageName)
+	err = s.Storage().DownloadArchive(storageName, backup, archiveName, tempFile)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to download archive %s: %v", archiveName, err)
+	}
+	return tempFile.Name(), cleanup, nil
+}
+
+// ParseRestoreTime parses the time a restore stops at, RFC 3339 or a local
+// "2006-01-02 15:04:05" time. An empty value is the zero time.
+func ParseRestoreTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected \"2006-01-02 15:04:05\" or RFC 3339", value)
+	}
+	return t, nil
+}
+
+// ensureEmptyDir fails if dir exists and is not an empty directory
+func ensureEmptyDir(dir string) error {
+	f, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to access restore target: %v", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Readdirnames(1); err != io.EOF {
+		if err != nil {
+			return fmt.Errorf("restore target %s is not a directory: %v", dir, err)
+		}
+		return fmt.Errorf("restore target %s is not empty", dir)
+	}
+	return nil
+}
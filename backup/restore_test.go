@@ -0,0 +1,66 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"backupdb/config"
+	"backupdb/history"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRestoreLocalArchive(t *testing.T) {
+	testDir := "test_data_restore"
+	os.MkdirAll(testDir, 0755)
+	defer os.RemoveAll(testDir)
+	os.WriteFile(filepath.Join(testDir, "test.txt"), []byte("test content"), 0644)
+	defer os.RemoveAll("backups")
+
+	backupCfg := config.BackupConfig{Name: "restore-test", SourcePath: testDir}
+	service := NewBackupService(&config.Config{Backups: []config.BackupConfig{backupCfg}})
+	assert.NoError(t, service.CreateBackup(backupCfg))
+
+	target := filepath.Join(t.TempDir(), "restored")
+	assert.NoError(t, service.Restore(backupCfg, RestoreOptions{TargetDir: target}))
+	content, err := os.ReadFile(filepath.Join(target, "test.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "test content", string(content))
+
+	// Restoring over existing files is refused
+	err = service.Restore(backupCfg, RestoreOptions{TargetDir: target})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not empty")
+
+	err = service.Restore(backupCfg, RestoreOptions{TargetDir: filepath.Join(t.TempDir(), "x"), Archive: "restore-test_20200101000000.tar.gz"})
+	assert.Error(t, err)
+}
+
+func TestCleanupOldBackupsKeepsPinned(t *testing.T) {
+	testDir := "test_data_pinned"
+	os.MkdirAll(testDir, 0755)
+	defer os.RemoveAll(testDir)
+	os.WriteFile(filepath.Join(testDir, "test.txt"), []byte("test content"), 0644)
+	defer os.RemoveAll("backups")
+
+	backupCfg := config.BackupConfig{Name: "pinned-test", SourcePath: testDir}
+	backupCfg.Scheduler.MaxBackups = 1
+	service := NewBackupService(&config.Config{})
+	store := history.NewStore(filepath.Join(t.TempDir(), "history.db"))
+	service.SetHistory(store)
+
+	first, err := service.RunBackup(backupCfg)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Pin(backupCfg.Name, first.Archive))
+
+	_, err = service.RunBackup(backupCfg)
+	assert.NoError(t, err)
+	_, err = service.RunBackup(backupCfg)
+	assert.NoError(t, err)
+
+	entries, err := os.ReadDir(filepath.Join("backups", backupCfg.Name))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.FileExists(t, filepath.Join("backups", backupCfg.Name, first.Archive))
+}
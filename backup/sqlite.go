@@ -0,0 +1,160 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"backupdb/archive"
+	"backupdb/config"
+	"backupdb/history"
+	"backupdb/logger"
+)
+
+// sqliteSnapshotFile is the name each copy is written under before being
+// renamed, so the .backup command never has to quote a path
+const sqliteSnapshotFile = "snapshot.db"
+
+// SQLiteBackup implements BackupTask for SQLite database files. Each file is
+// copied with the online backup API of the sqlite3 shell (.backup), a
+// consistent snapshot even while the database is being written to.
+type SQLiteBackup struct {
+	archiveService *archive.ArchiveService
+	results        []history.DatabaseResult // Outcome of each database copy of the last run
+}
+
+// Run copies every database file into the archive, under its file name
+func (t *SQLiteBackup) Run(backup config.BackupConfig, backupDir, backupFile string, log *logger.Logger) error {
+	if backup.DB == nil {
+		return fmt.Errorf("missing DB config for sqlite backup")
+	}
+	if backup.SSH != nil && backup.SSH.Mode == config.SSHModeTunnel {
+		return fmt.Errorf("sqlite backups copy the database files on the SSH host, set ssh.mode to exec")
+	}
+
+	conn, closeConn, err := openDBConnection(backup, config.SSHModeExec, 0)
+	if err != nil {
+		return err
+	}
+	defer closeConn()
+
+	databases, err := selectDatabases(backup.DB, func() ([]string, error) {
+		return nil, fmt.Errorf("__ALL__ is not supported for sqlite backups, list the database files in db.databases")
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Info("Backup", "[%s] Backing up %d SQLite databases: %v", backup.Name, len(databases), databases)
+
+	tempDir := filepath.Join(backupDir, "temp_sqlite")
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return fmt.Errorf("failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	t.results = dumpDatabases(backup.Name, log, databases, backup.DB.Parallelism, func(dbPath string) (string, error) {
+		copyPath := filepath.Join(tempDir, filepath.Base(dbPath))
+		return copyPath, t.copyDatabase(backup, dbPath, copyPath, conn)
+	})
+	if err := checkPartialFailure(backup, log, t.results); err != nil {
+		return err
+	}
+	if err := writeManifest(tempDir, backup, t.results); err != nil {
+		return err
+	}
+
+	err = t.archiveService.CreateBackupArchive(config.BackupConfig{
+		Name:       backup.Name,
+		SourcePath: tempDir,
+	}, backupFile)
+	if err != nil {
+		os.Remove(backupFile)
+		return fmt.Errorf("failed to create archive for sqlite backup: %v", err)
+	}
+
+	log.Info("Backup", "[%s] Successfully created backup archive with %d SQLite databases", backup.Name, len(databases))
+	return nil
+}
+
+// DatabaseResults returns the outcome of each database copy of the last run
+func (t *SQLiteBackup) DatabaseResults() []history.DatabaseResult { return t.results }
+
+// Kind returns the type of backup
+func (t *SQLiteBackup) Kind() string { return "sqlite" }
+
+// copyDatabase writes a snapshot of a database file to copyPath, checking its
+// integrity if db.integrity_check is set. The snapshot is taken on the SSH
+// host in exec mode and streamed back.
+func (t *SQLiteBackup) copyDatabase(backup config.BackupConfig, dbPath, copyPath string, conn *dbConnection) error {
+	bin := "sqlite3"
+	if backup.DB.SQLite3Path != "" {
+		bin = backup.DB.SQLite3Path
+	}
+	workDir, err := os.MkdirTemp(filepath.Dir(copyPath), "snapshot_")
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot directory: %v", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	if conn.remote() {
+		// Checked first, sqlite3 would create a missing database
+		script := `DB_FILE=` + shellQuote(dbPath) + `; [ -f "$DB_FILE" ] || { echo "$DB_FILE: no such database file" >&2; exit 1; }; ` +
+			`SNAPSHOT_DIR=$(mktemp -d) || exit 1; cd "$SNAPSHOT_DIR" && ` + shellQuote(bin) + ` "$DB_FILE" ".backup ` + sqliteSnapshotFile + `"`
+		if backup.DB.IntegrityCheck {
+			script += ` && result=$(` + shellQuote(bin) + ` ` + sqliteSnapshotFile + ` "PRAGMA integrity_check") && { [ "$result" = ok ] || { echo "integrity check failed: $result" >&2; false; }; }`
+		}
+		script += ` && tar -cf - ` + sqliteSnapshotFile + `; status=$?; cd / && rm -rf "$SNAPSHOT_DIR"; exit $status`
+		err = extractTarStream(t.archiveService, workDir, func(stdout io.Writer) error {
+			var stderr bytes.Buffer
+			if err := conn.ssh.Run(script, nil, stdout, &stderr); err != nil {
+				return fmt.Errorf("%v, output: %s", err, strings.TrimSpace(stderr.String()))
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to copy %s: %v", dbPath, err)
+		}
+		return os.Rename(filepath.Join(workDir, sqliteSnapshotFile), copyPath)
+	}
+
+	source, err := filepath.Abs(dbPath)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %v", dbPath, err)
+	}
+	if info, err := os.Stat(source); err != nil {
+		return fmt.Errorf("failed to access database file: %v", err)
+	} else if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a database file", dbPath)
+	}
+	if _, err := runSQLite(bin, workDir, source, ".backup "+sqliteSnapshotFile); err != nil {
+		return fmt.Errorf("failed to copy %s: %v", dbPath, err)
+	}
+	if backup.DB.IntegrityCheck {
+		out, err := runSQLite(bin, workDir, sqliteSnapshotFile, "PRAGMA integrity_check")
+		if err != nil {
+			return fmt.Errorf("failed to check integrity of %s: %v", dbPath, err)
+		}
+		if result := strings.TrimSpace(string(out)); result != "ok" {
+			return fmt.Errorf("integrity check of %s failed: %s", dbPath, result)
+		}
+	}
+	return os.Rename(filepath.Join(workDir, sqliteSnapshotFile), copyPath)
+}
+
+// runSQLite runs a command of the sqlite3 shell on a database, from dir
+func runSQLite(bin, dir, dbPath, command string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(bin, dbPath, command)
+	cmd.Dir = dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%v, output: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
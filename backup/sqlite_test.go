@@ -0,0 +1,61 @@
+package backup
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"backupdb/archive"
+	"backupdb/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSQLiteBackup_Run(t *testing.T) {
+	defer os.RemoveAll("backups")
+	// A fake sqlite3 copying the database and failing the check of corrupt ones
+	dir := t.TempDir()
+	fakeSQLite := filepath.Join(dir, "sqlite3")
+	script := `#!/bin/sh
+case "$2" in
+".backup snapshot.db") cp "$1" snapshot.db ;;
+"PRAGMA integrity_check") if grep -q corrupt "$1"; then echo "*** in database main ***"; echo "Page 5 is never used"; else echo ok; fi ;;
+*) echo "unexpected command $2" >&2; exit 1 ;;
+esac
+`
+	assert.NoError(t, os.WriteFile(fakeSQLite, []byte(script), 0755))
+	appDB := filepath.Join(dir, "app.db")
+	assert.NoError(t, os.WriteFile(appDB, []byte("app data"), 0644))
+	jobsDB := filepath.Join(dir, "jobs.db")
+	assert.NoError(t, os.WriteFile(jobsDB, []byte("corrupt data"), 0644))
+
+	backupCfg := config.BackupConfig{
+		Name: "sqlite",
+		Type: "sqlite",
+		DB:   &config.DBConfig{Databases: []string{appDB, jobsDB, filepath.Join(dir, "missing.db")}, SQLite3Path: fakeSQLite, IntegrityCheck: true},
+	}
+	service := NewBackupService(&config.Config{})
+	run, err := service.RunBackup(backupCfg)
+	assert.NoError(t, err)
+	assert.Len(t, run.Databases, 3)
+	assert.True(t, run.Databases[0].Success)
+	assert.Contains(t, run.Databases[1].Error, "integrity check of "+jobsDB+" failed: *** in database main ***")
+	assert.Contains(t, run.Databases[2].Error, "failed to access database file")
+
+	restoreDir := filepath.Join(dir, "restored")
+	assert.NoError(t, archive.NewArchiveService().ExtractArchive(filepath.Join("backups", "sqlite", run.Archive), restoreDir))
+	data, err := os.ReadFile(filepath.Join(restoreDir, "app.db"))
+	assert.NoError(t, err)
+	assert.Equal(t, "app data", string(data))
+	assert.NoFileExists(t, filepath.Join(restoreDir, "jobs.db"))
+	var manifest dumpManifest
+	data, err = os.ReadFile(filepath.Join(restoreDir, manifestFile))
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(data, &manifest))
+	assert.False(t, manifest.Complete)
+
+	backupCfg.DB.OnPartialFailure = config.PartialFailureFail
+	_, err = service.RunBackup(backupCfg)
+	assert.ErrorContains(t, err, "failed to dump 2 of 3 databases")
+}
@@ -1,8 +1,10 @@
 package config
 
 import (
+	"bytes"
 	"fmt"
 	"os"
+	"sort"
 
 	"gopkg.in/yaml.v3"
 )
@@ -11,6 +13,37 @@ import (
 type Config struct {
 	Backups []BackupConfig           `yaml:"backups"`
 	Storage map[string]StorageConfig `yaml:"storage"`
+	API     APIConfig                `yaml:"api"`
+	Secrets SecretsConfig            `yaml:"secrets"`
+
+	lines map[string]position // Position of each field in the config files, keyed by field path
+	files []string            // Absolute paths of the main file and the included ones
+}
+
+// Files returns the absolute paths of the configuration files the config was
+// loaded from, the main file and every included one
+func (c *Config) Files() []string {
+	return c.files
+}
+
+// APIConfig holds settings of the HTTP management API
+type APIConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Listen  string `yaml:"listen"` // e.g. ":8080"
+	Token   string `yaml:"token"`  // Bearer token required on every request
+}
+
+// SecretsConfig configures the secret backends of vault: and exec: references
+type SecretsConfig struct {
+	Vault VaultConfig `yaml:"vault"`
+}
+
+// VaultConfig holds the settings of a HashiCorp Vault KV secrets engine
+type VaultConfig struct {
+	Address   string `yaml:"address"`    // e.g. "https://vault:8200", defaults to $VAULT_ADDR
+	Token     string `yaml:"token"`      // Defaults to $VAULT_TOKEN
+	Namespace string `yaml:"namespace"`  // Vault Enterprise namespace
+	KVVersion int    `yaml:"kv_version"` // 1 or 2 (default)
 }
 
 // BackupConfig represents a single backup configuration
@@ -20,9 +53,11 @@ type BackupConfig struct {
 	Storage         []string              `yaml:"storage"`
 	ObjectKeyPrefix string                `yaml:"object_key_prefix"`
 	RemoteRetention RemoteRetentionConfig `yaml:"remote_retention"`
+	RunOnStart      string                `yaml:"run_on_start"`      // always (default), never, if_missed
+	Extends         string                `yaml:"extends,omitempty"` // Template the backup is based on, resolved when loading
 
 	// New fields for DB backup
-	Type string     `yaml:"type"` // folder, mysql, postgres
+	Type string     `yaml:"type"` // folder, mysql, mysql_binlog, mysql_physical, postgres, postgres_basebackup, postgres_wal, sqlite, mongodb, redis
 	SSH  *SSHConfig `yaml:"ssh,omitempty"`
 	DB   *DBConfig  `yaml:"db,omitempty"`
 
@@ -39,6 +74,13 @@ type BackupConfig struct {
 	} `yaml:"ignore"`
 }
 
+// Policies deciding whether a backup runs when the daemon starts
+const (
+	RunOnStartAlways   = "always"
+	RunOnStartNever    = "never"
+	RunOnStartIfMissed = "if_missed"
+)
+
 // RemoteRetentionConfig holds remote storage retention settings
 type RemoteRetentionConfig struct {
 	Enabled      bool `yaml:"enabled"`
@@ -49,12 +91,47 @@ type RemoteRetentionConfig struct {
 	MaxPerYear   int  `yaml:"max_per_year"`
 }
 
+// How database clients use the SSH host
+const (
+	SSHModeTunnel = "tunnel" // Local client through a port forwarded by the SSH host, the default for MySQL
+	SSHModeExec   = "exec"   // Client runs on the SSH host, the default for PostgreSQL
+)
+
+// What a database backup does when some of its databases fail to dump
+const (
+	PartialFailureWarn = "warn" // Archive the other databases, the run is recorded as partial
+	PartialFailureFail = "fail" // Fail the run without creating an archive
+)
+
+// Postgres dump formats
+const (
+	DumpFormatPlain     = "plain"     // SQL script, restored with psql
+	DumpFormatCustom    = "custom"    // pg_dump -Fc archive, restored with pg_restore
+	DumpFormatDirectory = "directory" // pg_dump -Fd directory, dumped and restored in parallel
+)
+
+// Redis snapshot methods
+const (
+	RedisMethodBGSave = "bgsave" // BGSAVE on the server, then copy of its RDB and AOF files
+	RedisMethodRDB    = "rdb"    // redis-cli --rdb, the RDB sent to the client as to a replica
+)
+
 // SSHConfig holds SSH connection info
 type SSHConfig struct {
-	Host    string `yaml:"host"`
-	Port    int    `yaml:"port"`
-	User    string `yaml:"user"`
-	KeyFile string `yaml:"key_file"`
+	Mode          string `yaml:"mode"` // SSHModeTunnel or SSHModeExec, depends on the backup type if empty
+	Host          string `yaml:"host"`
+	Port          int    `yaml:"port"`
+	User          string `yaml:"user"`
+	KeyFile       string `yaml:"key_file"`
+	KeyPassphrase string `yaml:"key_passphrase"` // Passphrase of an encrypted key file
+	UseAgent      bool   `yaml:"use_agent"`      // Authenticate with the keys of the agent at $SSH_AUTH_SOCK
+
+	KnownHostsFile        string `yaml:"known_hosts_file"`         // Defaults to ~/.ssh/known_hosts
+	InsecureIgnoreHostKey bool   `yaml:"insecure_ignore_host_key"` // Skip host key verification, for testing only
+
+	Jump              *SSHConfig `yaml:"jump,omitempty"`     // Jump host the connection goes through
+	KeepaliveInterval int        `yaml:"keepalive_interval"` // Seconds between keepalives, 30 by default, -1 disables
+	ConnectTimeout    int        `yaml:"connect_timeout"`    // Seconds, 15 by default
 }
 
 // DBConfig holds database info for dump
@@ -62,13 +139,61 @@ type DBConfig struct {
 	Name             string   `yaml:"name"`
 	Databases        []string `yaml:"databases"`
 	ExcludeDatabases []string `yaml:"exclude_databases"`
+	Parallelism      int      `yaml:"parallelism"`        // Databases dumped at the same time, 1 by default
+	OnPartialFailure string   `yaml:"on_partial_failure"` // PartialFailureWarn (default) or PartialFailureFail
+
+	// Table filters, glob patterns applying to every database or, prefixed
+	// with "<database>:", to one database. Collections for MongoDB.
+	IncludeTables  []string `yaml:"include_tables"`   // Only dump matching tables
+	ExcludeTables  []string `yaml:"exclude_tables"`   // Skip matching tables
+	DataOnlyTables []string `yaml:"data_only_tables"` // Leave the data of matching tables out, dumping their structure
+	SchemaOnly     bool     `yaml:"schema_only"`      // Dump the structure of every table without data
+
+	Host             string   `yaml:"host"`     // Server host, as seen from the SSH host when there is one
+	Port             int      `yaml:"port"`     // Server port, 3306, 5432, 27017 or 6379 by default
+	Socket           string   `yaml:"socket"`   // Unix socket path (MySQL) or directory (Postgres), instead of host and port
+	SSLMode          string   `yaml:"ssl_mode"` // disable, prefer, require, verify-ca or verify-full
+	SSLCA            string   `yaml:"ssl_ca"`   // CA certificate file verifying the server
+	SSLCert          string   `yaml:"ssl_cert"` // Client certificate file
+	SSLKey           string   `yaml:"ssl_key"`  // Client key file
 	User             string   `yaml:"user"`
 	Password         string   `yaml:"password"`
 	DumpOptions      []string `yaml:"dump_options"`
-	MySQLPath        string   `yaml:"mysql_path"`     // Path to mysql binary
-	MysqldumpPath    string   `yaml:"mysqldump_path"` // Path to mysqldump binary
-	PSQLPath         string   `yaml:"psql_path"`      // Path to psql binary (for Postgres)
-	PGDumpPath       string   `yaml:"pg_dump_path"`   // Path to pg_dump binary (for Postgres)
+	MySQLPath        string   `yaml:"mysql_path"`         // Path to mysql binary
+	MysqldumpPath    string   `yaml:"mysqldump_path"`     // Path to mysqldump binary
+	PSQLPath         string   `yaml:"psql_path"`          // Path to psql binary (for Postgres)
+	PGDumpPath       string   `yaml:"pg_dump_path"`       // Path to pg_dump binary (for Postgres)
+	PGDumpAllPath    string   `yaml:"pg_dumpall_path"`    // Path to pg_dumpall binary (for Postgres)
+	PGRestorePath    string   `yaml:"pg_restore_path"`    // Path to pg_restore binary (for Postgres)
+	PGBasebackupPath string   `yaml:"pg_basebackup_path"` // Path to pg_basebackup binary (for Postgres)
+	Format           string   `yaml:"format"`             // Postgres dump format: plain (default), custom or directory
+	Jobs             int      `yaml:"jobs"`               // Parallel pg_dump jobs (directory format) and pg_restore jobs
+	Globals          bool     `yaml:"globals"`            // Also dump roles and tablespaces (Postgres), always done for __ALL__
+
+	// Binary log archiving (mysql_binlog backups)
+	MysqlbinlogPath string `yaml:"mysqlbinlog_path"`  // Path to mysqlbinlog binary
+	BinlogStartFile string `yaml:"binlog_start_file"` // First binlog archived by the first run, the oldest on the server by default
+	FlushBinlogs    bool   `yaml:"flush_binlogs"`     // Rotate the current binlog before each run so it is archived too
+
+	// Physical backups with Percona XtraBackup or mariabackup (mysql_physical backups)
+	XtrabackupPath  string `yaml:"xtrabackup_path"`  // Path to xtrabackup binary, or mariabackup
+	XbstreamPath    string `yaml:"xbstream_path"`    // Path to xbstream binary, or mbstream, used by restores
+	IncrementalRuns int    `yaml:"incremental_runs"` // Incremental backups taken between two full backups, 0 for full backups only
+
+	// SQLite database files (sqlite backups), listed in name or databases
+	SQLite3Path    string `yaml:"sqlite3_path"`    // Path to sqlite3 binary
+	IntegrityCheck bool   `yaml:"integrity_check"` // Run PRAGMA integrity_check on each copy, failing the database if it is not ok
+
+	// MongoDB (mongodb backups)
+	URI              string `yaml:"uri"`               // Connection string, instead of host, port and socket
+	AuthSource       string `yaml:"auth_source"`       // Database the user authenticates against, admin by default
+	Oplog            bool   `yaml:"oplog"`             // Dump with --oplog for a consistent snapshot of a replica set, with name __ALL__
+	MongodumpPath    string `yaml:"mongodump_path"`    // Path to mongodump binary
+	MongorestorePath string `yaml:"mongorestore_path"` // Path to mongorestore binary
+
+	// Redis (redis backups)
+	RedisMethod  string `yaml:"redis_method"`   // RedisMethodBGSave or RedisMethodRDB, bgsave when the server files are reachable
+	RedisCLIPath string `yaml:"redis_cli_path"` // Path to redis-cli binary
 }
 
 // StorageConfig represents storage configuration
@@ -107,10 +232,67 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, fmt.Errorf("failed to read config file: %v", err)
 	}
 
+	return parseConfig(path, data)
+}
+
+// EffectiveConfig returns the configuration file as YAML with includes, defaults
+// and templates resolved. Environment variable and file references are left as
+// they are so secrets are not printed.
+func EffectiveConfig(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	root, _, err := resolveConfig(path, data)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(root); err != nil {
+		return nil, fmt.Errorf("failed to encode config: %v", err)
+	}
+	return out.Bytes(), nil
+}
+
+// parseConfig decodes a configuration, rejecting unknown fields, records the
+// line of every field so validation errors can point at them and resolves
+// environment variable and file references
+func parseConfig(path string, data []byte) (*Config, error) {
+	root, loader, err := resolveConfig(path, data)
+	if err != nil {
+		return nil, err
+	}
+
 	var config Config
-	if err := yaml.Unmarshal(data, &config); err != nil {
+	if err := root.Decode(&config); err != nil {
 		return nil, fmt.Errorf("failed to parse config file: %v", err)
 	}
+	config.lines = make(map[string]position)
+	loader.recordLines(root, "", config.lines)
+	for file := range loader.loaded {
+		config.files = append(config.files, file)
+	}
+	sort.Strings(config.files)
 
+	if err := config.interpolate(); err != nil {
+		return nil, err
+	}
 	return &config, nil
 }
+
+// resolveConfig loads a configuration file with its includes and applies
+// defaults and templates to its backups
+func resolveConfig(path string, data []byte) (*yaml.Node, *configLoader, error) {
+	loader := newConfigLoader(path)
+	root, err := loader.load(path, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := loader.resolve(root); err != nil {
+		return nil, nil, err
+	}
+	return root, loader, nil
+}
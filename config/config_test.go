@@ -0,0 +1,314 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	cfg := &Config{
+		Backups: []BackupConfig{{Name: "a", SourcePath: "data", Storage: []string{"s3"}}},
+		Storage: map[string]StorageConfig{"s3": {Kind: "s3"}},
+	}
+	assert.NoError(t, cfg.Validate())
+
+	cfg.Backups = append(cfg.Backups, BackupConfig{Name: "a"})
+	assert.ErrorContains(t, cfg.Validate(), "duplicate backup name a")
+
+	cfg.Backups = []BackupConfig{{Name: "a", Storage: []string{"missing"}}}
+	assert.ErrorContains(t, cfg.Validate(), "storage missing is not configured")
+
+	cfg.Backups = []BackupConfig{{}}
+	assert.ErrorContains(t, cfg.Validate(), "name is required")
+
+	// Postgres no longer needs SSH, but the SSH mode must be known
+	cfg.Backups = []BackupConfig{{Name: "pg", Type: "postgres", DB: &DBConfig{Name: "app"}}}
+	assert.NoError(t, cfg.Validate())
+	cfg.Backups[0].SSH = &SSHConfig{Mode: "socks", Host: "db", Port: 22, User: "backup", KeyFile: "id"}
+	assert.ErrorContains(t, cfg.Validate(), `backups[0].ssh.mode: unknown ssh mode "socks", expected one of tunnel, exec`)
+
+	// A socket can't go through the default MySQL tunnel
+	cfg.Backups[0] = BackupConfig{Name: "my", Type: "mysql", DB: &DBConfig{Name: "app", Socket: "/run/mysqld/mysqld.sock", SSLMode: "required"}}
+	cfg.Backups[0].SSH = &SSHConfig{Host: "db", Port: 22, User: "backup", KeyFile: "id"}
+	err := cfg.Validate()
+	assert.ErrorContains(t, err, "backups[0].db.socket: socket cannot be used through an SSH tunnel, set ssh.mode to exec")
+	assert.ErrorContains(t, err, `backups[0].db.ssl_mode: unknown ssl_mode "required"`)
+	cfg.Backups[0].SSH.Mode = SSHModeExec
+	cfg.Backups[0].DB.SSLMode = "require"
+	assert.NoError(t, cfg.Validate())
+
+	// Table filters are globs, optionally prefixed with a database name
+	cfg.Backups[0].DB.ExcludeTables = []string{"app:tmp_*", ":sessions", "log[s"}
+	err = cfg.Validate()
+	assert.ErrorContains(t, err, `backups[0].db.exclude_tables[1]: database name missing in table pattern ":sessions"`)
+	assert.ErrorContains(t, err, `backups[0].db.exclude_tables[2]: invalid table pattern "log[s"`)
+
+	// WAL archives are pushed by archive_command, base backups need no database name
+	cfg.Backups = []BackupConfig{{Name: "pg-base", Type: "postgres_basebackup", DB: &DBConfig{User: "replicator"}}, {Name: "pg-wal", Type: "postgres_wal"}}
+	assert.NoError(t, cfg.Validate())
+	cfg.Backups[1].Scheduler.Enabled = true
+	assert.ErrorContains(t, cfg.Validate(), "backups[1].scheduler.enabled: postgres_wal backups run from archive_command with -wal-push, not on a schedule")
+
+	// xtrabackup reads the data files, it cannot run through a tunnel
+	cfg.Backups = []BackupConfig{{Name: "mysql-physical", Type: "mysql_physical", DB: &DBConfig{IncrementalRuns: 6}, SSH: &SSHConfig{Host: "db", Port: 22, User: "backup", UseAgent: true, Mode: SSHModeTunnel}}}
+	assert.ErrorContains(t, cfg.Validate(), "backups[0].db: mysql_physical backups run xtrabackup on the database host, set ssh.mode to exec")
+	cfg.Backups[0].SSH.Mode = ""
+	assert.NoError(t, cfg.Validate())
+	cfg.Backups[0].Scheduler.MaxBackups = 6
+	assert.NoError(t, cfg.Validate())
+	warnings := cfg.Warnings()
+	assert.Len(t, warnings, 1)
+	assert.Equal(t, "backups[0].scheduler.max_backups: max_backups 6 does not cover a full backup and its 6 incremental runs, older archives are kept until the full backup the kept ones build on", warnings[0].String())
+
+	// SQLite files are archived under their file name
+	cfg.Backups = []BackupConfig{{Name: "sqlite", Type: "sqlite", DB: &DBConfig{Databases: []string{"/srv/app/data.db", "/srv/jobs/data.db"}}}}
+	assert.ErrorContains(t, cfg.Validate(), "backups[0].db: database files /srv/app/data.db and /srv/jobs/data.db have the same file name")
+	cfg.Backups[0].DB.Databases = []string{"/srv/app/data.db", "/srv/jobs/jobs.db"}
+	assert.NoError(t, cfg.Validate())
+
+	// mongodump only records the oplog of whole instance dumps
+	cfg.Backups = []BackupConfig{{Name: "mongo", Type: "mongodb", DB: &DBConfig{Databases: []string{"shop"}, Oplog: true, ExcludeTables: []string{"cache_*", "*_tmp"}}}}
+	err = cfg.Validate()
+	assert.ErrorContains(t, err, "backups[0].db.oplog: oplog requires db.name __ALL__")
+	assert.ErrorContains(t, err, `backups[0].db.exclude_tables[1]: excluded collections of mongodb backups must be names or prefixes ending with *, got "*_tmp"`)
+	assert.NotContains(t, err.Error(), "exclude_tables[0]")
+	cfg.Backups[0].DB = &DBConfig{Name: "__ALL__", URI: "mongodb://rs0.example.com/?replicaSet=rs0", Oplog: true, ExcludeDatabases: []string{"local"}, ExcludeTables: []string{"cache_*"}}
+	assert.NoError(t, cfg.Validate())
+	cfg.Backups[0].DB.IncludeTables = []string{"shop:orders"}
+	assert.ErrorContains(t, cfg.Validate(), "backups[0].db.include_tables: include_tables is not supported when dumping the whole instance with db.name __ALL__")
+
+	// BGSAVE writes the RDB file on the server, out of reach through a tunnel
+	cfg.Backups = []BackupConfig{{Name: "redis", Type: "redis", DB: &DBConfig{RedisMethod: RedisMethodBGSave}, SSH: &SSHConfig{Host: "cache", Port: 22, User: "backup", UseAgent: true}}}
+	assert.ErrorContains(t, cfg.Validate(), "backups[0].db.redis_method: bgsave copies the files of the server, which an SSH tunnel cannot reach")
+	cfg.Backups[0].SSH.Mode = SSHModeExec
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestDiff(t *testing.T) {
+	oldCfg := &Config{
+		Backups: []BackupConfig{{Name: "kept"}, {Name: "removed"}, {Name: "rescheduled"}},
+		Storage: map[string]StorageConfig{"s3": {Kind: "s3", Bucket: "a"}, "gone": {Kind: "rsync"}},
+	}
+	newCfg := &Config{
+		Backups: []BackupConfig{{Name: "kept"}, {Name: "rescheduled"}, {Name: "added"}},
+		Storage: map[string]StorageConfig{"s3": {Kind: "s3", Bucket: "b"}, "new": {Kind: "rsync"}},
+	}
+	newCfg.Backups[1].Scheduler.Enabled = true
+	newCfg.Backups[1].Scheduler.CronExpr = "0 2 * * *"
+
+	assert.Empty(t, Diff(oldCfg, oldCfg))
+	assert.Equal(t, []string{
+		`backup rescheduled schedule changed: disabled -> "0 2 * * *" (max_backups 0)`,
+		"backup added added",
+		"backup removed removed",
+		"storage gone removed",
+		"storage new added",
+		"storage s3 changed",
+	}, Diff(oldCfg, newCfg))
+}
+
+func TestParseConfigRejectsUnknownFields(t *testing.T) {
+	_, err := parseConfig("", []byte("backups:\n  - name: a\n    sorce_path: data\n"))
+	assert.ErrorContains(t, err, "line 3: field sorce_path not found")
+
+	cfg, err := parseConfig("", []byte(""))
+	assert.NoError(t, err)
+	assert.Empty(t, cfg.Backups)
+
+	cfg, err = parseConfig("", []byte("backups:\n  - name: a\n    type: mysql\n    db:\n      data_only_tables: [sessions]\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sessions"}, cfg.Backups[0].DB.DataOnlyTables)
+}
+
+func TestValidateReportsLines(t *testing.T) {
+	cfg, err := parseConfig("", []byte(`backups:
+  - name: db
+    type: mysql
+    storage: [s3, missing]
+    ssh:
+      host: db.example.com
+      user: root
+    db:
+      name: app
+    run_on_start: sometimes
+    scheduler:
+      enabled: true
+      cron_expr: "0 25 * * *"
+storage:
+  s3:
+    enabled: false
+    kind: s3
+  ftp:
+    kind: ftp
+`))
+	assert.NoError(t, err)
+
+	validationErr, ok := cfg.Validate().(*ValidationError)
+	assert.True(t, ok)
+	var issues []string
+	for _, issue := range validationErr.Issues {
+		issues = append(issues, issue.String())
+	}
+	assert.Equal(t, []string{
+		"line 5: backups[0].ssh.port: port must be between 1 and 65535, got 0",
+		"line 5: backups[0].ssh: key_file or use_agent is required",
+		"line 4: backups[0].storage[1]: storage missing is not configured",
+		`line 10: backups[0].run_on_start: unknown run_on_start "sometimes", expected always, never or if_missed`,
+		`line 13: backups[0].scheduler.cron_expr: invalid cron expression "0 25 * * *": end of range (25) above maximum (23): 25`,
+		`line 19: storage.ftp.kind: unknown storage kind "ftp", expected one of s3, rsync, google_drive`,
+	}, issues)
+
+	warnings := cfg.Warnings()
+	assert.Len(t, warnings, 1)
+	assert.Equal(t, "line 4: backups[0].storage[0]: storage s3 is disabled, archives will not be uploaded to it", warnings[0].String())
+}
+
+func TestParseConfigInterpolation(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "db_password")
+	assert.NoError(t, os.WriteFile(secretFile, []byte("s3cret\n"), 0600))
+	t.Setenv("BACKUP_BUCKET", "prod-backups")
+	t.Setenv("DB_PASSWORD_FILE", secretFile)
+	t.Setenv("EMPTY", "")
+
+	cfg, err := parseConfig("", []byte(`backups:
+  - name: db
+    type: mysql
+    db:
+      name: app
+      password: file:${DB_PASSWORD_FILE}
+      dump_options: ["--host=${DB_HOST:-127.0.0.1}", "--comment=$${literal}"]
+storage:
+  s3:
+    kind: s3
+    bucket: ${BACKUP_BUCKET}
+    region: ${EMPTY:-us-east-1}
+    endpoint: "${EMPTY}"
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cret", cfg.Backups[0].DB.Password)
+	assert.Equal(t, []string{"--host=127.0.0.1", "--comment=${literal}"}, cfg.Backups[0].DB.DumpOptions)
+	assert.Equal(t, "prod-backups", cfg.Storage["s3"].Bucket)
+	assert.Equal(t, "us-east-1", cfg.Storage["s3"].Region)
+	assert.Equal(t, "", cfg.Storage["s3"].Endpoint)
+
+	_, err = parseConfig("", []byte("storage:\n  s3:\n    kind: s3\n    secret_access_key: ${MISSING_BACKUP_SECRET}\n"))
+	assert.ErrorContains(t, err, "line 4: storage.s3.secret_access_key: environment variable MISSING_BACKUP_SECRET is not set")
+
+	_, err = parseConfig("", []byte("api:\n  token: file:/nonexistent/token\n"))
+	assert.ErrorContains(t, err, "line 2: api.token: failed to read secret file")
+}
+
+func writeConfigFile(t *testing.T, path, content string) {
+	t.Helper()
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0644))
+}
+
+func TestLoadConfigDefaultsTemplatesAndIncludes(t *testing.T) {
+	dir := t.TempDir()
+	mainFile := filepath.Join(dir, "config.yaml")
+	writeConfigFile(t, mainFile, `include: conf.d/*.yaml
+defaults:
+  storage: [s3]
+  remote_retention:
+    enabled: true
+    max_per_day: 3
+  scheduler:
+    enabled: true
+    cron_expr: "0 2 * * *"
+    max_backups: 7
+templates:
+  nightly-db:
+    type: mysql
+    scheduler:
+      cron_expr: "0 3 * * *"
+    ignore:
+      files: ["*.tmp"]
+backups:
+  - name: files
+    source_path: /data/files
+storage:
+  s3:
+    kind: s3
+`)
+	writeConfigFile(t, filepath.Join(dir, "conf.d", "team-a.yaml"), `templates:
+  nightly-db-small:
+    extends: nightly-db
+    scheduler:
+      max_backups: 2
+backups:
+  - name: orders
+    extends: nightly-db-small
+    db:
+      name: orders
+    remote_retention:
+      max_per_day: 1
+`)
+
+	cfg, err := LoadConfig(mainFile)
+	assert.NoError(t, err)
+	assert.Len(t, cfg.Backups, 2)
+	assert.Equal(t, []string{filepath.Join(dir, "conf.d", "team-a.yaml"), mainFile}, cfg.Files())
+
+	files := cfg.Backups[0]
+	assert.Equal(t, "files", files.Name)
+	assert.Equal(t, []string{"s3"}, files.Storage)
+	assert.Equal(t, "0 2 * * *", files.Scheduler.CronExpr)
+	assert.Equal(t, 7, files.Scheduler.MaxBackups)
+
+	orders := cfg.Backups[1]
+	assert.Equal(t, "orders", orders.Name)
+	assert.Equal(t, "mysql", orders.Type)
+	assert.Empty(t, orders.Extends)
+	assert.True(t, orders.Scheduler.Enabled)
+	assert.Equal(t, "0 3 * * *", orders.Scheduler.CronExpr)
+	assert.Equal(t, 2, orders.Scheduler.MaxBackups)
+	assert.Equal(t, []string{"*.tmp"}, orders.Ignore.Files)
+	assert.True(t, orders.RemoteRetention.Enabled)
+	assert.Equal(t, 1, orders.RemoteRetention.MaxPerDay)
+	assert.Equal(t, "orders", orders.DB.Name)
+
+	// Issues in included files point at the included file
+	orders.Scheduler.MaxBackups = -1
+	cfg.Backups[1] = orders
+	validationErr, ok := cfg.Validate().(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, filepath.Join(dir, "conf.d", "team-a.yaml"), validationErr.Issues[0].File)
+	assert.Equal(t, 5, validationErr.Issues[0].Line)
+
+	effective, err := EffectiveConfig(mainFile)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(effective), "templates:")
+	assert.NotContains(t, string(effective), "include:")
+	assert.Contains(t, string(effective), "name: orders")
+}
+
+func TestLoadConfigIncludeAndTemplateErrors(t *testing.T) {
+	dir := t.TempDir()
+	mainFile := filepath.Join(dir, "config.yaml")
+
+	writeConfigFile(t, mainFile, "backups:\n  - name: a\n    extends: missing\n")
+	_, err := LoadConfig(mainFile)
+	assert.ErrorContains(t, err, "line 3: template missing is not defined")
+
+	writeConfigFile(t, mainFile, "templates:\n  a:\n    extends: b\n  b:\n    extends: a\nbackups:\n  - name: x\n    extends: a\n")
+	_, err = LoadConfig(mainFile)
+	assert.ErrorContains(t, err, "template a extends itself (a -> b -> a)")
+
+	writeConfigFile(t, filepath.Join(dir, "other.yaml"), "storage:\n  s3:\n    kind: s3\n    bucket: other\n")
+	writeConfigFile(t, mainFile, "include: other.yaml\nstorage:\n  s3:\n    kind: s3\n")
+	_, err = LoadConfig(mainFile)
+	assert.ErrorContains(t, err, "storage s3 is already defined")
+
+	writeConfigFile(t, filepath.Join(dir, "other.yaml"), "backups:\n  - name: a\n    sorce_path: x\n")
+	writeConfigFile(t, mainFile, "include: [other.yaml]\n")
+	_, err = LoadConfig(mainFile)
+	assert.ErrorContains(t, err, "other.yaml: yaml: unmarshal errors:\n  line 3: field sorce_path not found")
+
+	writeConfigFile(t, mainFile, "include: missing.yaml\n")
+	_, err = LoadConfig(mainFile)
+	assert.ErrorContains(t, err, "missing.yaml does not exist")
+}
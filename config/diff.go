@@ -0,0 +1,89 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// Diff describes the differences between two configurations, one line per change
+func Diff(oldCfg, newCfg *Config) []string {
+	var changes []string
+
+	oldBackups := make(map[string]BackupConfig)
+	for _, backup := range oldCfg.Backups {
+		oldBackups[backup.Name] = backup
+	}
+	newBackups := make(map[string]BackupConfig)
+	for _, backup := range newCfg.Backups {
+		newBackups[backup.Name] = backup
+	}
+
+	for _, backup := range newCfg.Backups {
+		oldBackup, ok := oldBackups[backup.Name]
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("backup %s added", backup.Name))
+		case !reflect.DeepEqual(oldBackup.Scheduler, backup.Scheduler):
+			changes = append(changes, fmt.Sprintf("backup %s schedule changed: %s", backup.Name, describeScheduleChange(oldBackup, backup)))
+			if !backupEqualIgnoringSchedule(oldBackup, backup) {
+				changes = append(changes, fmt.Sprintf("backup %s settings changed", backup.Name))
+			}
+		case !reflect.DeepEqual(oldBackup, backup):
+			changes = append(changes, fmt.Sprintf("backup %s settings changed", backup.Name))
+		}
+	}
+	for _, backup := range oldCfg.Backups {
+		if _, ok := newBackups[backup.Name]; !ok {
+			changes = append(changes, fmt.Sprintf("backup %s removed", backup.Name))
+		}
+	}
+
+	storageNames := make(map[string]bool)
+	for name := range oldCfg.Storage {
+		storageNames[name] = true
+	}
+	for name := range newCfg.Storage {
+		storageNames[name] = true
+	}
+	var sortedStorageNames []string
+	for name := range storageNames {
+		sortedStorageNames = append(sortedStorageNames, name)
+	}
+	sort.Strings(sortedStorageNames)
+	for _, name := range sortedStorageNames {
+		oldStorage, inOld := oldCfg.Storage[name]
+		newStorage, inNew := newCfg.Storage[name]
+		switch {
+		case !inOld:
+			changes = append(changes, fmt.Sprintf("storage %s added", name))
+		case !inNew:
+			changes = append(changes, fmt.Sprintf("storage %s removed", name))
+		case !reflect.DeepEqual(oldStorage, newStorage):
+			changes = append(changes, fmt.Sprintf("storage %s changed", name))
+		}
+	}
+
+	if !reflect.DeepEqual(oldCfg.API, newCfg.API) {
+		changes = append(changes, "api settings changed")
+	}
+	if !reflect.DeepEqual(oldCfg.Secrets, newCfg.Secrets) {
+		changes = append(changes, "secrets settings changed")
+	}
+	return changes
+}
+
+func describeScheduleChange(oldBackup, newBackup BackupConfig) string {
+	describe := func(backup BackupConfig) string {
+		if !backup.Scheduler.Enabled {
+			return "disabled"
+		}
+		return fmt.Sprintf("%q (max_backups %d)", backup.Scheduler.CronExpr, backup.Scheduler.MaxBackups)
+	}
+	return describe(oldBackup) + " -> " + describe(newBackup)
+}
+
+func backupEqualIgnoringSchedule(a, b BackupConfig) bool {
+	a.Scheduler = b.Scheduler
+	return reflect.DeepEqual(a, b)
+}
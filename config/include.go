@@ -0,0 +1,340 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configFile is the layout of a configuration file: a Config plus the keys
+// that are resolved while loading and do not appear in the effective config
+type configFile struct {
+	Config    `yaml:",inline"`
+	Include   stringList              `yaml:"include"`   // Glob patterns of files merged into this one, e.g. conf.d/*.yaml
+	Defaults  BackupConfig            `yaml:"defaults"`  // Settings applied to every backup
+	Templates map[string]BackupConfig `yaml:"templates"` // Named settings a backup can extend
+}
+
+// stringList accepts a single string or a list of strings
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*l = stringList{node.Value}
+		return nil
+	}
+	var values []string
+	if err := node.Decode(&values); err != nil {
+		return err
+	}
+	*l = values
+	return nil
+}
+
+// configLoader reads a configuration file with its includes and resolves
+// defaults and templates into a single YAML document
+type configLoader struct {
+	mainFile string
+	files    map[*yaml.Node]string // File each node was read from
+	loaded   map[string]bool       // Files already loaded, by absolute path
+}
+
+func newConfigLoader(mainFile string) *configLoader {
+	return &configLoader{
+		mainFile: mainFile,
+		files:    make(map[*yaml.Node]string),
+		loaded:   make(map[string]bool),
+	}
+}
+
+// load parses a configuration file and merges its includes into it
+func (l *configLoader) load(path string, data []byte) (*yaml.Node, error) {
+	if absPath, err := filepath.Abs(path); err == nil {
+		l.loaded[absPath] = true
+	}
+
+	// Decode strictly into the typed layout first so unknown keys are reported
+	// with the line of the file they appear in
+	var file configFile
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil && err != io.EOF {
+		return nil, l.errorf(path, "%v", err)
+	}
+
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, l.errorf(path, "%v", err)
+	}
+	root := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	if len(document.Content) > 0 {
+		root = document.Content[0]
+	}
+	if root.Kind != yaml.MappingNode {
+		return nil, l.errorf(path, "the document must be a mapping")
+	}
+	l.recordFile(root, path)
+
+	if _, include := mappingValue(root, "include"); include != nil {
+		removeKey(root, "include")
+		for _, pattern := range file.Include {
+			if err := l.include(root, path, pattern); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return root, nil
+}
+
+// include loads the files matching pattern, relative to the including file,
+// and merges them into root
+func (l *configLoader) include(root *yaml.Node, path, pattern string) error {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(path), pattern)
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return l.errorf(path, "invalid include pattern %q: %v", pattern, err)
+	}
+	if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+		return l.errorf(path, "included file %s does not exist", pattern)
+	}
+	sort.Strings(matches)
+
+	for _, match := range matches {
+		if absPath, err := filepath.Abs(match); err == nil && l.loaded[absPath] {
+			continue
+		}
+		data, err := os.ReadFile(match)
+		if err != nil {
+			return l.errorf(path, "failed to read included file: %v", err)
+		}
+		included, err := l.load(match, data)
+		if err != nil {
+			return err
+		}
+		if err := l.mergeIncluded(root, included, match); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeIncluded merges an included file into root: backups are appended,
+// storages and templates must not be defined twice and other settings are
+// deep-merged with the values already in root taking precedence
+func (l *configLoader) mergeIncluded(root, included *yaml.Node, path string) error {
+	for i := 0; i+1 < len(included.Content); i += 2 {
+		key, value := included.Content[i], resolveAlias(included.Content[i+1])
+		existingKey, existing := mappingValue(root, key.Value)
+		if existing == nil {
+			root.Content = append(root.Content, key, value)
+			continue
+		}
+
+		switch key.Value {
+		case "backups":
+			if existing.Kind != yaml.SequenceNode || value.Kind != yaml.SequenceNode {
+				return l.errorf(path, "backups must be a list")
+			}
+			existing.Content = append(existing.Content, value.Content...)
+		case "storage", "templates":
+			for j := 0; j+1 < len(value.Content); j += 2 {
+				name := value.Content[j]
+				if otherKey, _ := mappingValue(existing, name.Value); otherKey != nil {
+					return l.errorf(path, "line %d: %s %s is already defined at %s",
+						name.Line, key.Value, name.Value, l.describe(otherKey))
+				}
+				existing.Content = append(existing.Content, name, value.Content[j+1])
+			}
+		default:
+			setValue(root, existingKey, mergeNodes(value, existing))
+		}
+	}
+	return nil
+}
+
+// resolve applies defaults and templates to every backup and removes them from the document
+func (l *configLoader) resolve(root *yaml.Node) error {
+	_, defaults := mappingValue(root, "defaults")
+	_, templates := mappingValue(root, "templates")
+	removeKey(root, "defaults")
+	removeKey(root, "templates")
+
+	if defaults != nil {
+		if _, extends := mappingValue(defaults, "extends"); extends != nil {
+			return l.errorf(l.fileOf(extends), "line %d: defaults cannot use extends", extends.Line)
+		}
+	}
+
+	_, backups := mappingValue(root, "backups")
+	if backups == nil || backups.Kind != yaml.SequenceNode {
+		return nil
+	}
+	for i, backup := range backups.Content {
+		backup = resolveAlias(backup)
+		base := defaults
+		if _, extends := mappingValue(backup, "extends"); extends != nil {
+			template, err := l.template(templates, extends, nil)
+			if err != nil {
+				return err
+			}
+			base = mergeNodes(base, template)
+		}
+
+		resolved := mergeNodes(base, withoutKey(backup, "extends"))
+		l.files[resolved] = l.fileOf(backup)
+		backups.Content[i] = resolved
+	}
+	return nil
+}
+
+// template returns a template merged with the templates it extends
+func (l *configLoader) template(templates, ref *yaml.Node, chain []string) (*yaml.Node, error) {
+	name := ref.Value
+	for _, parent := range chain {
+		if parent == name {
+			return nil, l.errorf(l.fileOf(ref), "line %d: template %s extends itself (%s -> %s)",
+				ref.Line, name, strings.Join(chain, " -> "), name)
+		}
+	}
+
+	var template *yaml.Node
+	if templates != nil {
+		_, template = mappingValue(templates, name)
+	}
+	if template == nil {
+		return nil, l.errorf(l.fileOf(ref), "line %d: template %s is not defined", ref.Line, name)
+	}
+
+	_, parentRef := mappingValue(template, "extends")
+	if parentRef == nil {
+		return template, nil
+	}
+	parent, err := l.template(templates, parentRef, append(chain, name))
+	if err != nil {
+		return nil, err
+	}
+	return mergeNodes(parent, withoutKey(template, "extends")), nil
+}
+
+// recordFile remembers the file of every node of a parsed document
+func (l *configLoader) recordFile(node *yaml.Node, path string) {
+	l.files[node] = path
+	for _, child := range node.Content {
+		l.recordFile(child, path)
+	}
+}
+
+// fileOf returns the file a node was read from, empty for the main file
+func (l *configLoader) fileOf(node *yaml.Node) string {
+	if file := l.files[node]; file != l.mainFile {
+		return file
+	}
+	return ""
+}
+
+// describe returns the position of a node for error messages
+func (l *configLoader) describe(node *yaml.Node) string {
+	if file := l.fileOf(node); file != "" {
+		return fmt.Sprintf("%s line %d", file, node.Line)
+	}
+	return fmt.Sprintf("line %d", node.Line)
+}
+
+func (l *configLoader) errorf(path, format string, args ...interface{}) error {
+	if path == "" || path == l.mainFile {
+		return fmt.Errorf("failed to parse config file: "+format, args...)
+	}
+	return fmt.Errorf("failed to parse %s: "+format, append([]interface{}{path}, args...)...)
+}
+
+// mergeNodes deep-merges override into base without modifying either: mappings
+// are merged key by key, any other value in override replaces the one in base
+func mergeNodes(base, override *yaml.Node) *yaml.Node {
+	base, override = resolveAlias(base), resolveAlias(override)
+	if base == nil {
+		return override
+	}
+	if override == nil {
+		return base
+	}
+	if base.Kind != yaml.MappingNode || override.Kind != yaml.MappingNode {
+		return override
+	}
+
+	// Keep the keys of override first, so the backup's own settings are listed
+	// before inherited ones and positions point at the values in use
+	merged := *override
+	merged.Content = nil
+	for i := 0; i+1 < len(override.Content); i += 2 {
+		key, value := override.Content[i], override.Content[i+1]
+		if _, existing := mappingValue(base, key.Value); existing != nil {
+			value = mergeNodes(existing, value)
+		}
+		merged.Content = append(merged.Content, key, value)
+	}
+	for i := 0; i+1 < len(base.Content); i += 2 {
+		if key, _ := mappingValue(override, base.Content[i].Value); key == nil {
+			merged.Content = append(merged.Content, base.Content[i], base.Content[i+1])
+		}
+	}
+	return &merged
+}
+
+// mappingValue returns the key and value nodes of a key in a mapping
+func mappingValue(mapping *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	mapping = resolveAlias(mapping)
+	if mapping == nil || mapping.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i], resolveAlias(mapping.Content[i+1])
+		}
+	}
+	return nil, nil
+}
+
+// setValue replaces the value of an existing key in a mapping
+func setValue(mapping, key, value *yaml.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i] == key {
+			mapping.Content[i+1] = value
+			return
+		}
+	}
+}
+
+func removeKey(mapping *yaml.Node, key string) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content = append(mapping.Content[:i:i], mapping.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+// withoutKey returns a copy of a mapping without a key
+func withoutKey(mapping *yaml.Node, key string) *yaml.Node {
+	if _, value := mappingValue(mapping, key); value == nil {
+		return mapping
+	}
+	copied := *resolveAlias(mapping)
+	copied.Content = append([]*yaml.Node(nil), copied.Content...)
+	removeKey(&copied, key)
+	return &copied
+}
+
+func resolveAlias(node *yaml.Node) *yaml.Node {
+	for node != nil && node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	return node
+}
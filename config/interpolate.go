@@ -0,0 +1,144 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// filePrefix marks a value read from a file, e.g. file:/run/secrets/db_password
+const filePrefix = "file:"
+
+// interpolate resolves ${VAR}, ${VAR:-default} and file: references in every
+// string field of the configuration
+func (c *Config) interpolate() error {
+	var issues []Issue
+	interpolateValue(reflect.ValueOf(c).Elem(), "", func(path, value string) string {
+		resolved, err := expandValue(value)
+		if err != nil {
+			issues = append(issues, c.issue(path, err.Error()))
+			return value
+		}
+		return resolved
+	})
+	if len(issues) > 0 {
+		return &ValidationError{Issues: issues}
+	}
+	return nil
+}
+
+// interpolateValue walks v and replaces every string with the result of resolve,
+// building field paths from the yaml tags
+func interpolateValue(v reflect.Value, path string, resolve func(path, value string) string) {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(resolve(path, v.String()))
+	case reflect.Ptr:
+		if !v.IsNil() {
+			interpolateValue(v.Elem(), path, resolve)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+			if field.PkgPath != "" || name == "" || name == "-" {
+				continue
+			}
+			interpolateValue(v.Field(i), joinPath(path, name), resolve)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			interpolateValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i), resolve)
+		}
+	case reflect.Map:
+		// Map values are not addressable, so resolve a copy and store it back
+		for _, key := range v.MapKeys() {
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(v.MapIndex(key))
+			interpolateValue(value, joinPath(path, fmt.Sprint(key.Interface())), resolve)
+			v.SetMapIndex(key, value)
+		}
+	}
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// expandValue replaces environment variable references in s, then reads the
+// value from a file if it starts with file:. $${ escapes a literal ${.
+func expandValue(s string) (string, error) {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			break
+		}
+		if i > 0 && s[i-1] == '$' {
+			b.WriteString(s[:i-1])
+			b.WriteString("${")
+			s = s[i+2:]
+			continue
+		}
+		end := strings.Index(s[i:], "}")
+		if end < 0 {
+			return "", fmt.Errorf("unterminated variable reference in %q", s[i:])
+		}
+		value, err := lookupVariable(s[i+2 : i+end])
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(s[:i])
+		b.WriteString(value)
+		s = s[i+end+1:]
+	}
+
+	expanded := b.String()
+	if !strings.HasPrefix(expanded, filePrefix) {
+		return expanded, nil
+	}
+	path := strings.TrimPrefix(expanded, filePrefix)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %v", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// lookupVariable resolves the inside of a ${...} reference: NAME or NAME:-default.
+// The default is used when the variable is unset or empty.
+func lookupVariable(ref string) (string, error) {
+	name, defaultValue, hasDefault := strings.Cut(ref, ":-")
+	if !validVariableName(name) {
+		return "", fmt.Errorf("invalid variable name %q", name)
+	}
+	if value := os.Getenv(name); value != "" {
+		return value, nil
+	}
+	if hasDefault {
+		return defaultValue, nil
+	}
+	if _, ok := os.LookupEnv(name); ok {
+		return "", nil
+	}
+	return "", fmt.Errorf("environment variable %s is not set", name)
+}
+
+func validVariableName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		if r == '_' || (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z') || (i > 0 && r >= '0' && r <= '9') {
+			continue
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,514 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// Supported backup types and storage kinds
+var (
+	backupTypes  = []string{"", "folder", "mysql", "mysql_binlog", "mysql_physical", "postgres", "postgres_basebackup", "postgres_wal", "sqlite", "mongodb", "redis"}
+	storageKinds = []string{"s3", "rsync", "google_drive"}
+	sshModes     = []string{"", SSHModeTunnel, SSHModeExec}
+	sslModes     = []string{"", "disable", "prefer", "require", "verify-ca", "verify-full"}
+	dumpFormats  = []string{"", DumpFormatPlain, DumpFormatCustom, DumpFormatDirectory}
+)
+
+// Issue is a configuration problem found by validation
+type Issue struct {
+	File    string // Included file the field comes from, empty for the main config file
+	Line    int    // Line in the config file, 0 if unknown
+	Path    string // Field path, e.g. backups[0].scheduler.cron_expr
+	Message string
+}
+
+func (i Issue) String() string {
+	switch {
+	case i.File != "" && i.Line > 0:
+		return fmt.Sprintf("%s line %d: %s: %s", i.File, i.Line, i.Path, i.Message)
+	case i.Line > 0:
+		return fmt.Sprintf("line %d: %s: %s", i.Line, i.Path, i.Message)
+	}
+	return fmt.Sprintf("%s: %s", i.Path, i.Message)
+}
+
+// position locates a field in the configuration files
+type position struct {
+	file string
+	line int
+}
+
+// ValidationError holds every error found in a configuration
+type ValidationError struct {
+	Issues []Issue
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Issues))
+	for i, issue := range e.Issues {
+		messages[i] = issue.String()
+	}
+	return "invalid configuration:\n  " + strings.Join(messages, "\n  ")
+}
+
+// ParseSchedule parses a cron expression the same way the scheduler does,
+// accepting an optional seconds field
+func ParseSchedule(expr string) (cron.Schedule, error) {
+	if len(strings.Fields(expr)) == 6 {
+		return cron.NewParser(cron.Second | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor).Parse(expr)
+	}
+	return cron.ParseStandard(expr)
+}
+
+// validator collects issues with the line of the field they refer to
+type validator struct {
+	cfg      *Config
+	errors   []Issue
+	warnings []Issue
+}
+
+func (v *validator) errorf(path, format string, args ...interface{}) {
+	v.errors = append(v.errors, v.cfg.issue(path, fmt.Sprintf(format, args...)))
+}
+
+func (v *validator) warnf(path, format string, args ...interface{}) {
+	v.warnings = append(v.warnings, v.cfg.issue(path, fmt.Sprintf(format, args...)))
+}
+
+// Validate checks every field of the configuration for errors that would break
+// backups at runtime and returns a *ValidationError listing all of them
+func (c *Config) Validate() error {
+	v := c.validate()
+	if len(v.errors) > 0 {
+		return &ValidationError{Issues: v.errors}
+	}
+	return nil
+}
+
+// Warnings returns problems that do not prevent backups from running but are
+// likely mistakes, such as a backup using a disabled storage
+func (c *Config) Warnings() []Issue {
+	return c.validate().warnings
+}
+
+func (c *Config) validate() *validator {
+	v := &validator{cfg: c}
+
+	names := make(map[string]bool)
+	for i, backup := range c.Backups {
+		path := fmt.Sprintf("backups[%d]", i)
+		if backup.Name == "" {
+			v.errorf(path+".name", "name is required")
+		} else if names[backup.Name] {
+			v.errorf(path+".name", "duplicate backup name %s", backup.Name)
+		}
+		names[backup.Name] = true
+		v.validateBackup(path, backup)
+	}
+
+	storageNames := make([]string, 0, len(c.Storage))
+	for name := range c.Storage {
+		storageNames = append(storageNames, name)
+	}
+	sort.Strings(storageNames)
+	for _, name := range storageNames {
+		v.validateStorage("storage."+name, c.Storage[name])
+	}
+
+	if c.Secrets.Vault.KVVersion < 0 || c.Secrets.Vault.KVVersion > 2 {
+		v.errorf("secrets.vault.kv_version", "kv_version must be 1 or 2, got %d", c.Secrets.Vault.KVVersion)
+	}
+
+	if c.API.Enabled && c.API.Token == "" {
+		v.errorf("api.token", "token is required when the API is enabled")
+	}
+	return v
+}
+
+func (v *validator) validateBackup(path string, backup BackupConfig) {
+	if !contains(backupTypes, backup.Type) {
+		v.errorf(path+".type", "unknown backup type %q, expected one of %s", backup.Type, strings.Join(backupTypes[1:], ", "))
+	}
+
+	switch backup.Type {
+	case "", "folder":
+		if backup.SourcePath == "" {
+			v.errorf(path+".source_path", "source_path is required for folder backups")
+		}
+	case "mysql", "mysql_binlog", "mysql_physical", "postgres", "postgres_basebackup", "sqlite", "mongodb", "redis":
+		if backup.DB == nil {
+			v.errorf(path+".db", "db is required for %s backups", backup.Type)
+		} else {
+			v.validateDB(path+".db", backup)
+		}
+	case "postgres_wal":
+		if backup.Scheduler.Enabled {
+			v.errorf(path+".scheduler.enabled", "postgres_wal backups run from archive_command with -wal-push, not on a schedule")
+		}
+	}
+
+	if backup.SSH != nil {
+		if !contains(sshModes, backup.SSH.Mode) {
+			v.errorf(path+".ssh.mode", "unknown ssh mode %q, expected one of %s", backup.SSH.Mode, strings.Join(sshModes[1:], ", "))
+		}
+		v.validateSSH(path+".ssh", backup.SSH)
+	}
+
+	for i, storageName := range backup.Storage {
+		storagePath := fmt.Sprintf("%s.storage[%d]", path, i)
+		storageCfg, ok := v.cfg.Storage[storageName]
+		if !ok {
+			v.errorf(storagePath, "storage %s is not configured", storageName)
+		} else if !storageCfg.Enabled {
+			v.warnf(storagePath, "storage %s is disabled, archives will not be uploaded to it", storageName)
+		}
+	}
+
+	if backup.RemoteRetention.Enabled && (backup.Type == "mysql_binlog" || backup.Type == "postgres_wal") {
+		v.warnf(path+".remote_retention", "remote retention thins out older archives, leaving gaps in the %s archives that break point-in-time recovery", backup.Type)
+	}
+	if backup.RemoteRetention.Enabled && backup.Type == "mysql_physical" && backup.DB != nil && backup.DB.IncrementalRuns > 0 {
+		v.warnf(path+".remote_retention", "remote retention thins out older archives, leaving incremental backups without the archives they build on")
+	}
+	if backup.Type == "mysql_physical" && backup.DB != nil && backup.DB.IncrementalRuns > 0 && backup.Scheduler.MaxBackups > 0 && backup.Scheduler.MaxBackups <= backup.DB.IncrementalRuns {
+		v.warnf(path+".scheduler.max_backups", "max_backups %d does not cover a full backup and its %d incremental runs, older archives are kept until the full backup the kept ones build on", backup.Scheduler.MaxBackups, backup.DB.IncrementalRuns)
+	}
+
+	switch backup.RunOnStart {
+	case "", RunOnStartAlways, RunOnStartNever, RunOnStartIfMissed:
+	default:
+		v.errorf(path+".run_on_start", "unknown run_on_start %q, expected always, never or if_missed", backup.RunOnStart)
+	}
+
+	if backup.Scheduler.Enabled {
+		if backup.Scheduler.CronExpr == "" {
+			v.errorf(path+".scheduler.cron_expr", "cron_expr is required when the scheduler is enabled")
+		} else if _, err := ParseSchedule(backup.Scheduler.CronExpr); err != nil {
+			v.errorf(path+".scheduler.cron_expr", "invalid cron expression %q: %v", backup.Scheduler.CronExpr, err)
+		}
+	}
+	if backup.Scheduler.MaxBackups < 0 {
+		v.errorf(path+".scheduler.max_backups", "max_backups must not be negative")
+	}
+
+	retention := backup.RemoteRetention
+	for _, field := range []struct {
+		name  string
+		value int
+	}{
+		{"max_per_day", retention.MaxPerDay},
+		{"period_days", retention.PeriodDays},
+		{"max_per_period", retention.MaxPerPeriod},
+		{"max_per_month", retention.MaxPerMonth},
+		{"max_per_year", retention.MaxPerYear},
+	} {
+		if field.value < 0 {
+			v.errorf(path+".remote_retention."+field.name, "%s must not be negative", field.name)
+		}
+	}
+}
+
+func (v *validator) validateDB(path string, backup BackupConfig) {
+	db := backup.DB
+	if db.Name == "" && len(db.Databases) == 0 && (backup.Type == "mysql" || backup.Type == "postgres" || backup.Type == "sqlite" || backup.Type == "mongodb") {
+		v.errorf(path, "db.name or db.databases is required")
+	}
+	if db.Port < 0 || db.Port > 65535 {
+		v.errorf(path+".port", "port must be between 1 and 65535, got %d", db.Port)
+	}
+	if db.Socket != "" {
+		if db.Host != "" || db.Port != 0 {
+			v.errorf(path+".socket", "socket cannot be combined with host or port")
+		}
+		if backup.SSH != nil && sshMode(backup) == SSHModeTunnel {
+			v.errorf(path+".socket", "socket cannot be used through an SSH tunnel, set ssh.mode to exec")
+		}
+	}
+	if !contains(sslModes, db.SSLMode) {
+		v.errorf(path+".ssl_mode", "unknown ssl_mode %q, expected one of %s", db.SSLMode, strings.Join(sslModes[1:], ", "))
+	}
+	if db.SSLMode == "verify-full" && backup.SSH != nil && sshMode(backup) == SSHModeTunnel {
+		v.warnf(path+".ssl_mode", "verify-full checks the server name against the local tunnel address, use ssh.mode exec or verify-ca")
+	}
+	if (db.SSLCert == "") != (db.SSLKey == "") {
+		v.errorf(path+".ssl_cert", "ssl_cert and ssl_key must be set together")
+	}
+	if db.Format != "" && backup.Type != "postgres" {
+		v.errorf(path+".format", "format is only supported for postgres backups")
+	} else if !contains(dumpFormats, db.Format) {
+		v.errorf(path+".format", "unknown format %q, expected one of %s", db.Format, strings.Join(dumpFormats[1:], ", "))
+	}
+	if db.Jobs < 0 {
+		v.errorf(path+".jobs", "jobs must not be negative")
+	}
+	if db.Parallelism < 0 {
+		v.errorf(path+".parallelism", "parallelism must not be negative")
+	}
+	for _, list := range []struct {
+		name     string
+		patterns []string
+	}{
+		{"include_tables", db.IncludeTables},
+		{"exclude_tables", db.ExcludeTables},
+		{"data_only_tables", db.DataOnlyTables},
+	} {
+		for i, pattern := range list.patterns {
+			if err := validateTablePattern(pattern); err != nil {
+				v.errorf(fmt.Sprintf("%s.%s[%d]", path, list.name, i), "%v", err)
+			}
+		}
+	}
+	if backup.SSH != nil && sshMode(backup) == SSHModeTunnel {
+		switch backup.Type {
+		case "mysql_physical":
+			v.errorf(path, "mysql_physical backups run xtrabackup on the database host, set ssh.mode to exec")
+		case "sqlite":
+			v.errorf(path, "sqlite backups copy the database files on the SSH host, set ssh.mode to exec")
+		}
+	}
+	switch backup.Type {
+	case "sqlite":
+		v.validateSQLiteFiles(path, db)
+	case "mongodb":
+		v.validateMongoDB(path, backup)
+	}
+	switch db.RedisMethod {
+	case "", RedisMethodRDB:
+	case RedisMethodBGSave:
+		if backup.SSH != nil && sshMode(backup) == SSHModeTunnel {
+			v.errorf(path+".redis_method", "bgsave copies the files of the server, which an SSH tunnel cannot reach, use redis_method rdb or ssh.mode exec")
+		}
+	default:
+		v.errorf(path+".redis_method", "unknown redis_method %q, expected bgsave or rdb", db.RedisMethod)
+	}
+	if db.IncrementalRuns < 0 {
+		v.errorf(path+".incremental_runs", "incremental_runs must not be negative")
+	} else if db.IncrementalRuns > 0 && backup.Type != "mysql_physical" {
+		v.errorf(path+".incremental_runs", "incremental_runs is only supported for mysql_physical backups")
+	}
+	switch db.OnPartialFailure {
+	case "", PartialFailureWarn, PartialFailureFail:
+	default:
+		v.errorf(path+".on_partial_failure", "unknown on_partial_failure %q, expected warn or fail", db.OnPartialFailure)
+	}
+}
+
+// validateSQLiteFiles checks the database files of a sqlite backup, copied
+// under their file name next to manifest.json
+func (v *validator) validateSQLiteFiles(path string, db *DBConfig) {
+	if db.Name == "__ALL__" {
+		v.errorf(path+".name", "__ALL__ is not supported for sqlite backups, list the database files in db.databases")
+	}
+	files := db.Databases
+	if len(files) == 0 && db.Name != "" {
+		files = []string{db.Name}
+	}
+	seen := make(map[string]string)
+	for _, file := range files {
+		base := filepath.Base(file)
+		if base == "manifest.json" {
+			v.errorf(path, "database file %s cannot be named manifest.json", file)
+		} else if other, ok := seen[base]; ok {
+			v.errorf(path, "database files %s and %s have the same file name", other, file)
+		}
+		seen[base] = file
+	}
+}
+
+// validateMongoDB checks the options mongodump cannot honour
+func (v *validator) validateMongoDB(path string, backup BackupConfig) {
+	db := backup.DB
+	if db.URI != "" {
+		if db.Host != "" || db.Port != 0 || db.Socket != "" {
+			v.errorf(path+".uri", "uri cannot be combined with host, port or socket")
+		}
+		if backup.SSH != nil && sshMode(backup) == SSHModeTunnel {
+			v.errorf(path+".uri", "uri cannot be used through an SSH tunnel, set ssh.mode to exec")
+		}
+	}
+	if db.SSLCert != db.SSLKey {
+		v.errorf(path+".ssl_cert", "ssl_cert and ssl_key must be the same file, holding the certificate and the key, for mongodb backups")
+	}
+	if db.SchemaOnly || len(db.DataOnlyTables) > 0 {
+		v.errorf(path, "schema_only and data_only_tables are not supported for mongodb backups")
+	}
+	if db.Name == "__ALL__" {
+		if len(db.IncludeTables) > 0 {
+			v.errorf(path+".include_tables", "include_tables is not supported when dumping the whole instance with db.name __ALL__, list the databases in db.databases")
+		}
+	} else if db.Oplog {
+		v.errorf(path+".oplog", "oplog requires db.name __ALL__, mongodump only records the oplog of whole instance dumps")
+	}
+	for i, pattern := range db.IncludeTables {
+		if strings.ContainsAny(pattern, "*?[") {
+			v.errorf(fmt.Sprintf("%s.include_tables[%d]", path, i), "included collections of mongodb backups must be names, got %q", pattern)
+		}
+	}
+	for i, pattern := range db.ExcludeTables {
+		if strings.ContainsAny(strings.TrimSuffix(pattern, "*"), "*?[") {
+			v.errorf(fmt.Sprintf("%s.exclude_tables[%d]", path, i), "excluded collections of mongodb backups must be names or prefixes ending with *, got %q", pattern)
+		}
+	}
+}
+
+// validateTablePattern checks a table filter, [<database>:]<glob>
+func validateTablePattern(pattern string) error {
+	dbName, table, qualified := strings.Cut(pattern, ":")
+	if !qualified {
+		table = pattern
+	} else if dbName == "" {
+		return fmt.Errorf("database name missing in table pattern %q", pattern)
+	}
+	if table == "" {
+		return fmt.Errorf("empty table pattern %q", pattern)
+	}
+	if _, err := path.Match(table, ""); err != nil {
+		return fmt.Errorf("invalid table pattern %q: %v", pattern, err)
+	}
+	return nil
+}
+
+// sshMode returns the SSH mode of a database backup, the default of its type if unset
+func sshMode(backup BackupConfig) string {
+	if backup.SSH.Mode != "" {
+		return backup.SSH.Mode
+	}
+	switch backup.Type {
+	case "postgres", "postgres_basebackup", "mysql_physical", "sqlite", "mongodb":
+		return SSHModeExec
+	}
+	return SSHModeTunnel
+}
+
+func (v *validator) validateSSH(path string, ssh *SSHConfig) {
+	if ssh.Host == "" {
+		v.errorf(path+".host", "host is required")
+	}
+	if ssh.User == "" {
+		v.errorf(path+".user", "user is required")
+	}
+	if ssh.Port <= 0 || ssh.Port > 65535 {
+		v.errorf(path+".port", "port must be between 1 and 65535, got %d", ssh.Port)
+	}
+	if ssh.KeyFile == "" && !ssh.UseAgent {
+		v.errorf(path, "key_file or use_agent is required")
+	}
+	if ssh.KeyPassphrase != "" && ssh.KeyFile == "" {
+		v.errorf(path+".key_passphrase", "key_passphrase requires key_file")
+	}
+	if ssh.KeepaliveInterval < -1 {
+		v.errorf(path+".keepalive_interval", "keepalive_interval must be -1 (disabled) or more, got %d", ssh.KeepaliveInterval)
+	}
+	if ssh.ConnectTimeout < 0 {
+		v.errorf(path+".connect_timeout", "connect_timeout must not be negative")
+	}
+	if ssh.Jump != nil {
+		v.validateSSH(path+".jump", ssh.Jump)
+	}
+}
+
+func (v *validator) validateStorage(path string, storage StorageConfig) {
+	if !contains(storageKinds, storage.Kind) {
+		v.errorf(path+".kind", "unknown storage kind %q, expected one of %s", storage.Kind, strings.Join(storageKinds, ", "))
+		return
+	}
+	if !storage.Enabled {
+		return
+	}
+
+	required := func(field, value string) {
+		if value == "" {
+			v.errorf(path+"."+field, "%s is required for %s storage", field, storage.Kind)
+		}
+	}
+
+	switch storage.Kind {
+	case "s3":
+		required("bucket", storage.Bucket)
+		required("region", storage.Region)
+		required("access_key_id", storage.AccessKeyID)
+		required("secret_access_key", storage.SecretAccessKey)
+		if storage.Endpoint != "" {
+			if u, err := url.Parse(storage.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+				v.errorf(path+".endpoint", "endpoint must be an absolute URL, got %q", storage.Endpoint)
+			}
+		}
+	case "google_drive":
+		required("folder_id", storage.FolderID)
+		switch storage.AuthMode {
+		case "", "service_account":
+			required("credentials_file", storage.CredentialsFile)
+		case "oauth_user":
+			required("client_secret_file", storage.ClientSecretFile)
+			required("token_file", storage.TokenFile)
+		default:
+			v.errorf(path+".auth_mode", "unknown auth_mode %q, expected service_account or oauth_user", storage.AuthMode)
+		}
+	case "rsync":
+		required("server", storage.Server)
+		required("username", storage.Username)
+		required("path", storage.Path)
+		if storage.Port < 0 || storage.Port > 65535 {
+			v.errorf(path+".port", "port must be between 1 and 65535, got %d", storage.Port)
+		}
+	}
+}
+
+// issue creates an issue located at a field path, falling back to the closest
+// parent for fields missing from the file
+func (c *Config) issue(path, message string) Issue {
+	issue := Issue{Path: path, Message: message}
+	for field := path; field != ""; {
+		if pos, ok := c.lines[field]; ok {
+			issue.File, issue.Line = pos.file, pos.line
+			break
+		}
+		i := strings.LastIndexAny(field, ".[")
+		if i < 0 {
+			break
+		}
+		field = field[:i]
+	}
+	return issue
+}
+
+// recordLines walks a YAML document and records the position of every mapping key and sequence item
+func (l *configLoader) recordLines(node *yaml.Node, path string, lines map[string]position) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			l.recordLines(child, path, lines)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			childPath := joinPath(path, key.Value)
+			lines[childPath] = position{file: l.fileOf(key), line: key.Line}
+			l.recordLines(value, childPath, lines)
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			childPath := fmt.Sprintf("%s[%d]", path, i)
+			lines[childPath] = position{file: l.fileOf(item), line: item.Line}
+			l.recordLines(item, childPath, lines)
+		}
+	case yaml.AliasNode:
+		l.recordLines(node.Alias, path, lines)
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,279 @@
+package history
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// DefaultPath is the location of the run history database inside the backups directory
+const DefaultPath = "backups/history.db"
+
+const (
+	StatusSuccess = "success"
+	StatusFailed  = "failed"
+	StatusPartial = "partial" // Archived, but some databases failed to dump
+)
+
+// Stages a backup run goes through, recorded as the failing stage of a run
+const (
+	StageBackup    = "backup"
+	StageChecksum  = "checksum"
+	StageUpload    = "upload"
+	StageRetention = "retention"
+)
+
+var (
+	runsBucket = []byte("runs")
+	pinsBucket = []byte("pins")
+)
+
+// UploadResult holds the outcome of sending an archive to one storage provider
+type UploadResult struct {
+	Storage string `json:"storage"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// RetentionResult holds the remote archives deleted by retention on one storage provider
+type RetentionResult struct {
+	Storage string   `json:"storage"`
+	Deleted []string `json:"deleted,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// DatabaseResult holds the outcome of dumping one database of a database backup
+type DatabaseResult struct {
+	Database   string `json:"database"`
+	Success    bool   `json:"success"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+	Size       int64  `json:"size"` // Size of the dump in bytes
+}
+
+// Run represents a single recorded backup run
+type Run struct {
+	ID         uint64            `json:"id"`
+	Backup     string            `json:"backup"`
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt time.Time         `json:"finished_at"`
+	Status     string            `json:"status"`
+	Stage      string            `json:"stage,omitempty"` // Stage that failed, empty on success
+	Error      string            `json:"error,omitempty"`
+	Archive    string            `json:"archive,omitempty"`
+	Checksum   string            `json:"checksum,omitempty"` // SHA-256 of the archive
+	Size       int64             `json:"size"`
+	Databases  []DatabaseResult  `json:"databases,omitempty"`
+	Uploads    []UploadResult    `json:"uploads,omitempty"`
+	Retention  []RetentionResult `json:"retention,omitempty"`
+}
+
+// Duration returns how long the run took
+func (r Run) Duration() time.Duration {
+	if r.FinishedAt.IsZero() {
+		return 0
+	}
+	return r.FinishedAt.Sub(r.StartedAt)
+}
+
+// Store persists backup runs in an embedded bbolt database.
+// The database file is opened for each operation so that other processes
+// (e.g. the -history command) can read it while the daemon is running.
+type Store struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewStore creates a run history store backed by the database at path
+func NewStore(path string) *Store {
+	return &Store{path: path}
+}
+
+// Path returns the location of the history database
+func (s *Store) Path() string {
+	return s.path
+}
+
+func (s *Store) withDB(readOnly bool, fn func(db *bolt.DB) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if readOnly {
+		if _, err := os.Stat(s.path); os.IsNotExist(err) {
+			return nil
+		}
+	} else if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("failed to create history directory: %v", err)
+	}
+
+	db, err := bolt.Open(s.path, 0644, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: readOnly})
+	if err != nil {
+		return fmt.Errorf("failed to open history database %s: %v", s.path, err)
+	}
+	defer db.Close()
+
+	return fn(db)
+}
+
+// Record stores a run and assigns it an ID
+func (s *Store) Record(run *Run) error {
+	return s.withDB(false, func(db *bolt.DB) error {
+		return db.Update(func(tx *bolt.Tx) error {
+			runs, err := tx.CreateBucketIfNotExists(runsBucket)
+			if err != nil {
+				return err
+			}
+			bucket, err := runs.CreateBucketIfNotExists([]byte(run.Backup))
+			if err != nil {
+				return err
+			}
+
+			id, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			run.ID = id
+
+			data, err := json.Marshal(run)
+			if err != nil {
+				return fmt.Errorf("failed to encode run: %v", err)
+			}
+			return bucket.Put(runKey(id), data)
+		})
+	})
+}
+
+// List returns the most recent runs of a backup, newest first.
+// A limit of zero or less returns every recorded run.
+func (s *Store) List(backupName string, limit int) ([]Run, error) {
+	var result []Run
+	err := s.withDB(true, func(db *bolt.DB) error {
+		return db.View(func(tx *bolt.Tx) error {
+			bucket := backupBucket(tx, backupName)
+			if bucket == nil {
+				return nil
+			}
+
+			cursor := bucket.Cursor()
+			for key, value := cursor.Last(); key != nil; key, value = cursor.Prev() {
+				var run Run
+				if err := json.Unmarshal(value, &run); err != nil {
+					return fmt.Errorf("failed to decode run %d: %v", binary.BigEndian.Uint64(key), err)
+				}
+				result = append(result, run)
+				if limit > 0 && len(result) >= limit {
+					break
+				}
+			}
+			return nil
+		})
+	})
+	return result, err
+}
+
+// LastSuccess returns the most recent successful run of a backup, or nil if there is none
+func (s *Store) LastSuccess(backupName string) (*Run, error) {
+	var last *Run
+	err := s.withDB(true, func(db *bolt.DB) error {
+		return db.View(func(tx *bolt.Tx) error {
+			bucket := backupBucket(tx, backupName)
+			if bucket == nil {
+				return nil
+			}
+
+			cursor := bucket.Cursor()
+			for key, value := cursor.Last(); key != nil; key, value = cursor.Prev() {
+				var run Run
+				if err := json.Unmarshal(value, &run); err != nil {
+					return fmt.Errorf("failed to decode run %d: %v", binary.BigEndian.Uint64(key), err)
+				}
+				if run.Status == StatusSuccess {
+					last = &run
+					return nil
+				}
+			}
+			return nil
+		})
+	})
+	return last, err
+}
+
+// Pin marks an archive of a backup as pinned so retention never deletes it
+func (s *Store) Pin(backupName, archive string) error {
+	return s.withDB(false, func(db *bolt.DB) error {
+		return db.Update(func(tx *bolt.Tx) error {
+			pins, err := tx.CreateBucketIfNotExists(pinsBucket)
+			if err != nil {
+				return err
+			}
+			bucket, err := pins.CreateBucketIfNotExists([]byte(backupName))
+			if err != nil {
+				return err
+			}
+			pinnedAt, err := time.Now().MarshalText()
+			if err != nil {
+				return err
+			}
+			return bucket.Put([]byte(archive), pinnedAt)
+		})
+	})
+}
+
+// Unpin removes the pin of an archive
+func (s *Store) Unpin(backupName, archive string) error {
+	return s.withDB(false, func(db *bolt.DB) error {
+		return db.Update(func(tx *bolt.Tx) error {
+			pins := tx.Bucket(pinsBucket)
+			if pins == nil {
+				return nil
+			}
+			bucket := pins.Bucket([]byte(backupName))
+			if bucket == nil {
+				return nil
+			}
+			return bucket.Delete([]byte(archive))
+		})
+	})
+}
+
+// Pinned returns the pinned archive names of a backup
+func (s *Store) Pinned(backupName string) (map[string]bool, error) {
+	pinned := make(map[string]bool)
+	err := s.withDB(true, func(db *bolt.DB) error {
+		return db.View(func(tx *bolt.Tx) error {
+			pins := tx.Bucket(pinsBucket)
+			if pins == nil {
+				return nil
+			}
+			bucket := pins.Bucket([]byte(backupName))
+			if bucket == nil {
+				return nil
+			}
+			return bucket.ForEach(func(key, _ []byte) error {
+				pinned[string(key)] = true
+				return nil
+			})
+		})
+	})
+	return pinned, err
+}
+
+func backupBucket(tx *bolt.Tx, backupName string) *bolt.Bucket {
+	runs := tx.Bucket(runsBucket)
+	if runs == nil {
+		return nil
+	}
+	return runs.Bucket([]byte(backupName))
+}
+
+func runKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
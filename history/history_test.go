@@ -0,0 +1,71 @@
+package history
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStoreRecordAndList(t *testing.T) {
+	store := NewStore(filepath.Join(t.TempDir(), "history.db"))
+	started := time.Date(2024, 3, 10, 2, 0, 0, 0, time.UTC)
+
+	first := &Run{Backup: "db", StartedAt: started, FinishedAt: started.Add(time.Minute), Status: StatusSuccess, Archive: "db_1.tar.gz", Size: 10}
+	second := &Run{Backup: "db", StartedAt: started.Add(time.Hour), FinishedAt: started.Add(time.Hour), Status: StatusFailed, Stage: StageUpload, Error: "boom",
+		Uploads: []UploadResult{{Storage: "s3", Error: "boom"}}}
+	other := &Run{Backup: "files", StartedAt: started, Status: StatusSuccess}
+
+	assert.NoError(t, store.Record(first))
+	assert.NoError(t, store.Record(second))
+	assert.NoError(t, store.Record(other))
+	assert.Equal(t, uint64(1), first.ID)
+	assert.Equal(t, uint64(2), second.ID)
+
+	runs, err := store.List("db", 0)
+	assert.NoError(t, err)
+	assert.Len(t, runs, 2)
+	assert.Equal(t, uint64(2), runs[0].ID)
+	assert.Equal(t, StageUpload, runs[0].Stage)
+	assert.Equal(t, "s3", runs[0].Uploads[0].Storage)
+	assert.Equal(t, time.Minute, runs[1].Duration())
+
+	runs, err = store.List("db", 1)
+	assert.NoError(t, err)
+	assert.Len(t, runs, 1)
+
+	last, err := store.LastSuccess("db")
+	assert.NoError(t, err)
+	assert.NotNil(t, last)
+	assert.Equal(t, "db_1.tar.gz", last.Archive)
+}
+
+func TestStoreMissingDatabase(t *testing.T) {
+	store := NewStore(filepath.Join(t.TempDir(), "missing", "history.db"))
+
+	runs, err := store.List("db", 10)
+	assert.NoError(t, err)
+	assert.Empty(t, runs)
+
+	last, err := store.LastSuccess("db")
+	assert.NoError(t, err)
+	assert.Nil(t, last)
+}
+
+func TestStorePins(t *testing.T) {
+	store := NewStore(filepath.Join(t.TempDir(), "history.db"))
+
+	pinned, err := store.Pinned("db")
+	assert.NoError(t, err)
+	assert.Empty(t, pinned)
+
+	assert.NoError(t, store.Pin("db", "db_1.tar.gz"))
+	assert.NoError(t, store.Pin("db", "db_2.tar.gz"))
+	assert.NoError(t, store.Unpin("db", "db_1.tar.gz"))
+	assert.NoError(t, store.Unpin("other", "db_1.tar.gz"))
+
+	pinned, err = store.Pinned("db")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"db_2.tar.gz": true}, pinned)
+}
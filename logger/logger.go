@@ -3,16 +3,28 @@ package logger
 import (
 	"fmt"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
+// minSecretLength is the length below which secrets are not redacted, replacing
+// very short values would mangle unrelated text
+const minSecretLength = 4
+
+// redactedValue replaces secrets in log lines and errors
+const redactedValue = "[REDACTED]"
+
 // Logger wraps zap.Logger to provide a simpler interface
 type Logger struct{}
 
 var (
 	instance *Logger
 	once     sync.Once
+
+	secrets   []string // Longest first, so a secret containing another is redacted whole
+	secretsMu sync.RWMutex
 )
 
 // Get returns the singleton logger instance
@@ -43,6 +55,33 @@ func (l *Logger) Warn(msg string, args ...interface{}) {
 	logPrint("WARN", "", msg, args...)
 }
 
+// RegisterSecret adds a value, such as a password, that is scrubbed from every
+// log line and from errors passed through Redact
+func RegisterSecret(value string) {
+	if len(value) < minSecretLength {
+		return
+	}
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for _, secret := range secrets {
+		if secret == value {
+			return
+		}
+	}
+	secrets = append(secrets, value)
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+}
+
+// Redact replaces registered secrets in s
+func Redact(s string) string {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, redactedValue)
+	}
+	return s
+}
+
 func logPrint(level, tag, msg string, args ...interface{}) {
 	timestamp := time.Now().Format("2006/01/02 15:04:05")
 	if tag != "" {
@@ -61,5 +100,5 @@ func logPrint(level, tag, msg string, args ...interface{}) {
 	//		msg = msg[end+1:]
 	//	}
 	//}
-	fmt.Fprintf(os.Stdout, "%s %s %s %s\n", timestamp, tag, level, msg)
+	fmt.Fprintf(os.Stdout, "%s %s %s %s\n", timestamp, tag, level, Redact(msg))
 }
@@ -44,3 +44,12 @@ func TestLoggerSync(t *testing.T) {
 	err := logger.Sync()
 	assert.NoError(t, err, "Logger sync should not return an error")
 }
+
+func TestRedact(t *testing.T) {
+	RegisterSecret("s3cret")
+	RegisterSecret("s3cret-longer")
+	RegisterSecret("abc") // too short to be redacted
+
+	assert.Equal(t, "password=[REDACTED] key=[REDACTED] user=abc", Redact("password=s3cret key=s3cret-longer user=abc"))
+	assert.Equal(t, "nothing to hide", Redact("nothing to hide"))
+}
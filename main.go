@@ -8,13 +8,21 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
+	"backupdb/api"
 	"backupdb/backup"
 	"backupdb/config"
+	"backupdb/history"
 	"backupdb/logger"
 	"backupdb/scheduler"
+	"backupdb/secrets"
 	"backupdb/storage"
 
 	"golang.org/x/oauth2"
@@ -23,16 +31,82 @@ import (
 func main() {
 	configFile := flag.String("config", "config.yaml", "Path to configuration file")
 	googleDriveAuthInit := flag.String("gdrive-auth-init", "", "Initialize OAuth token for the named Google Drive storage")
+	historyBackup := flag.String("history", "", "Print the run history of the named backup and exit")
+	historyLimit := flag.Int("history-limit", 20, "Maximum number of runs printed by -history (0 for all)")
+	runOnce := flag.Bool("run-once", false, "Run the selected backups once, print a summary and exit")
+	only := flag.String("only", "", "Comma separated names of the backups run by -run-once (default: all)")
+	validateOnly := flag.Bool("validate", false, "Validate the configuration file, print any problems and exit (non-zero if invalid)")
+	printConfig := flag.Bool("print-config", false, "Print the effective configuration with includes, defaults and templates resolved and exit")
+	watchConfig := flag.Duration("watch-config", 0, "Reload the configuration when its files change, checked at this interval (e.g. 10s, 0 disables)")
+	restoreName := flag.String("restore", "", "Restore an archive of the named backup into -restore-target and exit")
+	restoreStorage := flag.String("restore-storage", "", "Storage the archive is fetched from (default: local)")
+	restoreArchive := flag.String("restore-archive", "", "Archive restored by -restore (default: the newest)")
+	restoreTarget := flag.String("restore-target", "", "Empty directory the archive is extracted into")
+	restoreDatabase := flag.String("restore-database", "", "Also restore the dump of this database, with mysql, pg_restore (postgres custom and directory formats) or mongorestore")
+	restoreInto := flag.String("restore-into", "", "Database the dump is restored into, must exist for postgres (default: -restore-database)")
+	restoreJobs := flag.Int("restore-jobs", 0, "Parallel pg_restore jobs (default: db.jobs)")
+	restoreTables := flag.String("restore-tables", "", "Comma separated tables restored by pg_restore, or collections by mongorestore (default: all)")
+	restoreSchemas := flag.String("restore-schemas", "", "Comma separated schemas restored by pg_restore (default: all)")
+	restoreBinlogs := flag.String("restore-binlogs", "", "mysql_binlog backup whose binlogs are replayed after the mysql dump")
+	restoreWAL := flag.String("restore-wal", "", "postgres_wal backup whose WAL files recover the postgres_basebackup restored by -restore")
+	restoreUntil := flag.String("restore-until", "", "Restore the state at this local time (e.g. \"2024-05-01 14:30:00\" or RFC 3339): newest archive before it, binlogs or WAL replayed up to it")
+	walPush := flag.String("wal-push", "", "Archive the WAL file given as argument with the named postgres_wal backup and exit, for archive_command")
+	workDir := flag.String("workdir", "", "Directory holding the backups directory, entered on start (default: the current directory)")
 	flag.Parse()
 
 	log := logger.Get()
 	defer log.Sync()
 
+	walFile := flag.Arg(0)
+	if *workDir != "" {
+		// Paths given on the command line stay relative to the current directory
+		*configFile, _ = filepath.Abs(*configFile)
+		if walFile != "" {
+			walFile, _ = filepath.Abs(walFile)
+		}
+		if err := os.Chdir(*workDir); err != nil {
+			log.Error("Config", "Failed to enter working directory: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	historyStore := history.NewStore(history.DefaultPath)
+	if *historyBackup != "" {
+		if err := printHistory(historyStore, *historyBackup, *historyLimit); err != nil {
+			log.Error("History", "%v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *printConfig {
+		effective, err := config.EffectiveConfig(*configFile)
+		if err != nil {
+			log.Error("Config", "Failed to load configuration: %v", err)
+			os.Exit(1)
+		}
+		os.Stdout.Write(effective)
+		return
+	}
+
+	if *validateOnly {
+		os.Exit(validateConfig(*configFile))
+	}
+
 	cfg, err := config.LoadConfig(*configFile)
 	if err != nil {
 		log.Error("Config", "Failed to load configuration: %v", err)
 		os.Exit(1)
 	}
+	if err := cfg.Validate(); err != nil {
+		log.Error("Config", "%v", err)
+		os.Exit(1)
+	}
+	for _, warning := range cfg.Warnings() {
+		log.Warn("[Config] %s", warning)
+	}
+	secrets.Configure(cfg.Secrets)
+	registerSecrets(cfg)
 
 	if *googleDriveAuthInit != "" {
 		if err := initializeGoogleDriveOAuth(cfg, *googleDriveAuthInit); err != nil {
@@ -43,10 +117,61 @@ func main() {
 	}
 
 	backupService := backup.NewBackupService(cfg)
+	backupService.SetHistory(historyStore)
+
+	if *restoreName != "" {
+		until, err := backup.ParseRestoreTime(*restoreUntil)
+		if err != nil {
+			log.Error("Restore", "Invalid -restore-until: %v", err)
+			os.Exit(1)
+		}
+		os.Exit(restoreBackup(backupService, *restoreName, backup.RestoreOptions{
+			Storage:        *restoreStorage,
+			Archive:        *restoreArchive,
+			TargetDir:      *restoreTarget,
+			Database:       *restoreDatabase,
+			TargetDatabase: *restoreInto,
+			Jobs:           *restoreJobs,
+			Tables:         splitList(*restoreTables),
+			Schemas:        splitList(*restoreSchemas),
+			BinlogBackup:   *restoreBinlogs,
+			WALBackup:      *restoreWAL,
+			Until:          until,
+		}))
+	}
+
+	if *walPush != "" {
+		os.Exit(pushWAL(backupService, *walPush, walFile))
+	}
+
+	if *runOnce {
+		os.Exit(runBackupsOnce(backupService, *only))
+	}
+
 	schedulerService := scheduler.NewSchedulerService(cfg)
 
+	var apiServer *api.Server
+	if cfg.API.Enabled {
+		apiServer = api.NewServer(cfg.API, backupService, schedulerService)
+		if err := apiServer.Start(); err != nil {
+			log.Error("API", "Failed to start API server: %v", err)
+			os.Exit(1)
+		}
+	}
+
 	go func() {
 		for _, backup := range cfg.Backups {
+			lastSuccess, err := historyStore.LastSuccess(backup.Name)
+			if err != nil {
+				log.Error("Backup", "Failed to read last successful run of %s: %v", backup.Name, err)
+			}
+			shouldRun, reason := scheduler.ShouldRunOnStart(backup, lastSuccess, time.Now())
+			if !shouldRun {
+				log.Info("Backup", "Skipping startup backup for %s: %s", backup.Name, reason)
+				continue
+			}
+			log.Info("Backup", "Running startup backup for %s: %s", backup.Name, reason)
+
 			if err := backupService.CreateBackup(backup); err != nil {
 				log.Error("Backup", "Failed to create backup for %s: %v", backup.Name, err)
 				continue
@@ -58,14 +183,396 @@ func main() {
 		schedulerService.Start(backupService)
 	}()
 
+	reloader := &configReloader{
+		path:      *configFile,
+		current:   cfg,
+		backups:   backupService,
+		scheduler: schedulerService,
+	}
+	if *watchConfig > 0 {
+		go reloader.watch(*watchConfig)
+	}
+
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigChan {
+		if sig == syscall.SIGHUP {
+			log.Info("Config", "Received SIGHUP, reloading configuration")
+			reloader.reload()
+			continue
+		}
+		break
+	}
 
+	if apiServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := apiServer.Shutdown(ctx); err != nil {
+			log.Error("API", "Failed to shut down API server: %v", err)
+		}
+		cancel()
+	}
 	schedulerService.Stop()
 	log.Info("System", "Shutting down...")
 }
 
+// configReloader reloads the configuration file and applies the changes to the running services
+type configReloader struct {
+	path      string
+	current   *config.Config
+	backups   *backup.BackupService
+	scheduler *scheduler.SchedulerService
+	mu        sync.Mutex
+}
+
+func (r *configReloader) reload() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	log := logger.Get()
+	cfg, err := config.LoadConfig(r.path)
+	if err != nil {
+		log.Error("Config", "Failed to reload configuration, keeping the current one: %v", err)
+		return
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Error("Config", "Invalid configuration, keeping the current one: %v", err)
+		return
+	}
+	for _, warning := range cfg.Warnings() {
+		log.Warn("[Config] %s", warning)
+	}
+
+	changes := config.Diff(r.current, cfg)
+	if len(changes) == 0 {
+		log.Info("Config", "Configuration reloaded, no changes")
+		return
+	}
+	for _, change := range changes {
+		log.Info("Config", "Change: %s", change)
+	}
+	if !reflect.DeepEqual(r.current.API, cfg.API) {
+		log.Info("Config", "API settings changes take effect after a restart")
+	}
+
+	secrets.Configure(cfg.Secrets)
+	registerSecrets(cfg)
+	r.backups.Reload(cfg)
+	r.scheduler.Reload(cfg)
+	r.current = cfg
+	log.Info("Config", "Configuration reloaded with %d changes", len(changes))
+}
+
+// watch polls the configuration files, the main one and its includes, and
+// reloads them when the modification time or size of one changes
+func (r *configReloader) watch(interval time.Duration) {
+	log := logger.Get()
+	last := r.statFiles()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if reflect.DeepEqual(r.statFiles(), last) {
+			continue
+		}
+		log.Info("Config", "Configuration file changed, reloading")
+		r.reload()
+		// The reloaded configuration may include other files
+		last = r.statFiles()
+	}
+}
+
+// configFileState is the modification time and size of a watched configuration file
+type configFileState struct {
+	modTime int64
+	size    int64
+}
+
+// statFiles returns the state of the files the current configuration was
+// loaded from. A file that cannot be read has a zero state.
+func (r *configReloader) statFiles() map[string]configFileState {
+	r.mu.Lock()
+	files := r.current.Files()
+	r.mu.Unlock()
+	if len(files) == 0 {
+		files = []string{r.path}
+	}
+
+	states := make(map[string]configFileState, len(files))
+	for _, path := range files {
+		info, err := os.Stat(path)
+		if err != nil {
+			logger.Get().Error("Config", "Failed to stat configuration file: %v", err)
+			states[path] = configFileState{}
+			continue
+		}
+		states[path] = configFileState{modTime: info.ModTime().UnixNano(), size: info.Size()}
+	}
+	return states
+}
+
+// runBackupsOnce runs the selected backups sequentially, prints a summary and
+// returns the process exit code: 0 if every backup succeeded, 1 if any failed,
+// 2 if some only partially succeeded
+func runBackupsOnce(backupService *backup.BackupService, only string) int {
+	log := logger.Get()
+
+	var selected []config.BackupConfig
+	if strings.TrimSpace(only) == "" {
+		for _, backupCfg := range backupService.Config().Backups {
+			// WAL files are archived by Postgres through -wal-push
+			if backupCfg.Type != "postgres_wal" {
+				selected = append(selected, backupCfg)
+			}
+		}
+	} else {
+		for _, name := range strings.Split(only, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			backupCfg, ok := backupService.FindBackup(name)
+			if !ok {
+				log.Error("Backup", "Backup %s not found in configuration", name)
+				return 1
+			}
+			selected = append(selected, backupCfg)
+		}
+	}
+	if len(selected) == 0 {
+		log.Error("Backup", "No backups selected")
+		return 1
+	}
+
+	var runs []*history.Run
+	failed, partial := 0, 0
+	for _, backupCfg := range selected {
+		run, err := backupService.RunBackup(backupCfg)
+		if err != nil {
+			log.Error("Backup", "Failed to create backup for %s: %v", backupCfg.Name, err)
+			failed++
+		} else if run.Status == history.StatusPartial {
+			log.Warn("[Backup] Backup of %s completed with failures: %s", backupCfg.Name, run.Error)
+			partial++
+		} else {
+			log.Info("Backup", "Backup completed successfully for %s", backupCfg.Name)
+		}
+		if run == nil {
+			run = &history.Run{Backup: backupCfg.Name, Status: history.StatusFailed}
+			if err != nil {
+				run.Error = logger.Redact(err.Error())
+			}
+		}
+		runs = append(runs, run)
+	}
+
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "BACKUP\tSTATUS\tSTAGE\tDURATION\tSIZE\tARCHIVE\tERROR")
+	for _, run := range runs {
+		stage := run.Stage
+		if stage == "" {
+			stage = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			run.Backup,
+			run.Status,
+			stage,
+			run.Duration().Round(time.Second),
+			run.Size,
+			run.Archive,
+			run.Error,
+		)
+	}
+	w.Flush()
+	printDatabaseResults(runs)
+	fmt.Printf("\n%d succeeded, %d partial, %d failed\n", len(runs)-failed-partial, partial, failed)
+
+	if failed > 0 {
+		return 1
+	}
+	if partial > 0 {
+		return 2
+	}
+	return 0
+}
+
+// printDatabaseResults prints the duration and size of each database dump of the runs
+func printDatabaseResults(runs []*history.Run) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	header := false
+	for _, run := range runs {
+		for _, result := range run.Databases {
+			if !header {
+				fmt.Println()
+				fmt.Fprintln(w, "BACKUP\tDATABASE\tSTATUS\tDURATION\tSIZE\tERROR")
+				header = true
+			}
+			status := "ok"
+			if !result.Success {
+				status = "failed"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n",
+				run.Backup,
+				result.Database,
+				status,
+				(time.Duration(result.DurationMs) * time.Millisecond).Round(100*time.Millisecond),
+				result.Size,
+				result.Error,
+			)
+		}
+	}
+	w.Flush()
+}
+
+// registerSecrets registers the secret values written in the configuration with
+// the logger so they are redacted. Secrets from a secret manager are registered
+// when they are resolved.
+func registerSecrets(cfg *config.Config) {
+	values := []string{cfg.API.Token, cfg.Secrets.Vault.Token}
+	for _, backup := range cfg.Backups {
+		if backup.DB != nil {
+			values = append(values, backup.DB.Password)
+		}
+	}
+	for _, storageCfg := range cfg.Storage {
+		values = append(values, storageCfg.SecretAccessKey)
+	}
+	for _, value := range values {
+		if !secrets.IsReference(value) {
+			logger.RegisterSecret(value)
+		}
+	}
+}
+
+// validateConfig loads and validates a configuration file, prints every problem
+// found and returns the process exit code
+func validateConfig(path string) int {
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		return 1
+	}
+
+	for _, warning := range cfg.Warnings() {
+		fmt.Fprintf(os.Stderr, "%s: warning: %s\n", path, warning)
+	}
+	if err := cfg.Validate(); err != nil {
+		if validationErr, ok := err.(*config.ValidationError); ok {
+			for _, issue := range validationErr.Issues {
+				fmt.Fprintf(os.Stderr, "%s: error: %s\n", path, issue)
+			}
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		}
+		return 1
+	}
+
+	fmt.Printf("%s: configuration is valid (%d backups, %d storages)\n", path, len(cfg.Backups), len(cfg.Storage))
+	return 0
+}
+
+// restoreBackup restores an archive of a backup and returns the process exit code
+func restoreBackup(backupService *backup.BackupService, name string, opts backup.RestoreOptions) int {
+	log := logger.Get()
+	backupCfg, ok := backupService.FindBackup(name)
+	if !ok {
+		log.Error("Restore", "Backup %s not found in configuration", name)
+		return 1
+	}
+	if err := backupService.Restore(backupCfg, opts); err != nil {
+		log.Error("Restore", "[%s] Restore failed: %v", name, err)
+		return 1
+	}
+	return 0
+}
+
+// pushWAL archives a WAL file with a postgres_wal backup and returns the
+// process exit code, non-zero telling Postgres to retry
+func pushWAL(backupService *backup.BackupService, name, walFile string) int {
+	log := logger.Get()
+	backupCfg, ok := backupService.FindBackup(name)
+	if !ok {
+		log.Error("Backup", "Backup %s not found in configuration", name)
+		return 1
+	}
+	if walFile == "" {
+		log.Error("Backup", "[%s] -wal-push requires the WAL file path (%%p) as argument", name)
+		return 1
+	}
+	if err := backupService.PushWAL(backupCfg, walFile); err != nil {
+		log.Error("Backup", "[%s] Failed to archive WAL file %s: %v", name, walFile, err)
+		return 1
+	}
+	return 0
+}
+
+// splitList splits a comma separated list, ignoring empty items
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func printHistory(store *history.Store, backupName string, limit int) error {
+	runs, err := store.List(backupName, limit)
+	if err != nil {
+		return err
+	}
+	if len(runs) == 0 {
+		fmt.Printf("No runs recorded for %s\n", backupName)
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTARTED\tDURATION\tSTATUS\tSTAGE\tSIZE\tARCHIVE\tUPLOADS\tDELETED")
+	for _, run := range runs {
+		var uploads []string
+		for _, upload := range run.Uploads {
+			state := "ok"
+			if !upload.Success {
+				state = "failed"
+			}
+			uploads = append(uploads, fmt.Sprintf("%s:%s", upload.Storage, state))
+		}
+		deleted := 0
+		for _, retention := range run.Retention {
+			deleted += len(retention.Deleted)
+		}
+		stage := run.Stage
+		if stage == "" {
+			stage = "-"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%d\n",
+			run.ID,
+			run.StartedAt.Format("2006-01-02 15:04:05"),
+			run.Duration().Round(time.Second),
+			run.Status,
+			stage,
+			run.Size,
+			run.Archive,
+			strings.Join(uploads, ","),
+			deleted,
+		)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println()
+	for _, run := range runs {
+		if run.Error != "" {
+			fmt.Printf("#%d error (%s): %s\n", run.ID, run.Stage, run.Error)
+			continue
+		}
+		fmt.Printf("#%d sha256 %s\n", run.ID, run.Checksum)
+	}
+	return nil
+}
+
 func initializeGoogleDriveOAuth(cfg *config.Config, storageName string) error {
 	storageCfg, exists := cfg.Storage[storageName]
 	if !exists {
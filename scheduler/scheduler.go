@@ -3,6 +3,7 @@ package scheduler
 import (
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/robfig/cron/v3"
 
@@ -12,17 +13,27 @@ import (
 )
 
 type SchedulerService struct {
-	config *config.Config
-	log    *logger.Logger
-	cron   *cron.Cron
-	jobs   map[string]cron.EntryID
-	mu     sync.Mutex
+	config        *config.Config
+	log           *logger.Logger
+	backupService *backup.BackupService
+	crons         map[string]*cron.Cron
+	jobs          map[string]cron.EntryID
+	mu            sync.Mutex
+}
+
+// JobSchedule describes the cron entry of a scheduled backup
+type JobSchedule struct {
+	Name     string
+	CronExpr string
+	Prev     time.Time // Last time the job was run by the scheduler, zero if never
+	Next     time.Time
 }
 
 func NewSchedulerService(cfg *config.Config) *SchedulerService {
 	return &SchedulerService{
 		config: cfg,
 		log:    logger.Get(),
+		crons:  make(map[string]*cron.Cron),
 		jobs:   make(map[string]cron.EntryID),
 	}
 }
@@ -40,53 +51,160 @@ func getCronInstance(expr string) *cron.Cron {
 func (s *SchedulerService) Start(backupService *backup.BackupService) {
 	s.log.Info("Scheduler", "Starting scheduler service")
 
+	s.mu.Lock()
+	s.backupService = backupService
+	backups := s.config.Backups
+	s.mu.Unlock()
+
 	// Schedule each backup
-	for _, backup := range s.config.Backups {
-		if !backup.Scheduler.Enabled {
-			s.log.Info("Scheduler", "Scheduler disabled for backup: %s", backup.Name)
-			continue
-		}
+	for _, backup := range backups {
+		s.scheduleBackup(backup)
+	}
+}
 
-		if backup.Scheduler.CronExpr == "" {
-			s.log.Error("Scheduler", "No cron expression provided for backup: %s", backup.Name)
-			continue
-		}
+// scheduleBackup creates and starts the cron instance of a backup
+func (s *SchedulerService) scheduleBackup(backup config.BackupConfig) {
+	if !backup.Scheduler.Enabled {
+		s.log.Info("Scheduler", "Scheduler disabled for backup: %s", backup.Name)
+		return
+	}
 
-		// Use the correct cron instance for this backup
-		cronInstance := getCronInstance(backup.Scheduler.CronExpr)
+	if backup.Scheduler.CronExpr == "" {
+		s.log.Error("Scheduler", "No cron expression provided for backup: %s", backup.Name)
+		return
+	}
+
+	// Use the correct cron instance for this backup
+	cronInstance := getCronInstance(backup.Scheduler.CronExpr)
+
+	name := backup.Name
+	jobID, err := cronInstance.AddFunc(backup.Scheduler.CronExpr, func() {
+		s.runScheduledBackup(name)
+	})
 
-		// Create a copy of the backup config for the closure
-		backupCfg := backup
-		jobID, err := cronInstance.AddFunc(backup.Scheduler.CronExpr, func() {
-			s.log.Info("Scheduler", "Running scheduled backup: %s (cron: %s)", backupCfg.Name, backupCfg.Scheduler.CronExpr)
+	if err != nil {
+		s.log.Error("Scheduler", "Failed to schedule backup: %s (cron: %s): %v", backup.Name, backup.Scheduler.CronExpr, err)
+		return
+	}
+
+	s.mu.Lock()
+	s.crons[backup.Name] = cronInstance
+	s.jobs[backup.Name] = jobID
+	s.mu.Unlock()
 
-			if err := backupService.CreateBackup(backupCfg); err != nil {
-				s.log.Error("Scheduler", "Failed to run scheduled backup: %s: %v", backupCfg.Name, err)
-			} else {
-				s.log.Info("Scheduler", "Backup completed successfully: %s", backupCfg.Name)
-			}
-		})
+	s.log.Info("Scheduler", "Backup scheduled successfully: %s (cron: %s)", backup.Name, backup.Scheduler.CronExpr)
 
-		if err != nil {
-			s.log.Error("Scheduler", "Failed to schedule backup: %s (cron: %s): %v", backup.Name, backup.Scheduler.CronExpr, err)
+	// Start the cron scheduler for this backup
+	cronInstance.Start()
+}
+
+// runScheduledBackup runs a backup with its current configuration, so settings
+// changed by a reload are picked up without rescheduling
+func (s *SchedulerService) runScheduledBackup(name string) {
+	s.mu.Lock()
+	backupService := s.backupService
+	s.mu.Unlock()
+
+	backupCfg, ok := backupService.FindBackup(name)
+	if !ok {
+		s.log.Error("Scheduler", "Scheduled backup %s is no longer configured", name)
+		return
+	}
+
+	s.log.Info("Scheduler", "Running scheduled backup: %s (cron: %s)", backupCfg.Name, backupCfg.Scheduler.CronExpr)
+
+	if err := backupService.CreateBackup(backupCfg); err != nil {
+		s.log.Error("Scheduler", "Failed to run scheduled backup: %s: %v", backupCfg.Name, err)
+	} else {
+		s.log.Info("Scheduler", "Backup completed successfully: %s", backupCfg.Name)
+	}
+}
+
+// Reload applies a new configuration: jobs of removed backups or with a changed
+// schedule are stopped and new or changed schedules are started. Running backups
+// are not interrupted.
+func (s *SchedulerService) Reload(cfg *config.Config) {
+	s.mu.Lock()
+	oldCfg := s.config
+	s.config = cfg
+	started := s.backupService != nil
+	s.mu.Unlock()
+
+	if !started {
+		return
+	}
+
+	oldBackups := make(map[string]config.BackupConfig)
+	for _, backup := range oldCfg.Backups {
+		oldBackups[backup.Name] = backup
+	}
+	newBackups := make(map[string]bool)
+	for _, backup := range cfg.Backups {
+		newBackups[backup.Name] = true
+	}
+
+	for _, backup := range oldCfg.Backups {
+		if !newBackups[backup.Name] {
+			s.unscheduleBackup(backup.Name)
+		}
+	}
+	for _, backup := range cfg.Backups {
+		oldBackup, ok := oldBackups[backup.Name]
+		if ok && oldBackup.Scheduler == backup.Scheduler {
 			continue
 		}
+		s.unscheduleBackup(backup.Name)
+		s.scheduleBackup(backup)
+	}
+}
 
-		s.mu.Lock()
-		s.jobs[backup.Name] = jobID
-		s.mu.Unlock()
-
-		s.log.Info("Scheduler", "Backup scheduled successfully: %s (cron: %s)", backup.Name, backup.Scheduler.CronExpr)
+// unscheduleBackup stops the cron instance of a backup without waiting for a running job
+func (s *SchedulerService) unscheduleBackup(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-		// Start the cron scheduler for this backup
-		cronInstance.Start()
+	cronInstance, ok := s.crons[name]
+	if !ok {
+		return
 	}
+	cronInstance.Stop()
+	delete(s.crons, name)
+	delete(s.jobs, name)
+	s.log.Info("Scheduler", "Backup unscheduled: %s", name)
 }
 
 // Stop stops the scheduler service
 func (s *SchedulerService) Stop() {
 	s.log.Info("Scheduler", "Stopping scheduler service")
-	if s.cron != nil {
-		s.cron.Stop()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, cronInstance := range s.crons {
+		cronInstance.Stop()
+		delete(s.crons, name)
+		delete(s.jobs, name)
+	}
+}
+
+// Schedule returns the cron entry of a scheduled backup
+func (s *SchedulerService) Schedule(name string) (JobSchedule, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cronInstance, ok := s.crons[name]
+	if !ok {
+		return JobSchedule{}, false
+	}
+	entry := cronInstance.Entry(s.jobs[name])
+	if !entry.Valid() {
+		return JobSchedule{}, false
+	}
+
+	schedule := JobSchedule{Name: name, Prev: entry.Prev, Next: entry.Next}
+	for _, backup := range s.config.Backups {
+		if backup.Name == name {
+			schedule.CronExpr = backup.Scheduler.CronExpr
+			break
+		}
 	}
+	return schedule, true
 }
@@ -36,7 +36,15 @@ func TestSchedulerService_Start_Stop(t *testing.T) {
 	backupService := backup.NewBackupService(cfg)
 	// Start and Stop should not panic
 	s.Start(backupService)
+
+	schedule, ok := s.Schedule("test-backup")
+	assert.True(t, ok)
+	assert.Equal(t, "* * * * *", schedule.CronExpr)
+	assert.False(t, schedule.Next.IsZero())
+
 	s.Stop()
+	_, ok = s.Schedule("test-backup")
+	assert.False(t, ok)
 }
 
 func TestSchedulerService_DisabledOrNoCron(t *testing.T) {
@@ -62,3 +70,41 @@ func TestSchedulerService_DisabledOrNoCron(t *testing.T) {
 	s.Start(backupService)
 	s.Stop()
 }
+
+func TestSchedulerService_Reload(t *testing.T) {
+	cfg := &config.Config{
+		Backups: []config.BackupConfig{
+			{Name: "kept", SourcePath: "test_data"},
+			{Name: "removed", SourcePath: "test_data"},
+		},
+	}
+	for i := range cfg.Backups {
+		cfg.Backups[i].Scheduler.Enabled = true
+		cfg.Backups[i].Scheduler.CronExpr = "0 1 * * *"
+	}
+	s := NewSchedulerService(cfg)
+	s.Start(backup.NewBackupService(cfg))
+	defer s.Stop()
+
+	newCfg := &config.Config{
+		Backups: []config.BackupConfig{
+			{Name: "kept", SourcePath: "test_data"},
+			{Name: "added", SourcePath: "test_data"},
+		},
+	}
+	newCfg.Backups[0].Scheduler.Enabled = true
+	newCfg.Backups[0].Scheduler.CronExpr = "0 2 * * *"
+	newCfg.Backups[1].Scheduler.Enabled = true
+	newCfg.Backups[1].Scheduler.CronExpr = "0 3 * * *"
+	s.Reload(newCfg)
+
+	schedule, ok := s.Schedule("kept")
+	assert.True(t, ok)
+	assert.Equal(t, "0 2 * * *", schedule.CronExpr)
+	assert.Equal(t, 2, schedule.Next.Hour())
+
+	_, ok = s.Schedule("added")
+	assert.True(t, ok)
+	_, ok = s.Schedule("removed")
+	assert.False(t, ok)
+}
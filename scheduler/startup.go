@@ -0,0 +1,45 @@
+package scheduler
+
+import (
+	"fmt"
+	"time"
+
+	"backupdb/config"
+	"backupdb/history"
+)
+
+// ShouldRunOnStart decides from the backup's run_on_start policy whether it must run
+// when the daemon starts, and returns the reason for the decision.
+// lastSuccess is the most recent successful run, or nil if the backup never succeeded.
+func ShouldRunOnStart(backup config.BackupConfig, lastSuccess *history.Run, now time.Time) (bool, string) {
+	if backup.Type == "postgres_wal" {
+		return false, "postgres_wal backups run from archive_command"
+	}
+	switch backup.RunOnStart {
+	case config.RunOnStartAlways, "":
+		return true, "run_on_start is always"
+	case config.RunOnStartNever:
+		return false, "run_on_start is never"
+	case config.RunOnStartIfMissed:
+	default:
+		return false, fmt.Sprintf("unknown run_on_start policy %q", backup.RunOnStart)
+	}
+
+	if !backup.Scheduler.Enabled || backup.Scheduler.CronExpr == "" {
+		return false, "no schedule to catch up"
+	}
+	schedule, err := config.ParseSchedule(backup.Scheduler.CronExpr)
+	if err != nil {
+		return false, fmt.Sprintf("invalid cron expression %q: %v", backup.Scheduler.CronExpr, err)
+	}
+	if lastSuccess == nil {
+		return true, "no successful run recorded"
+	}
+
+	missed := schedule.Next(lastSuccess.StartedAt)
+	if missed.After(now) {
+		return false, fmt.Sprintf("last successful run at %s, next scheduled run at %s",
+			lastSuccess.StartedAt.Format(time.RFC3339), missed.Format(time.RFC3339))
+	}
+	return true, fmt.Sprintf("missed scheduled run at %s", missed.Format(time.RFC3339))
+}
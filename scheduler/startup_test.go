@@ -0,0 +1,51 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"backupdb/config"
+	"backupdb/history"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldRunOnStart(t *testing.T) {
+	now := time.Date(2026, 5, 8, 12, 0, 0, 0, time.Local)
+	daily := config.BackupConfig{Name: "daily", RunOnStart: config.RunOnStartIfMissed}
+	daily.Scheduler.Enabled = true
+	daily.Scheduler.CronExpr = "0 2 * * *"
+
+	run, _ := ShouldRunOnStart(config.BackupConfig{}, nil, now)
+	assert.True(t, run)
+	run, _ = ShouldRunOnStart(config.BackupConfig{RunOnStart: config.RunOnStartNever}, nil, now)
+	assert.False(t, run)
+	run, _ = ShouldRunOnStart(config.BackupConfig{RunOnStart: "sometimes"}, nil, now)
+	assert.False(t, run)
+	run, _ = ShouldRunOnStart(config.BackupConfig{Type: "postgres_wal"}, nil, now)
+	assert.False(t, run)
+
+	// Never succeeded: catch up
+	run, _ = ShouldRunOnStart(daily, nil, now)
+	assert.True(t, run)
+
+	// Ran today at 02:00, next run tomorrow
+	run, reason := ShouldRunOnStart(daily, &history.Run{StartedAt: time.Date(2026, 5, 8, 2, 0, 5, 0, time.Local)}, now)
+	assert.False(t, run)
+	assert.Contains(t, reason, "next scheduled run")
+
+	// Last ran yesterday, today's 02:00 run was missed
+	run, reason = ShouldRunOnStart(daily, &history.Run{StartedAt: time.Date(2026, 5, 7, 2, 0, 5, 0, time.Local)}, now)
+	assert.True(t, run)
+	assert.Contains(t, reason, "missed")
+
+	// Seconds field is supported
+	daily.Scheduler.CronExpr = "0 0 2 * * *"
+	run, _ = ShouldRunOnStart(daily, &history.Run{StartedAt: time.Date(2026, 5, 7, 2, 0, 5, 0, time.Local)}, now)
+	assert.True(t, run)
+
+	// Unscheduled backups have nothing to catch up
+	daily.Scheduler.Enabled = false
+	run, _ = ShouldRunOnStart(daily, nil, now)
+	assert.False(t, run)
+}
@@ -0,0 +1,155 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"backupdb/config"
+)
+
+// Prefixes of values resolved from a secret backend
+const (
+	VaultPrefix = "vault:" // vault:<path>#<key>, e.g. vault:secret/backup/mysql#password
+	ExecPrefix  = "exec:"  // exec:<command>, the secret is the command's stdout
+)
+
+// commandTimeout limits how long an exec: command or a Vault request may take
+const commandTimeout = 30 * time.Second
+
+var (
+	current config.SecretsConfig
+	mu      sync.RWMutex
+)
+
+// Configure sets the secret backend settings used by Resolve
+func Configure(cfg config.SecretsConfig) {
+	mu.Lock()
+	defer mu.Unlock()
+	current = cfg
+}
+
+// IsReference reports whether a value must be resolved from a secret backend
+func IsReference(value string) bool {
+	return strings.HasPrefix(value, VaultPrefix) || strings.HasPrefix(value, ExecPrefix)
+}
+
+// Resolve returns the secret a value refers to, fetched from its backend on
+// every call. Values that are not references are returned unchanged.
+func Resolve(value string) (string, error) {
+	mu.RLock()
+	cfg := current
+	mu.RUnlock()
+
+	switch {
+	case strings.HasPrefix(value, VaultPrefix):
+		return resolveVault(cfg.Vault, strings.TrimPrefix(value, VaultPrefix))
+	case strings.HasPrefix(value, ExecPrefix):
+		return resolveExec(strings.TrimPrefix(value, ExecPrefix))
+	}
+	return value, nil
+}
+
+// resolveVault reads a key of a secret from a Vault KV secrets engine
+func resolveVault(cfg config.VaultConfig, ref string) (string, error) {
+	path, key, ok := strings.Cut(ref, "#")
+	path = strings.Trim(path, "/")
+	if !ok || path == "" || key == "" {
+		return "", fmt.Errorf("invalid vault reference %q, expected vault:<path>#<key>", VaultPrefix+ref)
+	}
+
+	address := cfg.Address
+	if address == "" {
+		address = os.Getenv("VAULT_ADDR")
+	}
+	token := cfg.Token
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	if address == "" || token == "" {
+		return "", fmt.Errorf("vault address and token are required to resolve %s", VaultPrefix+path)
+	}
+
+	// KV version 2 serves secrets under <mount>/data/<path>
+	apiPath := path
+	if cfg.KVVersion != 1 {
+		mount, rest, _ := strings.Cut(path, "/")
+		apiPath = mount + "/data/" + rest
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(address, "/")+"/v1/"+apiPath, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create vault request: %v", err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if cfg.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", cfg.Namespace)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to read vault secret %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to read vault secret %s: %s", path, resp.Status)
+	}
+
+	var body struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to decode vault secret %s: %v", path, err)
+	}
+	data := body.Data
+	if cfg.KVVersion != 1 {
+		var versioned struct {
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(data, &versioned); err != nil {
+			return "", fmt.Errorf("failed to decode vault secret %s: %v", path, err)
+		}
+		data = versioned.Data
+	}
+
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return "", fmt.Errorf("failed to decode vault secret %s: %v", path, err)
+	}
+	value, ok := values[key]
+	if !ok {
+		return "", fmt.Errorf("vault secret %s has no key %s", path, key)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+// resolveExec runs a command with the shell and returns its stdout without trailing newlines
+func resolveExec(command string) (string, error) {
+	if strings.TrimSpace(command) == "" {
+		return "", fmt.Errorf("exec reference has no command")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// Only stderr is reported, stdout may contain part of the secret
+		return "", fmt.Errorf("secret command failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimRight(stdout.String(), "\r\n"), nil
+}
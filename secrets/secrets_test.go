@@ -0,0 +1,79 @@
+package secrets
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"backupdb/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newVaultStub(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/backup/mysql":
+			w.Write([]byte(`{"data":{"data":{"password":"kv2-secret","port":3306},"metadata":{"version":1}}}`))
+		case "/v1/kv/backup/mysql":
+			w.Write([]byte(`{"data":{"password":"kv1-secret"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestResolveVault(t *testing.T) {
+	server := newVaultStub(t)
+	defer Configure(config.SecretsConfig{})
+
+	Configure(config.SecretsConfig{Vault: config.VaultConfig{Address: server.URL, Token: "root"}})
+	value, err := Resolve("vault:secret/backup/mysql#password")
+	assert.NoError(t, err)
+	assert.Equal(t, "kv2-secret", value)
+
+	value, err = Resolve("vault:secret/backup/mysql#port")
+	assert.NoError(t, err)
+	assert.Equal(t, "3306", value)
+
+	_, err = Resolve("vault:secret/backup/mysql#user")
+	assert.ErrorContains(t, err, "has no key user")
+	_, err = Resolve("vault:secret/backup/missing#password")
+	assert.ErrorContains(t, err, "404")
+	_, err = Resolve("vault:secret/backup/mysql")
+	assert.ErrorContains(t, err, "expected vault:<path>#<key>")
+
+	Configure(config.SecretsConfig{Vault: config.VaultConfig{Address: server.URL, Token: "root", KVVersion: 1}})
+	value, err = Resolve("vault:kv/backup/mysql#password")
+	assert.NoError(t, err)
+	assert.Equal(t, "kv1-secret", value)
+
+	Configure(config.SecretsConfig{Vault: config.VaultConfig{Address: server.URL, Token: "wrong"}})
+	_, err = Resolve("vault:secret/backup/mysql#password")
+	assert.ErrorContains(t, err, "403")
+}
+
+func TestResolveExec(t *testing.T) {
+	value, err := Resolve("exec:printf 's3cret\\n'")
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cret", value)
+
+	_, err = Resolve("exec:echo leaked; echo denied >&2; exit 3")
+	assert.ErrorContains(t, err, "denied")
+	assert.NotContains(t, err.Error(), "leaked")
+}
+
+func TestResolvePlainValue(t *testing.T) {
+	assert.False(t, IsReference("plain-password"))
+	assert.True(t, IsReference("exec:cat /run/secret"))
+
+	value, err := Resolve("plain-password")
+	assert.NoError(t, err)
+	assert.Equal(t, "plain-password", value)
+}
@@ -0,0 +1,305 @@
+package sshclient
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"backupdb/config"
+	"backupdb/logger"
+	"backupdb/secrets"
+)
+
+// Defaults of the connection settings
+const (
+	DefaultKeepaliveInterval = 30 * time.Second
+	DefaultConnectTimeout    = 15 * time.Second
+)
+
+// Client is an SSH connection, possibly through a jump host, used to run
+// remote commands and forward local ports
+type Client struct {
+	client *ssh.Client
+	jump   *Client // Connection to the jump host, nil if connected directly
+	done   chan struct{}
+	once   sync.Once
+}
+
+// Dial connects and authenticates to the host of cfg, through its jump host if any
+func Dial(cfg *config.SSHConfig) (*Client, error) {
+	var jump *Client
+	dial := func(network, addr string) (net.Conn, error) {
+		return net.DialTimeout(network, addr, connectTimeout(cfg))
+	}
+	if cfg.Jump != nil {
+		var err error
+		jump, err = Dial(cfg.Jump)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to jump host %s: %v", cfg.Jump.Host, err)
+		}
+		dial = jump.client.Dial
+	}
+
+	client, err := dialClient(cfg, dial)
+	if err != nil {
+		if jump != nil {
+			jump.Close()
+		}
+		return nil, err
+	}
+
+	c := &Client{client: client, jump: jump, done: make(chan struct{})}
+	if interval := keepaliveInterval(cfg); interval > 0 {
+		go c.keepalive(interval)
+	}
+	return c, nil
+}
+
+// dialClient opens the SSH connection to cfg.Host over a connection from dial
+func dialClient(cfg *config.SSHConfig, dial func(network, addr string) (net.Conn, error)) (*ssh.Client, error) {
+	auth, closeAgent, err := authMethods(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer closeAgent()
+	hostKeyCallback, err := hostKeyCallback(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	clientConfig := &ssh.ClientConfig{
+		User:            cfg.User,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         connectTimeout(cfg),
+	}
+
+	client, err := handshake(addr, clientConfig, dial)
+	var keyErr *knownhosts.KeyError
+	if errors.As(err, &keyErr) && len(keyErr.Want) > 0 {
+		// The host is known with another key type than the one the server
+		// offered first, retry asking for the known key types
+		for _, known := range keyErr.Want {
+			clientConfig.HostKeyAlgorithms = append(clientConfig.HostKeyAlgorithms, hostKeyAlgorithms(known.Key.Type())...)
+		}
+		client, err = handshake(addr, clientConfig, dial)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", addr, err)
+	}
+	return client, nil
+}
+
+func handshake(addr string, clientConfig *ssh.ClientConfig, dial func(network, addr string) (net.Conn, error)) (*ssh.Client, error) {
+	conn, err := dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if clientConfig.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(clientConfig.Timeout))
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, clientConfig)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// hostKeyAlgorithms returns the algorithms that can be negotiated for a key type
+func hostKeyAlgorithms(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{keyType}
+}
+
+// authMethods returns the public key authentication methods of cfg: the key
+// file, then the agent. The returned function closes the agent connection
+// once authentication is done.
+func authMethods(cfg *config.SSHConfig) ([]ssh.AuthMethod, func(), error) {
+	var methods []ssh.AuthMethod
+	closeAgent := func() {}
+
+	if cfg.KeyFile != "" {
+		key, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read SSH key file: %v", err)
+		}
+		var signer ssh.Signer
+		if cfg.KeyPassphrase != "" {
+			passphrase, err := secrets.Resolve(cfg.KeyPassphrase)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to resolve SSH key passphrase: %v", err)
+			}
+			logger.RegisterSecret(passphrase)
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to parse SSH key file %s: %v", cfg.KeyFile, err)
+			}
+		} else {
+			signer, err = ssh.ParsePrivateKey(key)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to parse SSH key file %s: %v", cfg.KeyFile, err)
+			}
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+
+	if cfg.UseAgent {
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		if socket == "" {
+			return nil, nil, fmt.Errorf("use_agent is set but SSH_AUTH_SOCK is not")
+		}
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to connect to SSH agent: %v", err)
+		}
+		closeAgent = func() { conn.Close() }
+		methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+	}
+
+	if len(methods) == 0 {
+		return nil, nil, fmt.Errorf("no SSH authentication method configured, set key_file or use_agent")
+	}
+	return methods, closeAgent, nil
+}
+
+// hostKeyCallback verifies host keys against the known_hosts file of cfg
+func hostKeyCallback(cfg *config.SSHConfig) (ssh.HostKeyCallback, error) {
+	if cfg.InsecureIgnoreHostKey {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	knownHostsFile := cfg.KnownHostsFile
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to find the known_hosts file: %v", err)
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	callback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known_hosts file (add the host with ssh-keyscan or set known_hosts_file): %v", err)
+	}
+	return callback, nil
+}
+
+func keepaliveInterval(cfg *config.SSHConfig) time.Duration {
+	if cfg.KeepaliveInterval < 0 {
+		return 0
+	}
+	if cfg.KeepaliveInterval == 0 {
+		return DefaultKeepaliveInterval
+	}
+	return time.Duration(cfg.KeepaliveInterval) * time.Second
+}
+
+func connectTimeout(cfg *config.SSHConfig) time.Duration {
+	if cfg.ConnectTimeout == 0 {
+		return DefaultConnectTimeout
+	}
+	return time.Duration(cfg.ConnectTimeout) * time.Second
+}
+
+// keepalive sends keepalive requests until the client is closed, and closes
+// it when the server stops answering
+func (c *Client) keepalive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if _, _, err := c.client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+				logger.Get().Error("SSH", "Keepalive failed, closing connection to %s: %v", c.client.RemoteAddr(), err)
+				c.Close()
+				return
+			}
+		}
+	}
+}
+
+// Run runs a command on the remote host with the given stdin, stdout and stderr,
+// any of which may be nil
+func (c *Client) Run(command string, stdin io.Reader, stdout, stderr io.Writer) error {
+	session, err := c.client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to open SSH session: %v", err)
+	}
+	defer session.Close()
+
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+	return session.Run(command)
+}
+
+// Forward listens on a free local port and forwards every connection to
+// remoteAddr, as seen from the remote host. It returns the local address and a
+// function that stops listening.
+func (c *Client) Forward(remoteAddr string) (string, func() error, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to listen for SSH tunnel: %v", err)
+	}
+
+	go func() {
+		for {
+			local, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go c.forwardConn(local, remoteAddr)
+		}
+	}()
+	return listener.Addr().String(), listener.Close, nil
+}
+
+func (c *Client) forwardConn(local net.Conn, remoteAddr string) {
+	defer local.Close()
+	remote, err := c.client.Dial("tcp", remoteAddr)
+	if err != nil {
+		logger.Get().Error("SSH", "Failed to open tunnel to %s: %v", remoteAddr, err)
+		return
+	}
+	defer remote.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(remote, local)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(local, remote)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// Close closes the connection and the connection to the jump host
+func (c *Client) Close() error {
+	var err error
+	c.once.Do(func() {
+		close(c.done)
+		err = c.client.Close()
+		if c.jump != nil {
+			c.jump.Close()
+		}
+	})
+	return err
+}
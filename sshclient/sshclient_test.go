@@ -0,0 +1,353 @@
+package sshclient
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"backupdb/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testServer is an in-process SSH server accepting one client key, running
+// exec requests with sh and opening direct-tcpip channels
+type testServer struct {
+	addr    string
+	port    int
+	hostKey ssh.Signer
+}
+
+func newTestServer(t *testing.T, clientKey ssh.PublicKey) *testServer {
+	_, hostPrivate, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	hostKey, err := ssh.NewSignerFromKey(hostPrivate)
+	assert.NoError(t, err)
+
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "backup" && bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+	}
+	serverConfig.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveConn(conn, serverConfig)
+		}
+	}()
+
+	return &testServer{
+		addr:    listener.Addr().String(),
+		port:    listener.Addr().(*net.TCPAddr).Port,
+		hostKey: hostKey,
+	}
+}
+
+func serveConn(conn net.Conn, serverConfig *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, serverConfig)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		switch newChannel.ChannelType() {
+		case "session":
+			go serveSession(newChannel)
+		case "direct-tcpip":
+			go serveDirectTCPIP(newChannel)
+		default:
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+func serveSession(newChannel ssh.NewChannel) {
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+
+	for req := range reqs {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+		command := string(req.Payload[4:])
+		req.Reply(true, nil)
+
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Stdin = channel
+		cmd.Stdout = channel
+		cmd.Stderr = channel.Stderr()
+		status := uint32(0)
+		if err := cmd.Run(); err != nil {
+			status = 1
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				status = uint32(exitErr.ExitCode())
+			}
+		}
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, status)
+		channel.SendRequest("exit-status", false, payload)
+		return
+	}
+}
+
+func serveDirectTCPIP(newChannel ssh.NewChannel) {
+	var target struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &target); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		io.Copy(channel, conn)
+		channel.CloseWrite()
+		wg.Done()
+	}()
+	go func() {
+		io.Copy(conn, channel)
+		conn.(*net.TCPConn).CloseWrite()
+		wg.Done()
+	}()
+	wg.Wait()
+	channel.Close()
+	conn.Close()
+}
+
+// writeClientKey writes an OpenSSH private key, encrypted if passphrase is set
+func writeClientKey(t *testing.T, passphrase string) (string, ed25519.PrivateKey, ssh.PublicKey) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	var block *pem.Block
+	if passphrase != "" {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(private, "", []byte(passphrase))
+	} else {
+		block, err = ssh.MarshalPrivateKey(private, "")
+	}
+	assert.NoError(t, err)
+
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600))
+
+	signer, err := ssh.NewSignerFromKey(private)
+	assert.NoError(t, err)
+	return keyFile, private, signer.PublicKey()
+}
+
+func writeKnownHosts(t *testing.T, servers ...*testServer) string {
+	var lines []string
+	for _, server := range servers {
+		lines = append(lines, knownhosts.Line([]string{knownhosts.Normalize(server.addr)}, server.hostKey.PublicKey()))
+	}
+	knownHostsFile := filepath.Join(t.TempDir(), "known_hosts")
+	assert.NoError(t, os.WriteFile(knownHostsFile, []byte(strings.Join(lines, "\n")+"\n"), 0600))
+	return knownHostsFile
+}
+
+func TestRunWithKnownHost(t *testing.T) {
+	keyFile, _, publicKey := writeClientKey(t, "")
+	server := newTestServer(t, publicKey)
+
+	client, err := Dial(&config.SSHConfig{
+		Host:           "127.0.0.1",
+		Port:           server.port,
+		User:           "backup",
+		KeyFile:        keyFile,
+		KnownHostsFile: writeKnownHosts(t, server),
+	})
+	assert.NoError(t, err)
+	defer client.Close()
+
+	var stdout, stderr bytes.Buffer
+	err = client.Run("cat; echo done >&2", strings.NewReader("from stdin"), &stdout, &stderr)
+	assert.NoError(t, err)
+	assert.Equal(t, "from stdin", stdout.String())
+	assert.Equal(t, "done\n", stderr.String())
+
+	err = client.Run("exit 3", nil, nil, nil)
+	var exitErr *ssh.ExitError
+	assert.ErrorAs(t, err, &exitErr)
+	assert.Equal(t, 3, exitErr.ExitStatus())
+}
+
+func TestDialRejectsUnknownHostKey(t *testing.T) {
+	keyFile, _, publicKey := writeClientKey(t, "")
+	server := newTestServer(t, publicKey)
+	otherServer := newTestServer(t, publicKey)
+
+	// known_hosts lists another key for this address
+	otherServer.addr = server.addr
+	_, err := Dial(&config.SSHConfig{
+		Host:           "127.0.0.1",
+		Port:           server.port,
+		User:           "backup",
+		KeyFile:        keyFile,
+		KnownHostsFile: writeKnownHosts(t, otherServer),
+	})
+	assert.ErrorContains(t, err, "key mismatch")
+
+	client, err := Dial(&config.SSHConfig{
+		Host:                  "127.0.0.1",
+		Port:                  server.port,
+		User:                  "backup",
+		KeyFile:               keyFile,
+		InsecureIgnoreHostKey: true,
+	})
+	assert.NoError(t, err)
+	client.Close()
+}
+
+func TestDialWithPassphraseAndAgent(t *testing.T) {
+	keyFile, private, publicKey := writeClientKey(t, "correct horse")
+	server := newTestServer(t, publicKey)
+	knownHostsFile := writeKnownHosts(t, server)
+
+	cfg := &config.SSHConfig{
+		Host:           "127.0.0.1",
+		Port:           server.port,
+		User:           "backup",
+		KeyFile:        keyFile,
+		KeyPassphrase:  "wrong",
+		KnownHostsFile: knownHostsFile,
+	}
+	_, err := Dial(cfg)
+	assert.ErrorContains(t, err, "failed to parse SSH key file")
+
+	cfg.KeyPassphrase = "correct horse"
+	client, err := Dial(cfg)
+	assert.NoError(t, err)
+	client.Close()
+
+	// Serve the key from an in-process agent
+	keyring := agent.NewKeyring()
+	assert.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: private}))
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	assert.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", socket)
+
+	client, err = Dial(&config.SSHConfig{
+		Host:           "127.0.0.1",
+		Port:           server.port,
+		User:           "backup",
+		UseAgent:       true,
+		KnownHostsFile: knownHostsFile,
+	})
+	assert.NoError(t, err)
+	client.Close()
+}
+
+func TestForwardThroughJumpHost(t *testing.T) {
+	keyFile, _, publicKey := writeClientKey(t, "")
+	jumpServer := newTestServer(t, publicKey)
+	server := newTestServer(t, publicKey)
+	knownHostsFile := writeKnownHosts(t, jumpServer, server)
+
+	// A TCP echo service only reachable "behind" the SSH host
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	client, err := Dial(&config.SSHConfig{
+		Host:           "127.0.0.1",
+		Port:           server.port,
+		User:           "backup",
+		KeyFile:        keyFile,
+		KnownHostsFile: knownHostsFile,
+		Jump: &config.SSHConfig{
+			Host:           "127.0.0.1",
+			Port:           jumpServer.port,
+			User:           "backup",
+			KeyFile:        keyFile,
+			KnownHostsFile: knownHostsFile,
+		},
+	})
+	assert.NoError(t, err)
+	defer client.Close()
+
+	localAddr, stop, err := client.Forward(echo.Addr().String())
+	assert.NoError(t, err)
+	defer stop()
+
+	conn, err := net.Dial("tcp", localAddr)
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	assert.NoError(t, err)
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(conn, reply)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(reply))
+}
@@ -2,7 +2,10 @@ package storage
 
 import (
 	"fmt"
+	"io"
 	"os"
+	"sort"
+	"time"
 
 	"backupdb/config"
 	"backupdb/logger"
@@ -21,7 +24,39 @@ type BackupFileSender interface {
 }
 
 type RemoteRetentionProvider interface {
-	CleanupRemoteBackups(backup config.BackupConfig) error
+	// CleanupRemoteBackups applies remote retention and returns the names of deleted archives.
+	// Pinned archive names are never deleted and do not count towards the retention limits.
+	CleanupRemoteBackups(backup config.BackupConfig, pinned map[string]bool) ([]string, error)
+}
+
+// ArchiveLister is implemented by providers that can list the archives of a backup
+type ArchiveLister interface {
+	ListArchives(backup config.BackupConfig) ([]RemoteArchive, error)
+}
+
+// ArchiveDownloader is implemented by providers that can download an archive of a backup
+type ArchiveDownloader interface {
+	DownloadArchive(backup config.BackupConfig, name string, w io.Writer) error
+}
+
+// RemoteArchive describes a backup archive stored by a provider
+type RemoteArchive struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// UploadResult holds the outcome of sending a file to a single storage provider
+type UploadResult struct {
+	Storage string
+	Err     error
+}
+
+// RetentionResult holds the outcome of remote retention on a single storage provider
+type RetentionResult struct {
+	Storage string
+	Deleted []string
+	Err     error
 }
 
 // StorageService manages multiple storage providers
@@ -81,16 +116,24 @@ func NewStorageService(cfg *config.Config) *StorageService {
 
 // SendToStorage sends a backup file to all specified storage providers
 func (s *StorageService) SendToStorage(filePath string, backup config.BackupConfig) error {
+	_, err := s.SendToStorageWithResults(filePath, backup)
+	return err
+}
+
+// SendToStorageWithResults sends a backup file to all specified storage providers
+// and reports the outcome for each of them
+func (s *StorageService) SendToStorageWithResults(filePath string, backup config.BackupConfig) ([]UploadResult, error) {
 	s.log.Info("Storage", "[%s] Sending file to storage: %s", backup.Name, filePath)
 
 	// Verify file exists
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		return fmt.Errorf("backup file does not exist: %s", filePath)
+		return nil, fmt.Errorf("backup file does not exist: %s", filePath)
 	}
 
 	// Track if any storage provider succeeded
 	anySuccess := false
 	var lastError error
+	var results []UploadResult
 
 	// Send to each specified storage provider
 	for _, name := range backup.Storage {
@@ -98,6 +141,7 @@ func (s *StorageService) SendToStorage(filePath string, backup config.BackupConf
 		if err != nil {
 			s.log.Error("Storage", "[%s] Failed to get storage provider: %s", backup.Name, name)
 			lastError = err
+			results = append(results, UploadResult{Storage: name, Err: err})
 			continue
 		}
 
@@ -111,31 +155,42 @@ func (s *StorageService) SendToStorage(filePath string, backup config.BackupConf
 		if err != nil {
 			s.log.Error("Storage", "[%s] Failed to send file to provider %s: %v", backup.Name, name, err)
 			lastError = err
+			results = append(results, UploadResult{Storage: name, Err: err})
 			continue
 		}
 
 		s.log.Info("Storage", "[%s] File sent successfully to provider: %s", backup.Name, name)
+		results = append(results, UploadResult{Storage: name})
 		anySuccess = true
 	}
 
 	if !anySuccess {
-		return fmt.Errorf("failed to send file to any storage provider: %v", lastError)
+		return results, fmt.Errorf("failed to send file to any storage provider: %v", lastError)
 	}
 
 	s.log.Info("Storage", "[%s] File sent successfully to at least one provider: %s", backup.Name, filePath)
-	return nil
+	return results, nil
 }
 
 func (s *StorageService) CleanupRemoteRetention(backup config.BackupConfig) error {
+	_, err := s.CleanupRemoteRetentionWithResults(backup, nil)
+	return err
+}
+
+// CleanupRemoteRetentionWithResults applies remote retention on every storage of the backup,
+// keeping pinned archives, and reports the deleted archives for each provider
+func (s *StorageService) CleanupRemoteRetentionWithResults(backup config.BackupConfig, pinned map[string]bool) ([]RetentionResult, error) {
 	if !backup.RemoteRetention.Enabled {
-		return nil
+		return nil, nil
 	}
 
 	var lastError error
+	var results []RetentionResult
 	for _, name := range backup.Storage {
 		provider, err := s.GetProvider(name)
 		if err != nil {
 			lastError = err
+			results = append(results, RetentionResult{Storage: name, Err: err})
 			continue
 		}
 
@@ -145,13 +200,15 @@ func (s *StorageService) CleanupRemoteRetention(backup config.BackupConfig) erro
 			continue
 		}
 
-		if err := retentionProvider.CleanupRemoteBackups(backup); err != nil {
+		deleted, err := retentionProvider.CleanupRemoteBackups(backup, pinned)
+		if err != nil {
 			s.log.Error("Storage", "[%s] Failed to clean up remote backups for provider %s: %v", backup.Name, name, err)
 			lastError = err
 		}
+		results = append(results, RetentionResult{Storage: name, Deleted: deleted, Err: err})
 	}
 
-	return lastError
+	return results, lastError
 }
 
 // GetProvider returns a specific storage provider by name
@@ -163,3 +220,48 @@ func (s *StorageService) GetProvider(name string) (StorageProvider, error) {
 	}
 	return provider, nil
 }
+
+// ListArchives lists the archives of a backup stored by the named provider, newest first.
+// The name "local" lists the archives kept in the local backups directory.
+func (s *StorageService) ListArchives(name string, backup config.BackupConfig) ([]RemoteArchive, error) {
+	if name == LocalStorageName {
+		return listLocalArchives(backup)
+	}
+
+	provider, err := s.GetProvider(name)
+	if err != nil {
+		return nil, err
+	}
+	lister, ok := provider.(ArchiveLister)
+	if !ok {
+		return nil, fmt.Errorf("storage provider %s does not support listing archives", name)
+	}
+	return lister.ListArchives(backup)
+}
+
+// DownloadArchive writes an archive of a backup stored by the named provider to w.
+// The name "local" reads from the local backups directory.
+func (s *StorageService) DownloadArchive(name string, backup config.BackupConfig, archiveName string, w io.Writer) error {
+	if name == LocalStorageName {
+		return downloadLocalArchive(backup, archiveName, w)
+	}
+
+	provider, err := s.GetProvider(name)
+	if err != nil {
+		return err
+	}
+	downloader, ok := provider.(ArchiveDownloader)
+	if !ok {
+		return fmt.Errorf("storage provider %s does not support downloading archives", name)
+	}
+	return downloader.DownloadArchive(backup, archiveName, w)
+}
+
+func sortRemoteArchives(archives []RemoteArchive) {
+	sort.Slice(archives, func(i, j int) bool {
+		if archives[i].Timestamp.Equal(archives[j].Timestamp) {
+			return archives[i].Name > archives[j].Name
+		}
+		return archives[i].Timestamp.After(archives[j].Timestamp)
+	})
+}
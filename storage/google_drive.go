@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -30,6 +31,7 @@ const (
 type googleDriveBackupFile struct {
 	ID        string
 	Name      string
+	Size      int64
 	Timestamp time.Time
 }
 
@@ -317,24 +319,20 @@ func (p *GoogleDriveProvider) SendFile(filePath string) error {
 	return nil
 }
 
-func (p *GoogleDriveProvider) CleanupRemoteBackups(backup config.BackupConfig) error {
-	if !backup.RemoteRetention.Enabled {
-		return nil
-	}
-
+func (p *GoogleDriveProvider) listBackupFiles(backup config.BackupConfig) ([]googleDriveBackupFile, error) {
 	query := googleDriveBackupListQuery(p.config.FolderID, backup.Name)
 	call := p.service.Files.List().
 		Q(query).
 		SupportsAllDrives(true).
 		IncludeItemsFromAllDrives(true).
 		PageSize(1000).
-		Fields("nextPageToken, files(id, name, mimeType)")
+		Fields("nextPageToken, files(id, name, mimeType, size)")
 
 	var files []googleDriveBackupFile
 	for {
 		result, err := call.Do()
 		if err != nil {
-			return fmt.Errorf("failed to list Google Drive files for retention: %v", err)
+			return nil, fmt.Errorf("failed to list Google Drive files: %v", err)
 		}
 
 		for _, driveFile := range result.Files {
@@ -343,6 +341,7 @@ func (p *GoogleDriveProvider) CleanupRemoteBackups(backup config.BackupConfig) e
 			}
 			backupFile, ok := parseGoogleDriveBackupFile(driveFile.Id, driveFile.Name, backup.Name)
 			if ok {
+				backupFile.Size = driveFile.Size
 				files = append(files, backupFile)
 			}
 		}
@@ -352,21 +351,81 @@ func (p *GoogleDriveProvider) CleanupRemoteBackups(backup config.BackupConfig) e
 		}
 		call.PageToken(result.NextPageToken)
 	}
+	return files, nil
+}
+
+// ListArchives implements ArchiveLister interface
+func (p *GoogleDriveProvider) ListArchives(backup config.BackupConfig) ([]RemoteArchive, error) {
+	files, err := p.listBackupFiles(backup)
+	if err != nil {
+		return nil, err
+	}
+
+	archives := make([]RemoteArchive, 0, len(files))
+	for _, file := range files {
+		archives = append(archives, RemoteArchive{Name: file.Name, Size: file.Size, Timestamp: file.Timestamp})
+	}
+	sortRemoteArchives(archives)
+	return archives, nil
+}
+
+// DownloadArchive implements ArchiveDownloader interface
+func (p *GoogleDriveProvider) DownloadArchive(backup config.BackupConfig, name string, w io.Writer) error {
+	files, err := p.listBackupFiles(backup)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if file.Name != name {
+			continue
+		}
+		resp, err := p.service.Files.Get(file.ID).SupportsAllDrives(true).Download()
+		if err != nil {
+			return fmt.Errorf("failed to download Google Drive file %s (%s): %v", file.Name, file.ID, err)
+		}
+		defer resp.Body.Close()
+
+		if _, err := io.Copy(w, resp.Body); err != nil {
+			return fmt.Errorf("failed to read Google Drive file %s (%s): %v", file.Name, file.ID, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("archive %s not found in Google Drive folder %s", name, p.config.FolderID)
+}
+
+func (p *GoogleDriveProvider) CleanupRemoteBackups(backup config.BackupConfig, pinned map[string]bool) ([]string, error) {
+	if !backup.RemoteRetention.Enabled {
+		return nil, nil
+	}
+
+	listed, err := p.listBackupFiles(backup)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Google Drive files for retention: %v", err)
+	}
+	var files []googleDriveBackupFile
+	for _, file := range listed {
+		if !pinned[file.Name] {
+			files = append(files, file)
+		}
+	}
 
 	toDelete := selectGoogleDriveBackupsToDelete(files, backup.RemoteRetention, time.Now())
+	var deleted []string
 	for _, file := range toDelete {
 		if err := p.service.Files.Delete(file.ID).SupportsAllDrives(true).Do(); err != nil {
-			return fmt.Errorf("failed to delete Google Drive file %s (%s): %v", file.Name, file.ID, err)
+			return deleted, fmt.Errorf("failed to delete Google Drive file %s (%s): %v", file.Name, file.ID, err)
 		}
+		deleted = append(deleted, file.Name)
 	}
 
 	p.log.Info("Google Drive remote retention completed",
 		"backup", backup.Name,
 		"folder_id", p.config.FolderID,
 		"matched", len(files),
-		"deleted", len(toDelete),
+		"deleted", len(deleted),
 	)
-	return nil
+	return deleted, nil
 }
 
 // GetName implements StorageProvider interface
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"backupdb/config"
+)
+
+// LocalStorageName is the storage name used for archives kept in the local backups directory
+const LocalStorageName = "local"
+
+// LocalBackupDir returns the directory holding the local archives of a backup
+func LocalBackupDir(backup config.BackupConfig) string {
+	return filepath.Join("backups", backup.Name)
+}
+
+func parseLocalArchiveName(name, backupName string) (time.Time, bool) {
+	pattern := fmt.Sprintf(`^%s_(\d{14})(?:_\d{1,9})?\.tar\.gz$`, regexp.QuoteMeta(backupName))
+	matches := regexp.MustCompile(pattern).FindStringSubmatch(name)
+	if len(matches) != 2 {
+		return time.Time{}, false
+	}
+
+	timestamp, err := time.Parse("20060102150405", matches[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return timestamp, true
+}
+
+func listLocalArchives(backup config.BackupConfig) ([]RemoteArchive, error) {
+	entries, err := os.ReadDir(LocalBackupDir(backup))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup directory: %v", err)
+	}
+
+	var archives []RemoteArchive
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		timestamp, ok := parseLocalArchiveName(entry.Name(), backup.Name)
+		if !ok {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		archives = append(archives, RemoteArchive{Name: entry.Name(), Size: info.Size(), Timestamp: timestamp})
+	}
+	sortRemoteArchives(archives)
+	return archives, nil
+}
+
+func downloadLocalArchive(backup config.BackupConfig, name string, w io.Writer) error {
+	if _, ok := parseLocalArchiveName(name, backup.Name); !ok {
+		return fmt.Errorf("%s is not an archive of backup %s", name, backup.Name)
+	}
+
+	file, err := os.Open(filepath.Join(LocalBackupDir(backup), name))
+	if err != nil {
+		return fmt.Errorf("failed to open archive %s: %v", name, err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(w, file); err != nil {
+		return fmt.Errorf("failed to read archive %s: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"backupdb/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalArchives(t *testing.T) {
+	backup := config.BackupConfig{Name: "local-test"}
+	dir := LocalBackupDir(backup)
+	os.MkdirAll(dir, 0755)
+	defer os.RemoveAll("backups")
+
+	os.WriteFile(filepath.Join(dir, "local-test_20260508010000_000000001.tar.gz"), []byte("old"), 0644)
+	os.WriteFile(filepath.Join(dir, "local-test_20260508020000_000000001.tar.gz"), []byte("newest"), 0644)
+	os.WriteFile(filepath.Join(dir, "other_20260508030000_000000001.tar.gz"), []byte("other"), 0644)
+
+	service := NewStorageService(&config.Config{})
+	archives, err := service.ListArchives(LocalStorageName, backup)
+	assert.NoError(t, err)
+	assert.Len(t, archives, 2)
+	assert.Equal(t, "local-test_20260508020000_000000001.tar.gz", archives[0].Name)
+	assert.Equal(t, int64(6), archives[0].Size)
+
+	var buf bytes.Buffer
+	assert.NoError(t, service.DownloadArchive(LocalStorageName, backup, archives[1].Name, &buf))
+	assert.Equal(t, "old", buf.String())
+
+	assert.Error(t, service.DownloadArchive(LocalStorageName, backup, "../other_20260508030000_000000001.tar.gz", &buf))
+	_, err = service.ListArchives("missing", backup)
+	assert.Error(t, err)
+}
@@ -3,6 +3,7 @@ package storage
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -12,23 +13,25 @@ import (
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 
 	"backupdb/config"
 	"backupdb/logger"
+	"backupdb/secrets"
 )
 
 // S3Provider implements StorageProvider for AWS S3
 type S3Provider struct {
-	config config.StorageConfig
-	client *s3.Client
-	log    *logger.Logger
+	config      config.StorageConfig
+	client      *s3.Client
+	credentials *aws.CredentialsCache
+	log         *logger.Logger
 }
 
 type s3BackupObject struct {
 	Key       string
+	Size      int64
 	Timestamp time.Time
 }
 
@@ -52,14 +55,16 @@ func NewS3Provider(cfg config.StorageConfig) (*S3Provider, error) {
 		return nil, fmt.Errorf("s3 secret access key is required")
 	}
 
+	// Credentials may be secret references, so they are resolved when the
+	// client needs them and the cache is invalidated before each upload
+	credentialsCache := aws.NewCredentialsCache(aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+		return resolveS3Credentials(cfg)
+	}))
+
 	// Create AWS configuration
 	awsCfg, err := awsconfig.LoadDefaultConfig(context.Background(),
 		awsconfig.WithRegion(cfg.Region),
-		awsconfig.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
-			cfg.AccessKeyID,
-			cfg.SecretAccessKey,
-			"",
-		)),
+		awsconfig.WithCredentialsProvider(credentialsCache),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load AWS config: %v", err)
@@ -78,9 +83,28 @@ func NewS3Provider(cfg config.StorageConfig) (*S3Provider, error) {
 	}
 
 	return &S3Provider{
-		config: cfg,
-		client: client,
-		log:    logger.Get(),
+		config:      cfg,
+		client:      client,
+		credentials: credentialsCache,
+		log:         logger.Get(),
+	}, nil
+}
+
+// resolveS3Credentials returns the credentials of a storage with secret references resolved
+func resolveS3Credentials(cfg config.StorageConfig) (aws.Credentials, error) {
+	accessKeyID, err := secrets.Resolve(cfg.AccessKeyID)
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("failed to resolve s3 access key ID: %v", err)
+	}
+	secretAccessKey, err := secrets.Resolve(cfg.SecretAccessKey)
+	if err != nil {
+		return aws.Credentials{}, fmt.Errorf("failed to resolve s3 secret access key: %v", err)
+	}
+	logger.RegisterSecret(secretAccessKey)
+	return aws.Credentials{
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretAccessKey,
+		Source:          "backupdb",
 	}, nil
 }
 
@@ -225,6 +249,9 @@ func (p *S3Provider) SendBackupFile(filePath string, backup config.BackupConfig)
 }
 
 func (p *S3Provider) sendFileWithPrefix(filePath, prefix string) error {
+	// Fetch secret credentials again for every run
+	p.credentials.Invalidate()
+
 	p.log.Info("Sending file to S3",
 		"file", filePath,
 		"bucket", p.config.Bucket,
@@ -274,11 +301,7 @@ func (p *S3Provider) sendFileWithPrefix(filePath, prefix string) error {
 	return nil
 }
 
-func (p *S3Provider) CleanupRemoteBackups(backup config.BackupConfig) error {
-	if !backup.RemoteRetention.Enabled {
-		return nil
-	}
-
+func (p *S3Provider) listBackupObjects(backup config.BackupConfig) ([]s3BackupObject, error) {
 	prefix := effectiveS3ObjectKeyPrefix(backup, p.config)
 	paginator := s3.NewListObjectsV2Paginator(p.client, &s3.ListObjectsV2Input{
 		Bucket: aws.String(p.config.Bucket),
@@ -289,7 +312,7 @@ func (p *S3Provider) CleanupRemoteBackups(backup config.BackupConfig) error {
 	for paginator.HasMorePages() {
 		page, err := paginator.NextPage(context.Background())
 		if err != nil {
-			return fmt.Errorf("failed to list S3 objects for retention: %v", err)
+			return nil, fmt.Errorf("failed to list S3 objects: %v", err)
 		}
 
 		for _, object := range page.Contents {
@@ -298,16 +321,77 @@ func (p *S3Provider) CleanupRemoteBackups(backup config.BackupConfig) error {
 			}
 			backupObject, ok := parseS3BackupObject(*object.Key, prefix, backup.Name)
 			if ok {
+				backupObject.Size = aws.ToInt64(object.Size)
 				objects = append(objects, backupObject)
 			}
 		}
 	}
+	return objects, nil
+}
+
+// ListArchives implements ArchiveLister interface
+func (p *S3Provider) ListArchives(backup config.BackupConfig) ([]RemoteArchive, error) {
+	objects, err := p.listBackupObjects(backup)
+	if err != nil {
+		return nil, err
+	}
+
+	archives := make([]RemoteArchive, 0, len(objects))
+	for _, object := range objects {
+		archives = append(archives, RemoteArchive{
+			Name:      filepath.Base(object.Key),
+			Size:      object.Size,
+			Timestamp: object.Timestamp,
+		})
+	}
+	sortRemoteArchives(archives)
+	return archives, nil
+}
+
+// DownloadArchive implements ArchiveDownloader interface
+func (p *S3Provider) DownloadArchive(backup config.BackupConfig, name string, w io.Writer) error {
+	if _, ok := parseS3BackupObject(name, "", backup.Name); !ok {
+		return fmt.Errorf("%s is not an archive of backup %s", name, backup.Name)
+	}
+
+	output, err := p.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(p.config.Bucket),
+		Key:    aws.String(s3ObjectKey(name, effectiveS3ObjectKeyPrefix(backup, p.config))),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to download S3 object %s: %v", name, err)
+	}
+	defer output.Body.Close()
+
+	if _, err := io.Copy(w, output.Body); err != nil {
+		return fmt.Errorf("failed to read S3 object %s: %v", name, err)
+	}
+	return nil
+}
+
+func (p *S3Provider) CleanupRemoteBackups(backup config.BackupConfig, pinned map[string]bool) ([]string, error) {
+	if !backup.RemoteRetention.Enabled {
+		return nil, nil
+	}
+
+	listed, err := p.listBackupObjects(backup)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list S3 objects for retention: %v", err)
+	}
+	var objects []s3BackupObject
+	for _, object := range listed {
+		if !pinned[filepath.Base(object.Key)] {
+			objects = append(objects, object)
+		}
+	}
 
 	toDelete := selectS3BackupsToDelete(objects, backup.RemoteRetention, time.Now())
 	if len(toDelete) == 0 {
-		return nil
+		return nil, nil
 	}
 
+	var deleted []string
+
 	for start := 0; start < len(toDelete); start += 1000 {
 		end := start + 1000
 		if end > len(toDelete) {
@@ -323,10 +407,15 @@ func (p *S3Provider) CleanupRemoteBackups(backup config.BackupConfig) error {
 			Delete: &types.Delete{Objects: identifiers},
 		})
 		if err != nil {
-			return fmt.Errorf("failed to delete S3 objects for retention: %v", err)
+			return deleted, fmt.Errorf("failed to delete S3 objects for retention: %v", err)
+		}
+		for _, object := range output.Deleted {
+			if object.Key != nil {
+				deleted = append(deleted, *object.Key)
+			}
 		}
 		if len(output.Errors) > 0 {
-			return fmt.Errorf("failed to delete %d S3 objects for retention", len(output.Errors))
+			return deleted, fmt.Errorf("failed to delete %d S3 objects for retention", len(output.Errors))
 		}
 	}
 
@@ -334,9 +423,9 @@ func (p *S3Provider) CleanupRemoteBackups(backup config.BackupConfig) error {
 		"backup", backup.Name,
 		"bucket", p.config.Bucket,
 		"matched", len(objects),
-		"deleted", len(toDelete),
+		"deleted", len(deleted),
 	)
-	return nil
+	return deleted, nil
 }
 
 // GetName implements StorageProvider interface
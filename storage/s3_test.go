@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -248,3 +249,23 @@ func TestS3ProviderSendFile(t *testing.T) {
 	assert.Error(t, err)
 	assert.Nil(t, provider)
 }
+
+func TestNewS3ProviderResolvesSecretCredentials(t *testing.T) {
+	cfg := config.StorageConfig{
+		Enabled:              true,
+		Kind:                 "s3",
+		Bucket:               "test-bucket",
+		Region:               "us-west-2",
+		AccessKeyID:          "test-key",
+		SecretAccessKey:      "exec:echo resolved-secret",
+		SkipBucketValidation: true,
+	}
+
+	provider, err := NewS3Provider(cfg)
+	assert.NoError(t, err)
+
+	credentials, err := provider.credentials.Retrieve(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "test-key", credentials.AccessKeyID)
+	assert.Equal(t, "resolved-secret", credentials.SecretAccessKey)
+}